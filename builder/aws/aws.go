@@ -3,72 +3,160 @@ package aws
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
 	cfnTypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
 	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
 )
 
+// ErrStackNotFound is returned when a CloudFormation stack does not exist
+var ErrStackNotFound = errors.New("stack does not exist")
+
+// ErrObjectNotFound is returned when an S3 object does not exist
+var ErrObjectNotFound = errors.New("object does not exist")
+
+// ErrParameterNotFound is returned when an SSM parameter does not exist
+var ErrParameterNotFound = errors.New("parameter does not exist")
+
+// ErrAccessDenied is returned when the build role lacks a permission the call needs
+var ErrAccessDenied = errors.New("access denied")
+
 type AWSInterface interface {
 	// SSM
 	GetParameter(name string) (string, error)
 	GetParametersByPath(path string) (map[string]string, error)
 	SetParameter(name string, value string) error
+	DeleteParameter(name string) error
+	DeleteParametersByPath(path string) (int, error)
+	ListParametersByTag(path, key, value string) ([]string, error)
+	// Secrets Manager
+	GetSecretValue(ref SecretReference) (string, error)
 	// CloudFormation
 	DescribeStack(name string) (*cfnTypes.Stack, error)
 	DestroyStack(name string) error
+	ListStackResources(name string) ([]cfnTypes.StackResourceSummary, error)
 	// ECR
 	GetECRLogin() (string, string, error)
-	CopyFromS3(bucket, prefix, dest string) error
-	SyncToS3(src, bucket, prefix string, quiet bool) error
+	// S3
+	GetObject(bucket, key string) ([]byte, error)
+	PutObject(bucket, key string, body []byte) error
+	DownloadStream(bucket, key string) (io.ReadCloser, error)
+	UploadStream(bucket, key string, body io.Reader) error
+	DeleteObject(bucket, key string) error
+	ListObjects(bucket, prefix string) (map[string]time.Time, error)
+	DeleteObjectsByPrefix(bucket, prefix string) (int, error)
+	DeleteObjects(bucket string, keys []string) (int, error)
+	CopyFromS3(bucket string, prefixes []string, dest string) (string, TransferStats, error)
+	SyncToS3(src, bucket, prefix string) (TransferStats, error)
 }
 
 type AWS struct {
 	config  *aws.Config
 	context context.Context
+	// service clients are shared by every call
+	ssm            *ssm.Client
+	cloudformation *cloudformation.Client
+	ecr            *ecr.Client
+	secretsmanager *secretsmanager.Client
+	s3             *s3.Client
+	s3Options      S3Options
+	parameters     *parameterCache
+	metrics        *metricsRecorder
+	// secrets caches SecretString values by secretCacheKey
+	secrets   map[string]string
+	secretsMu sync.Mutex
 }
 
 func New(config *aws.Config, context context.Context) *AWS {
+	metrics := &metricsRecorder{metrics: Metrics{Calls: map[string]int{}}}
+	cfg := config.Copy()
+	cfg.Retryer = newRetryer
+	cfg.APIOptions = append(cfg.APIOptions, metrics.addMiddleware)
 	return &AWS{
-		config:  config,
-		context: context,
+		config:         &cfg,
+		context:        context,
+		ssm:            ssm.NewFromConfig(cfg),
+		cloudformation: cloudformation.NewFromConfig(cfg),
+		ecr:            ecr.NewFromConfig(cfg),
+		secretsmanager: secretsmanager.NewFromConfig(cfg),
+		s3:             newS3Client(cfg, DefaultS3Options),
+		s3Options:      DefaultS3Options,
+		parameters:     newParameterCache(),
+		metrics:        metrics,
+		secrets:        map[string]string{},
 	}
 }
 
+// Metrics returns the API calls made so far
+func (a *AWS) Metrics() Metrics {
+	return a.metrics.snapshot()
+}
+
+func (a *AWS) cacheHit() {
+	a.metrics.record(func(m *Metrics) { m.CacheHits++ })
+}
+
 // SSM Parameter Store
 
 func (a *AWS) SetParameter(name string, value string) error {
-	ssmSvc := ssm.NewFromConfig(*a.config)
-	_, err := ssmSvc.PutParameter(a.context, &ssm.PutParameterInput{
+	_, err := a.ssm.PutParameter(a.context, &ssm.PutParameterInput{
 		Name:      &name,
 		Value:     &value,
 		Overwrite: aws.Bool(true),
 		Type:      ssmTypes.ParameterTypeString,
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	a.parameters.set(name, value)
+	return nil
 }
 
 func (a *AWS) GetParameter(name string) (string, error) {
-	ssmSvc := ssm.NewFromConfig(*a.config)
-	result, err := ssmSvc.GetParameter(a.context, &ssm.GetParameterInput{
-		Name: &name,
+	if value, ok := a.parameters.get(name); ok {
+		a.cacheHit()
+		return value, nil
+	}
+	result, err := a.ssm.GetParameter(a.context, &ssm.GetParameterInput{
+		Name:           &name,
+		WithDecryption: aws.Bool(true),
 	})
+	var notFound *ssmTypes.ParameterNotFound
+	if errors.As(err, &notFound) {
+		return "", fmt.Errorf("%w: %s", ErrParameterNotFound, name)
+	}
 	if err != nil {
 		return "", err
 	}
+	a.parameters.put(name, *result.Parameter.Value)
 	return *result.Parameter.Value, nil
 }
 
+// getParametersByPathPageSize is the most results GetParametersByPath returns per call
+const getParametersByPathPageSize = 10
+
 func (a *AWS) GetParametersByPath(path string) (map[string]string, error) {
-	ssmSvc := ssm.NewFromConfig(*a.config)
-	paginator := ssm.NewGetParametersByPathPaginator(ssmSvc, &ssm.GetParametersByPathInput{
+	if params, ok := a.parameters.getPath(path); ok {
+		a.cacheHit()
+		return params, nil
+	}
+	paginator := ssm.NewGetParametersByPathPaginator(a.ssm, &ssm.GetParametersByPathInput{
 		Path:           &path,
 		WithDecryption: aws.Bool(true),
+		MaxResults:     aws.Int32(getParametersByPathPageSize),
 	})
 	params := make(map[string]string)
 	for paginator.HasMorePages() {
@@ -80,16 +168,191 @@ func (a *AWS) GetParametersByPath(path string) (map[string]string, error) {
 			params[*p.Name] = *p.Value
 		}
 	}
+	a.parameters.setPath(path, params)
 	return params, nil
 }
 
+func (a *AWS) DeleteParameter(name string) error {
+	_, err := a.ssm.DeleteParameter(a.context, &ssm.DeleteParameterInput{
+		Name: &name,
+	})
+	a.parameters.delete(name)
+	var notFound *ssmTypes.ParameterNotFound
+	if errors.As(err, &notFound) {
+		return nil
+	}
+	return err
+}
+
+// deleteParametersBatchSize is the most names DeleteParameters accepts
+const deleteParametersBatchSize = 10
+
+func batches(names []string, size int) [][]string {
+	result := [][]string{}
+	for len(names) > size {
+		result = append(result, names[:size])
+		names = names[size:]
+	}
+	if len(names) > 0 {
+		result = append(result, names)
+	}
+	return result
+}
+
+// DeleteParametersByPath deletes every parameter under the path, including
+// nested paths, and returns how many were deleted
+func (a *AWS) DeleteParametersByPath(path string) (int, error) {
+	// forget the path even if only some of it is deleted
+	defer a.parameters.delete(path)
+	paginator := ssm.NewGetParametersByPathPaginator(a.ssm, &ssm.GetParametersByPathInput{
+		Path:       &path,
+		Recursive:  aws.Bool(true),
+		MaxResults: aws.Int32(getParametersByPathPageSize),
+	})
+	names := []string{}
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(a.context)
+		if err != nil {
+			return 0, err
+		}
+		for _, p := range output.Parameters {
+			names = append(names, *p.Name)
+		}
+	}
+	deleted := 0
+	for _, batch := range batches(names, deleteParametersBatchSize) {
+		output, err := a.ssm.DeleteParameters(a.context, &ssm.DeleteParametersInput{
+			Names: batch,
+		})
+		if err != nil {
+			return deleted, err
+		}
+		deleted += len(output.DeletedParameters)
+	}
+	return deleted, nil
+}
+
+// isAccessDenied checks for an IAM permission error
+func isAccessDenied(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.ErrorCode() == "AccessDeniedException"
+}
+
+// ListParametersByTag returns the names of the parameters directly under the
+// path which have the tag set to value. An error wrapping ErrAccessDenied is
+// returned if the role can't describe parameters.
+func (a *AWS) ListParametersByTag(path, key, value string) ([]string, error) {
+	paginator := ssm.NewDescribeParametersPaginator(a.ssm, &ssm.DescribeParametersInput{
+		ParameterFilters: []ssmTypes.ParameterStringFilter{
+			{Key: aws.String("Path"), Option: aws.String("OneLevel"), Values: []string{strings.TrimSuffix(path, "/")}},
+			{Key: aws.String("tag:" + key), Values: []string{value}},
+		},
+	})
+	names := []string{}
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(a.context)
+		if isAccessDenied(err) {
+			return nil, fmt.Errorf("%w: %w", ErrAccessDenied, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range output.Parameters {
+			names = append(names, *p.Name)
+		}
+	}
+	return names, nil
+}
+
+// Secrets Manager
+
+// SecretReference identifies a Secrets Manager value. JSONKey, VersionStage and
+// VersionID are optional, without a JSONKey the whole SecretString is used.
+type SecretReference struct {
+	SecretID     string
+	JSONKey      string
+	VersionStage string
+	VersionID    string
+}
+
+func (r SecretReference) cacheKey() string {
+	return strings.Join([]string{r.SecretID, r.VersionStage, r.VersionID}, "|")
+}
+
+// extractJSONKey returns the value of key in a SecretString holding a JSON object
+func extractJSONKey(secret, key string) (string, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &values); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object")
+	}
+	value, ok := values[key]
+	if !ok {
+		return "", fmt.Errorf("secret has no key %q", key)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	// numbers, booleans and nested values are passed on as JSON
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// GetSecretValue returns the referenced SecretString, or one key of it. Secrets
+// are cached, so each one is only fetched once no matter how many keys are used.
+func (a *AWS) GetSecretValue(ref SecretReference) (string, error) {
+	a.secretsMu.Lock()
+	defer a.secretsMu.Unlock()
+	secret, ok := a.secrets[ref.cacheKey()]
+	if !ok {
+		input := &secretsmanager.GetSecretValueInput{SecretId: &ref.SecretID}
+		if ref.VersionStage != "" {
+			input.VersionStage = &ref.VersionStage
+		}
+		if ref.VersionID != "" {
+			input.VersionId = &ref.VersionID
+		}
+		result, err := a.secretsmanager.GetSecretValue(a.context, input)
+		if err != nil {
+			return "", err
+		}
+		if result.SecretString == nil {
+			return "", fmt.Errorf("secret %s has no SecretString", ref.SecretID)
+		}
+		secret = *result.SecretString
+		a.secrets[ref.cacheKey()] = secret
+	}
+	if ref.JSONKey == "" {
+		return secret, nil
+	}
+	return extractJSONKey(secret, ref.JSONKey)
+}
+
 // Cloudformation
 
+// isStackNotFound checks for the error CloudFormation returns for a missing stack.
+// It has no dedicated error code, only a ValidationError with this message.
+func isStackNotFound(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.ErrorCode() == "ValidationError" && strings.Contains(apiErr.ErrorMessage(), "does not exist")
+}
+
+// DescribeStack returns the stack or an error wrapping ErrStackNotFound
 func (a *AWS) DescribeStack(stackName string) (*cfnTypes.Stack, error) {
-	cfSvc := cloudformation.NewFromConfig(*a.config)
-	result, err := cfSvc.DescribeStacks(a.context, &cloudformation.DescribeStacksInput{
+	result, err := a.cloudformation.DescribeStacks(a.context, &cloudformation.DescribeStacksInput{
 		StackName: &stackName,
 	})
+	if isStackNotFound(err) {
+		return nil, fmt.Errorf("%w: %s", ErrStackNotFound, stackName)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -100,13 +363,30 @@ func (a *AWS) DescribeStack(stackName string) (*cfnTypes.Stack, error) {
 }
 
 func (a *AWS) DestroyStack(stackName string) error {
-	cfSvc := cloudformation.NewFromConfig(*a.config)
-	_, err := cfSvc.DeleteStack(a.context, &cloudformation.DeleteStackInput{
+	_, err := a.cloudformation.DeleteStack(a.context, &cloudformation.DeleteStackInput{
 		StackName: &stackName,
 	})
 	return err
 }
 
+func (a *AWS) ListStackResources(stackName string) ([]cfnTypes.StackResourceSummary, error) {
+	paginator := cloudformation.NewListStackResourcesPaginator(a.cloudformation, &cloudformation.ListStackResourcesInput{
+		StackName: &stackName,
+	})
+	resources := []cfnTypes.StackResourceSummary{}
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(a.context)
+		if isStackNotFound(err) {
+			return nil, fmt.Errorf("%w: %s", ErrStackNotFound, stackName)
+		}
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, output.StackResourceSummaries...)
+	}
+	return resources, nil
+}
+
 // ECR
 
 func decodeECRToken(token string) (string, string, error) {
@@ -123,8 +403,7 @@ func decodeECRToken(token string) (string, string, error) {
 
 // GetECRPassword returns the password for the given ECR registry
 func (a *AWS) GetECRLogin() (string, string, error) {
-	ecrSvc := ecr.NewFromConfig(*a.config)
-	result, err := ecrSvc.GetAuthorizationToken(context.Background(), &ecr.GetAuthorizationTokenInput{})
+	result, err := a.ecr.GetAuthorizationToken(a.context, &ecr.GetAuthorizationTokenInput{})
 	if err != nil {
 		return "", "", err
 	}
@@ -1,6 +1,11 @@
 package aws
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
 
 func TestECRTokenDecode(t *testing.T) {
 	encoded := "QVdTOnBhc3N3b3Jk"
@@ -33,3 +38,58 @@ func TestECRTokenDecodeInvalidBase64(t *testing.T) {
 		t.Errorf("expected an error, got nil")
 	}
 }
+
+func TestIsStackNotFound(t *testing.T) {
+	notFound := &smithy.GenericAPIError{Code: "ValidationError", Message: "Stack with id apppack-reviewapp-app123 does not exist"}
+	if !isStackNotFound(fmt.Errorf("operation error: %w", notFound)) {
+		t.Errorf("expected stack not found for %s", notFound)
+	}
+	for _, err := range []error{
+		nil,
+		fmt.Errorf("stack does not exist"),
+		&smithy.GenericAPIError{Code: "Throttling", Message: "Rate exceeded"},
+		&smithy.GenericAPIError{Code: "ValidationError", Message: "Template format error"},
+	} {
+		if isStackNotFound(err) {
+			t.Errorf("expected %v not to be stack not found", err)
+		}
+	}
+}
+
+func TestBatches(t *testing.T) {
+	names := []string{"a", "b", "c", "d", "e"}
+	result := batches(names, 2)
+	if len(result) != 3 || len(result[0]) != 2 || len(result[2]) != 1 || result[2][0] != "e" {
+		t.Errorf("expected batches of 2, got %v", result)
+	}
+	if result := batches(nil, 10); len(result) != 0 {
+		t.Errorf("expected no batches, got %v", result)
+	}
+}
+
+func TestExtractJSONKey(t *testing.T) {
+	secret := `{"username": "admin", "password": "hunter2", "port": 5432}`
+	for key, expected := range map[string]string{"password": "hunter2", "port": "5432"} {
+		value, err := extractJSONKey(secret, key)
+		if err != nil {
+			t.Errorf("expected no error, got %s", err)
+		}
+		if value != expected {
+			t.Errorf("expected %s, got %s", expected, value)
+		}
+	}
+	if _, err := extractJSONKey(secret, "host"); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+	if _, err := extractJSONKey("hunter2", "password"); err == nil {
+		t.Error("expected an error for a plain text secret")
+	}
+}
+
+func TestDirPrefix(t *testing.T) {
+	for prefix, expected := range map[string]string{"cache/main": "cache/main/", "cache/main/": "cache/main/", "": ""} {
+		if result := dirPrefix(prefix); result != expected {
+			t.Errorf("expected %q, got %q", expected, result)
+		}
+	}
+}
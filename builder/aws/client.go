@@ -0,0 +1,178 @@
+package aws
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// Large pipelines with many review apps are throttled by SSM, so calls are
+// retried more, and for longer, than the SDK defaults. Backoff is jittered.
+var (
+	maxAttempts = 10
+	maxBackoff  = 20 * time.Second
+)
+
+// retryOptions disables the retry quota, so a burst of throttling doesn't fail
+// every call after it
+func retryOptions(o *retry.StandardOptions) {
+	o.MaxAttempts = maxAttempts
+	o.MaxBackoff = maxBackoff
+	o.RateLimiter = ratelimit.None
+}
+
+// newRetryer uses adaptive mode, which also slows down the client when it is throttled
+var newRetryer = func() aws.Retryer {
+	return retry.NewAdaptiveMode(func(o *retry.AdaptiveModeOptions) {
+		o.StandardOptions = append(o.StandardOptions, retryOptions)
+	})
+}
+
+// Metrics counts the AWS API calls made by the builder
+type Metrics struct {
+	// Calls is the number of calls by "Service.Operation"
+	Calls map[string]int
+	// Attempts is the number of requests sent, including retries
+	Attempts int
+	// CacheHits is the number of parameter reads served from the cache
+	CacheHits int
+}
+
+// Total is the number of calls made, not counting retries
+func (m Metrics) Total() int {
+	total := 0
+	for _, n := range m.Calls {
+		total += n
+	}
+	return total
+}
+
+type metricsRecorder struct {
+	mu      sync.Mutex
+	metrics Metrics
+}
+
+func (r *metricsRecorder) record(f func(*Metrics)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f(&r.metrics)
+}
+
+func (r *metricsRecorder) snapshot() Metrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := r.metrics
+	m.Calls = map[string]int{}
+	for k, v := range r.metrics.Calls {
+		m.Calls[k] = v
+	}
+	return m
+}
+
+// addMiddleware counts each call once, after the SDK has registered which it
+// is, and each request sent by the retry loop
+func (r *metricsRecorder) addMiddleware(stack *middleware.Stack) error {
+	err := stack.Initialize.Add(middleware.InitializeMiddlewareFunc("ApppackCallMetrics", func(
+		ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		name := awsmiddleware.GetServiceID(ctx) + "." + awsmiddleware.GetOperationName(ctx)
+		r.record(func(m *Metrics) { m.Calls[name]++ })
+		return next.HandleInitialize(ctx, in)
+	}), middleware.After)
+	if err != nil {
+		return err
+	}
+	return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("ApppackAttemptMetrics", func(
+		ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler,
+	) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		r.record(func(m *Metrics) { m.Attempts++ })
+		return next.HandleFinalize(ctx, in)
+	}), "Retry", middleware.After)
+}
+
+// parameterCache holds the parameters read during this process, which runs a
+// single build phase. Writes update or invalidate it.
+type parameterCache struct {
+	mu     sync.Mutex
+	values map[string]string
+	paths  map[string]map[string]string
+}
+
+func newParameterCache() *parameterCache {
+	return &parameterCache{values: map[string]string{}, paths: map[string]map[string]string{}}
+}
+
+func (c *parameterCache) get(name string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.values[name]
+	return value, ok
+}
+
+func (c *parameterCache) getPath(path string) (map[string]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	params, ok := c.paths[path]
+	if !ok {
+		return nil, false
+	}
+	copied := make(map[string]string, len(params))
+	for k, v := range params {
+		copied[k] = v
+	}
+	return copied, true
+}
+
+// put remembers a parameter which was read
+func (c *parameterCache) put(name, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[name] = value
+}
+
+// set remembers a parameter which was written
+func (c *parameterCache) set(name, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[name] = value
+	c.invalidatePaths(name)
+}
+
+func (c *parameterCache) setPath(path string, params map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	copied := make(map[string]string, len(params))
+	for k, v := range params {
+		copied[k] = v
+		c.values[k] = v
+	}
+	c.paths[path] = copied
+}
+
+// delete forgets every parameter under prefix (or the parameter itself)
+func (c *parameterCache) delete(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.values {
+		if strings.HasPrefix(name, prefix) {
+			delete(c.values, name)
+		}
+	}
+	c.invalidatePaths(prefix)
+}
+
+// invalidatePaths forgets the path reads which could include name
+func (c *parameterCache) invalidatePaths(name string) {
+	for path := range c.paths {
+		if strings.HasPrefix(name, path) || strings.HasPrefix(path, name) {
+			delete(c.paths, path)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+)
+
+// fakeSSM is an SSM endpoint serving parameters from a map. The first
+// throttle requests fail with a ThrottlingException, and the denied
+// operations with an AccessDeniedException.
+type fakeSSM struct {
+	mu       sync.Mutex
+	params   map[string]string
+	throttle int
+	denied   map[string]bool
+	requests map[string]int
+}
+
+func (f *fakeSSM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSSM.")
+	f.requests[operation]++
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	if f.throttle > 0 {
+		f.throttle--
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"__type": "ThrottlingException", "message": "Rate exceeded"}`)
+		return
+	}
+	if f.denied[operation] {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"__type": "AccessDeniedException", "message": "not authorized to perform: ssm:%s"}`, operation)
+		return
+	}
+	var input struct {
+		Name      string
+		Names     []string
+		Path      string
+		Value     string
+		Recursive bool
+		NextToken string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var output interface{}
+	switch operation {
+	case "GetParameter":
+		value, ok := f.params[input.Name]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type": "ParameterNotFound"}`)
+			return
+		}
+		output = map[string]interface{}{"Parameter": map[string]string{"Name": input.Name, "Value": value}}
+	case "PutParameter":
+		f.params[input.Name] = input.Value
+		output = map[string]int{"Version": 1}
+	case "GetParametersByPath":
+		names := []string{}
+		for name := range f.params {
+			rest, ok := strings.CutPrefix(name, input.Path)
+			if ok && (input.Recursive || !strings.Contains(rest, "/")) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		// pages of 10, the NextToken is the index of the next page
+		start := 0
+		fmt.Sscan(input.NextToken, &start)
+		end := min(start+10, len(names))
+		params := []map[string]string{}
+		for _, name := range names[start:end] {
+			params = append(params, map[string]string{"Name": name, "Value": f.params[name]})
+		}
+		page := map[string]interface{}{"Parameters": params}
+		if end < len(names) {
+			page["NextToken"] = fmt.Sprint(end)
+		}
+		output = page
+	case "DeleteParameters":
+		for _, name := range input.Names {
+			delete(f.params, name)
+		}
+		output = map[string][]string{"DeletedParameters": input.Names}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(output)
+}
+
+// useStandardRetryer replaces the adaptive retryer for the rest of the test.
+// Adaptive mode slows the client to a couple of seconds per request once it is
+// throttled, so tests of many retries use the same options without it.
+func useStandardRetryer(t *testing.T) {
+	previous := newRetryer
+	newRetryer = func() aws.Retryer { return retry.NewStandard(retryOptions) }
+	t.Cleanup(func() { newRetryer = previous })
+}
+
+func fakeSSMClient(t *testing.T, fake *fakeSSM) *AWS {
+	previous := maxBackoff
+	maxBackoff = time.Millisecond
+	t.Cleanup(func() { maxBackoff = previous })
+	fake.requests = map[string]int{}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	cfg := aws.Config{
+		Region:       "us-east-1",
+		Credentials:  aws.AnonymousCredentials{},
+		BaseEndpoint: aws.String(server.URL),
+	}
+	return New(&cfg, context.Background())
+}
+
+func TestParameterCache(t *testing.T) {
+	fake := &fakeSSM{params: map[string]string{
+		"/apppack/apps/test/config/FOO": "bar",
+		"/apppack/apps/test/config/BAZ": "qux",
+	}}
+	a := fakeSSMClient(t, fake)
+	for i := 0; i < 3; i++ {
+		params, err := a.GetParametersByPath("/apppack/apps/test/config/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(params) != 2 {
+			t.Errorf("expected 2 parameters, got %v", params)
+		}
+	}
+	// a parameter read with its path is cached too
+	if value, err := a.GetParameter("/apppack/apps/test/config/FOO"); err != nil || value != "bar" {
+		t.Errorf("expected bar, got %s, %v", value, err)
+	}
+	if fake.requests["GetParametersByPath"] != 1 || fake.requests["GetParameter"] != 0 {
+		t.Errorf("expected the reads to be cached, got %v", fake.requests)
+	}
+	// writes are visible to later reads
+	if err := a.SetParameter("/apppack/apps/test/config/FOO", "updated"); err != nil {
+		t.Fatal(err)
+	}
+	params, err := a.GetParametersByPath("/apppack/apps/test/config/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["/apppack/apps/test/config/FOO"] != "updated" {
+		t.Errorf("expected the write to invalidate the cached path, got %v", params)
+	}
+	metrics := a.Metrics()
+	if metrics.CacheHits != 3 || metrics.Total() != 3 || metrics.Calls["SSM.GetParametersByPath"] != 2 {
+		t.Errorf("unexpected metrics %+v", metrics)
+	}
+}
+
+func TestThrottlingRetried(t *testing.T) {
+	useStandardRetryer(t)
+	fake := &fakeSSM{params: map[string]string{"/apppack/apps/test/config/FOO": "bar"}, throttle: 3}
+	a := fakeSSMClient(t, fake)
+	value, err := a.GetParameter("/apppack/apps/test/config/FOO")
+	if err != nil {
+		t.Fatalf("expected throttling to be retried, got %s", err)
+	}
+	if value != "bar" {
+		t.Errorf("expected bar, got %s", value)
+	}
+	metrics := a.Metrics()
+	if metrics.Calls["SSM.GetParameter"] != 1 || metrics.Attempts != 4 {
+		t.Errorf("expected 1 call in 4 attempts, got %+v", metrics)
+	}
+}
+
+func TestThrottlingRetriedAdaptive(t *testing.T) {
+	// the retryer the builder uses, which takes a couple of seconds to recover
+	fake := &fakeSSM{params: map[string]string{"/apppack/apps/test/config/FOO": "bar"}, throttle: 1}
+	a := fakeSSMClient(t, fake)
+	value, err := a.GetParameter("/apppack/apps/test/config/FOO")
+	if err != nil {
+		t.Fatalf("expected throttling to be retried, got %s", err)
+	}
+	if value != "bar" {
+		t.Errorf("expected bar, got %s", value)
+	}
+	if metrics := a.Metrics(); metrics.Attempts != 2 {
+		t.Errorf("expected 2 attempts, got %+v", metrics)
+	}
+}
+
+func TestThrottlingGivesUp(t *testing.T) {
+	useStandardRetryer(t)
+	fake := &fakeSSM{params: map[string]string{}, throttle: maxAttempts + 1}
+	a := fakeSSMClient(t, fake)
+	if _, err := a.GetParameter("/apppack/apps/test/config/FOO"); err == nil || !strings.Contains(err.Error(), "ThrottlingException") {
+		t.Errorf("expected a throttling error, got %v", err)
+	}
+	if metrics := a.Metrics(); metrics.Attempts != maxAttempts {
+		t.Errorf("expected %d attempts, got %d", maxAttempts, metrics.Attempts)
+	}
+}
+
+func TestDeleteParametersByPathBatches(t *testing.T) {
+	fake := &fakeSSM{params: map[string]string{"/apppack/pipelines/test/config/KEEP": "1"}}
+	for i := 0; i < 25; i++ {
+		fake.params[fmt.Sprintf("/apppack/pipelines/test/review-apps/pr/1/config/KEY_%02d", i)] = "1"
+	}
+	a := fakeSSMClient(t, fake)
+	if _, err := a.GetParametersByPath("/apppack/pipelines/test/review-apps/pr/1/config/"); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := a.DeleteParametersByPath("/apppack/pipelines/test/review-apps/pr/1/config/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 25 || len(fake.params) != 1 {
+		t.Errorf("expected 25 parameters to be deleted, got %d, %v", deleted, fake.params)
+	}
+	if fake.requests["DeleteParameters"] != 3 {
+		t.Errorf("expected 3 batches, got %d", fake.requests["DeleteParameters"])
+	}
+	params, err := a.GetParametersByPath("/apppack/pipelines/test/review-apps/pr/1/config/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(params) != 0 {
+		t.Errorf("expected the deleted path not to be served from the cache, got %v", params)
+	}
+}
+
+func TestListParametersByTagAccessDenied(t *testing.T) {
+	fake := &fakeSSM{params: map[string]string{}, denied: map[string]bool{"DescribeParameters": true}}
+	a := fakeSSMClient(t, fake)
+	_, err := a.ListParametersByTag("/apppack/apps/test/config/", "apppack:build", "true")
+	if !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("expected ErrAccessDenied, got %v", err)
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "AccessDeniedException" {
+		t.Errorf("expected the API error to be kept, got %v", err)
+	}
+}
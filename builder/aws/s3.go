@@ -1,40 +1,243 @@
 package aws
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/seqsense/s3sync"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go/logging"
 )
 
-type SilentLogger struct{}
+const (
+	// deleteObjectsBatchSize is the most keys S3 deletes in one call
+	deleteObjectsBatchSize = 1000
+	// uploadPartSize is the size of each part of a streamed upload, of which
+	// the uploader buffers as many as it uploads at once
+	uploadPartSize = 16 << 20
+)
 
-func (s *SilentLogger) Log(v ...interface{})                 {}
-func (s *SilentLogger) Logf(format string, v ...interface{}) {}
+// S3Options configures the S3 client and the transfers it makes
+type S3Options struct {
+	// Endpoint replaces the S3 endpoint, for S3-compatible stores like MinIO.
+	// Buckets are addressed by path on it.
+	Endpoint string
+	// Concurrency is the number of files, or parts of an upload, transferred at once
+	Concurrency int
+	// Checksum is the algorithm used to verify uploads, empty to disable
+	// checksums. Downloads are verified when the object has a checksum.
+	Checksum s3Types.ChecksumAlgorithm
+}
 
-func (a *AWS) CopyFromS3(bucket, prefix, dest string) error {
-	sess, err := session.NewSession(&aws.Config{})
-	if err != nil {
-		return err
+// DefaultS3Options checksum with CRC32, which is fast and supported by S3-compatible stores
+var DefaultS3Options = S3Options{
+	Concurrency: 8,
+	Checksum:    s3Types.ChecksumAlgorithmCrc32,
+}
+
+// S3OptionsFromEnv reads S3_ENDPOINT_URL, S3_CONCURRENCY and S3_CHECKSUM
+// (an algorithm or "none") on top of the defaults
+func S3OptionsFromEnv(getenv func(string) string) (S3Options, error) {
+	options := DefaultS3Options
+	options.Endpoint = getenv("S3_ENDPOINT_URL")
+	if value := getenv("S3_CONCURRENCY"); value != "" {
+		concurrency, err := strconv.Atoi(value)
+		if err != nil || concurrency < 1 {
+			return options, fmt.Errorf("invalid S3_CONCURRENCY %q: must be a positive number", value)
+		}
+		options.Concurrency = concurrency
+	}
+	if value := getenv("S3_CHECKSUM"); value != "" {
+		options.Checksum = ""
+		for _, algorithm := range options.Checksum.Values() {
+			if strings.EqualFold(value, string(algorithm)) {
+				options.Checksum = algorithm
+			}
+		}
+		if options.Checksum == "" && !strings.EqualFold(value, "none") {
+			return options, fmt.Errorf("invalid S3_CHECKSUM %q: must be one of %v or none", value, options.Checksum.Values())
+		}
 	}
-	syncManager := s3sync.New(sess)
-	return syncManager.Sync(fmt.Sprintf("s3://%s/%s", bucket, prefix), dest)
+	return options, nil
 }
 
-func (a *AWS) SyncToS3(src, bucket, prefix string, quiet bool) error {
-	sess, err := session.NewSession(&aws.Config{})
+func newS3Client(cfg aws.Config, options S3Options) *s3.Client {
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if options.Endpoint != "" {
+			o.BaseEndpoint = &options.Endpoint
+			o.UsePathStyle = true
+		}
+		// the SDK warns about every object without a checksum, which includes
+		// every multipart upload, so don't log it
+		o.Logger = logging.Nop{}
+	})
+}
+
+// SetS3Options replaces the S3 client with one using the options
+func (a *AWS) SetS3Options(options S3Options) {
+	a.s3Options = options
+	a.s3 = newS3Client(*a.config, options)
+}
+
+// GetObject returns the content of an S3 object, or an error wrapping ErrObjectNotFound
+func (a *AWS) GetObject(bucket, key string) ([]byte, error) {
+	body, err := a.DownloadStream(bucket, key)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	var syncManager *s3sync.Manager
-	if quiet {
-		s3sync.SetLogger(&SilentLogger{})
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// DownloadStream returns the content of an S3 object as it is downloaded, or
+// an error wrapping ErrObjectNotFound
+func (a *AWS) DownloadStream(bucket, key string) (io.ReadCloser, error) {
+	result, err := a.s3.GetObject(a.context, &s3.GetObjectInput{
+		Bucket:       &bucket,
+		Key:          &key,
+		ChecksumMode: s3Types.ChecksumModeEnabled,
+	})
+	var noSuchKey *s3Types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, fmt.Errorf("%w: s3://%s/%s", ErrObjectNotFound, bucket, key)
 	}
-	syncManager = s3sync.New(sess, s3sync.WithDelete())
-	err = syncManager.Sync(src, fmt.Sprintf("s3://%s/%s", bucket, prefix))
-	if quiet {
-		s3sync.SetLogger(nil)
+	if err != nil {
+		return nil, err
 	}
+	return result.Body, nil
+}
+
+func (a *AWS) PutObject(bucket, key string, body []byte) error {
+	_, err := a.s3.PutObject(a.context, &s3.PutObjectInput{
+		Bucket:            &bucket,
+		Key:               &key,
+		Body:              bytes.NewReader(body),
+		ChecksumAlgorithm: a.s3Options.Checksum,
+	})
+	return err
+}
+
+func (a *AWS) uploader() *manager.Uploader {
+	return manager.NewUploader(a.s3, func(u *manager.Uploader) {
+		u.PartSize = uploadPartSize
+		u.Concurrency = a.s3Options.Concurrency
+	})
+}
+
+// UploadStream uploads the body as it is read, in parts, so its size doesn't
+// need to be known in advance. A part is buffered for each concurrent upload.
+func (a *AWS) UploadStream(bucket, key string, body io.Reader) error {
+	_, err := a.uploader().Upload(a.context, &s3.PutObjectInput{
+		Bucket:            &bucket,
+		Key:               &key,
+		Body:              body,
+		ChecksumAlgorithm: a.s3Options.Checksum,
+	})
+	return err
+}
+
+func (a *AWS) DeleteObject(bucket, key string) error {
+	_, err := a.s3.DeleteObject(a.context, &s3.DeleteObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
 	return err
 }
+
+func (a *AWS) listObjects(bucket, prefix string) ([]s3Types.Object, error) {
+	paginator := s3.NewListObjectsV2Paginator(a.s3, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	objects := []s3Types.Object{}
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(a.context)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, output.Contents...)
+	}
+	return objects, nil
+}
+
+// ListObjects returns the last modified time of every object under the prefix
+func (a *AWS) ListObjects(bucket, prefix string) (map[string]time.Time, error) {
+	objects, err := a.listObjects(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	modified := map[string]time.Time{}
+	for _, o := range objects {
+		modified[*o.Key] = *o.LastModified
+	}
+	return modified, nil
+}
+
+// DeleteObjectsByPrefix deletes every object under the prefix, returning the
+// number deleted
+func (a *AWS) DeleteObjectsByPrefix(bucket, prefix string) (int, error) {
+	objects, err := a.listObjects(bucket, prefix)
+	if err != nil {
+		return 0, err
+	}
+	keys := make([]string, 0, len(objects))
+	for _, o := range objects {
+		keys = append(keys, *o.Key)
+	}
+	return a.DeleteObjects(bucket, keys)
+}
+
+// DeleteObjects deletes the keys in batches, returning the number deleted
+func (a *AWS) DeleteObjects(bucket string, keys []string) (int, error) {
+	deleted := 0
+	quiet := true
+	for _, batch := range batches(keys, deleteObjectsBatchSize) {
+		identifiers := make([]s3Types.ObjectIdentifier, len(batch))
+		for i := range batch {
+			identifiers[i] = s3Types.ObjectIdentifier{Key: &batch[i]}
+		}
+		output, err := a.s3.DeleteObjects(a.context, &s3.DeleteObjectsInput{
+			Bucket: &bucket,
+			Delete: &s3Types.Delete{Objects: identifiers, Quiet: &quiet},
+		})
+		if err != nil {
+			return deleted, err
+		}
+		if len(output.Errors) > 0 {
+			e := output.Errors[0]
+			return deleted + len(batch) - len(output.Errors), fmt.Errorf("unable to delete s3://%s/%s: %s", bucket, *e.Key, *e.Message)
+		}
+		deleted += len(batch)
+	}
+	return deleted, nil
+}
+
+// prefixExists is true if there are any objects under the prefix
+func (a *AWS) prefixExists(bucket, prefix string) (bool, error) {
+	maxKeys := int32(1)
+	output, err := a.s3.ListObjectsV2(a.context, &s3.ListObjectsV2Input{
+		Bucket:  &bucket,
+		Prefix:  &prefix,
+		MaxKeys: &maxKeys,
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(output.Contents) > 0, nil
+}
+
+// dirPrefix ends the prefix with a slash, so it doesn't also match siblings
+// which share its name as a prefix
+func dirPrefix(prefix string) string {
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		return prefix
+	}
+	return prefix + "/"
+}
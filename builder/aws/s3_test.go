@@ -0,0 +1,402 @@
+package aws
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeS3 is a path-style S3 endpoint storing objects in memory. It implements
+// the calls the builder makes, including multipart uploads.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	modified map[string]time.Time
+	// checksums are the CRC32 checksums sent with single part uploads
+	checksums map[string]string
+	uploads   map[string]map[int][]byte
+	requests  map[string]int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:   map[string][]byte{},
+		modified:  map[string]time.Time{},
+		checksums: map[string]string{},
+		uploads:   map[string]map[int][]byte{},
+		requests:  map[string]int{},
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// the first path segment is the bucket, which is ignored
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.requests["ListObjectsV2"]++
+		f.list(w, query.Get("prefix"), query.Get("max-keys"))
+	case r.Method == http.MethodGet:
+		f.requests["GetObject"]++
+		content, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+			return
+		}
+		if checksum, ok := f.checksums[key]; ok {
+			w.Header().Set("x-amz-checksum-crc32", checksum)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.requests["CreateMultipartUpload"]++
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, key, id)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		f.requests["UploadPart"]++
+		part, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[query.Get("uploadId")][part] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, part))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.requests["CompleteMultipartUpload"]++
+		parts := f.uploads[query.Get("uploadId")]
+		numbers := []int{}
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		content := []byte{}
+		for _, n := range numbers {
+			content = append(content, parts[n]...)
+		}
+		f.put(key, content)
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>`, key)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		f.requests["AbortMultipartUpload"]++
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.requests["PutObject"]++
+		f.put(key, body)
+		if checksum := r.Header.Get("x-amz-checksum-crc32"); checksum != "" {
+			f.checksums[key] = checksum
+		}
+	case r.Method == http.MethodPost && query.Has("delete"):
+		f.requests["DeleteObjects"]++
+		var input struct {
+			Objects []struct{ Key string } `xml:"Object"`
+		}
+		xml.Unmarshal(body, &input)
+		for _, o := range input.Objects {
+			delete(f.objects, o.Key)
+		}
+		fmt.Fprint(w, `<DeleteResult></DeleteResult>`)
+	case r.Method == http.MethodDelete:
+		f.requests["DeleteObject"]++
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (f *fakeS3) put(key string, content []byte) {
+	f.objects[key] = content
+	// S3 has second precision
+	f.modified[key] = time.Now().Truncate(time.Second)
+	delete(f.checksums, key)
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, maxKeys string) {
+	keys := []string{}
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if n, err := strconv.Atoi(maxKeys); err == nil && n < len(keys) {
+		keys = keys[:n]
+	}
+	fmt.Fprint(w, `<ListBucketResult>`)
+	for _, k := range keys {
+		fmt.Fprintf(w, `<Contents><Key>%s</Key><LastModified>%s</LastModified><Size>%d</Size></Contents>`,
+			k, f.modified[k].UTC().Format(time.RFC3339), len(f.objects[k]))
+	}
+	fmt.Fprintf(w, `<KeyCount>%d</KeyCount><IsTruncated>false</IsTruncated></ListBucketResult>`, len(keys))
+}
+
+func fakeS3Client(tb testing.TB, fake *fakeS3) *AWS {
+	server := httptest.NewServer(fake)
+	tb.Cleanup(server.Close)
+	cfg := aws.Config{
+		Region:      "us-east-1",
+		Credentials: aws.AnonymousCredentials{},
+	}
+	a := New(&cfg, context.Background())
+	options := DefaultS3Options
+	options.Endpoint = server.URL
+	a.SetS3Options(options)
+	return a
+}
+
+func TestUploadStreamMultipart(t *testing.T) {
+	fake := newFakeS3()
+	a := fakeS3Client(t, fake)
+	content := make([]byte, uploadPartSize*2+1024)
+	rand.Read(content)
+	// a pipe has no length, like an archive streamed as it is written
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(func() error {
+			_, err := writer.Write(content)
+			return err
+		}())
+	}()
+	if err := a.UploadStream("artifacts", "cache-archive/main/abc.tar.zst", reader); err != nil {
+		t.Fatal(err)
+	}
+	if fake.requests["UploadPart"] != 3 || fake.requests["CompleteMultipartUpload"] != 1 {
+		t.Errorf("expected a multipart upload of 3 parts, got %v", fake.requests)
+	}
+	body, err := a.DownloadStream("artifacts", "cache-archive/main/abc.tar.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	downloaded, err := io.ReadAll(body)
+	if err != nil || !bytes.Equal(downloaded, content) {
+		t.Errorf("expected the uploaded content back, got %d bytes, %v", len(downloaded), err)
+	}
+	if _, err = a.DownloadStream("artifacts", "missing"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound, got %v", err)
+	}
+}
+
+func TestDeleteObjectsByPrefix(t *testing.T) {
+	fake := newFakeS3()
+	for _, k := range []string{"cache/pr-1/a", "cache/pr-1/b/c", "cache/pr-10/a", "cache-index/pr-1.json"} {
+		fake.put(k, []byte("x"))
+	}
+	a := fakeS3Client(t, fake)
+	deleted, err := a.DeleteObjectsByPrefix("artifacts", "cache/pr-1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 || len(fake.objects) != 2 {
+		t.Errorf("expected 2 objects to be deleted, got %d, %v", deleted, fake.objects)
+	}
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncToS3(t *testing.T) {
+	fake := newFakeS3()
+	fake.put("cache/main/stale", []byte("removed locally"))
+	fake.put("cache/main-2/other", []byte("another branch"))
+	a := fakeS3Client(t, fake)
+	src := t.TempDir()
+	// written in the past, so they are older than the objects uploaded
+	writeFiles(t, src, map[string]string{"index.json": "{}", "blobs/sha256/abc": "layer"})
+	past := time.Now().Add(-time.Minute)
+	for _, name := range []string{"index.json", "blobs/sha256/abc"} {
+		os.Chtimes(filepath.Join(src, name), past, past)
+	}
+	stats, err := a.SyncToS3(src, "artifacts", "cache/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (TransferStats{Files: 2, Bytes: 7, Deleted: 1}); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+	if string(fake.objects["cache/main/blobs/sha256/abc"]) != "layer" || fake.objects["cache/main/index.json"] == nil {
+		t.Errorf("expected the files to be uploaded, got %v", fake.objects)
+	}
+	if _, ok := fake.objects["cache/main/stale"]; ok {
+		t.Error("expected the object without a file to be deleted")
+	}
+	if _, ok := fake.objects["cache/main-2/other"]; !ok {
+		t.Error("expected another prefix's objects to be kept")
+	}
+	if fake.checksums["cache/main/index.json"] == "" {
+		t.Error("expected the upload to have a checksum")
+	}
+	// only changed files are uploaded again
+	writeFiles(t, src, map[string]string{"index.json": `{"manifests": []}`})
+	if stats, err = a.SyncToS3(src, "artifacts", "cache/main"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.requests["PutObject"] != 3 {
+		t.Errorf("expected 1 more upload, got %d", fake.requests["PutObject"]-2)
+	}
+	if expected := (TransferStats{Files: 1, Bytes: 17, Unchanged: 1, UnchangedBytes: 5}); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestCopyFromS3(t *testing.T) {
+	fake := newFakeS3()
+	fake.put("cache/main/index.json", []byte("{}"))
+	fake.put("cache/main/blobs/sha256/abc", []byte("layer"))
+	fake.put("cache/main-2/other", []byte("another branch"))
+	a := fakeS3Client(t, fake)
+	dest := t.TempDir()
+	key, stats, err := a.CopyFromS3("artifacts", []string{"cache/pr-1", "cache/main"}, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "cache/main/" {
+		t.Errorf("expected the fallback to be restored, got %s", key)
+	}
+	if expected := (TransferStats{Files: 2, Bytes: 7}); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+	content, err := os.ReadFile(filepath.Join(dest, "blobs", "sha256", "abc"))
+	if err != nil || string(content) != "layer" {
+		t.Errorf("expected the object to be downloaded, got %q, %v", content, err)
+	}
+	if _, err = os.Stat(filepath.Join(dest, "other")); !os.IsNotExist(err) {
+		t.Error("expected another prefix's objects not to be downloaded")
+	}
+	// downloaded files keep the object's time, so syncing them back uploads nothing
+	if _, err = a.SyncToS3(dest, "artifacts", "cache/main"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.requests["PutObject"] != 0 {
+		t.Errorf("expected no uploads, got %d", fake.requests["PutObject"])
+	}
+	// and restoring again downloads nothing
+	if _, stats, err = a.CopyFromS3("artifacts", []string{"cache/main"}, dest); err != nil || stats.Files != 0 || stats.Unchanged != 2 {
+		t.Errorf("expected the files to be unchanged, got %+v, %v", stats, err)
+	}
+	if key, _, err = a.CopyFromS3("artifacts", []string{"cache/pr-1"}, t.TempDir()); err != nil || key != "" {
+		t.Errorf("expected a miss, got %q, %v", key, err)
+	}
+}
+
+func TestDownloadChecksumVerified(t *testing.T) {
+	fake := newFakeS3()
+	a := fakeS3Client(t, fake)
+	if err := a.PutObject("artifacts", "config-fingerprints/main.json", []byte(`{"A": "1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	fake.objects["config-fingerprints/main.json"] = []byte(`{"A": "2"}`)
+	if _, err := a.GetObject("artifacts", "config-fingerprints/main.json"); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+}
+
+func TestS3OptionsFromEnv(t *testing.T) {
+	env := map[string]string{"S3_ENDPOINT_URL": "http://minio:9000", "S3_CONCURRENCY": "32", "S3_CHECKSUM": "sha256"}
+	options, err := S3OptionsFromEnv(func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.Endpoint != "http://minio:9000" || options.Concurrency != 32 || options.Checksum != s3Types.ChecksumAlgorithmSha256 {
+		t.Errorf("unexpected options %+v", options)
+	}
+	env = map[string]string{"S3_CHECKSUM": "none"}
+	if options, err = S3OptionsFromEnv(func(k string) string { return env[k] }); err != nil || options.Checksum != "" {
+		t.Errorf("expected checksums to be disabled, got %+v, %v", options, err)
+	}
+	for _, invalid := range []map[string]string{{"S3_CONCURRENCY": "0"}, {"S3_CHECKSUM": "md5"}} {
+		if _, err = S3OptionsFromEnv(func(k string) string { return invalid[k] }); err == nil {
+			t.Errorf("expected an error for %v", invalid)
+		}
+	}
+}
+
+// benchmarkS3 uses the bucket named by S3_BENCHMARK_BUCKET when it is set,
+// with the options from the environment (e.g. S3_ENDPOINT_URL), so
+// throughput can be measured against MinIO or S3 itself. Otherwise it uses
+// the in-memory fake.
+func benchmarkS3(b *testing.B) (*AWS, string) {
+	bucket := os.Getenv("S3_BENCHMARK_BUCKET")
+	if bucket == "" {
+		return fakeS3Client(b, newFakeS3()), "artifacts"
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		b.Fatal(err)
+	}
+	options, err := S3OptionsFromEnv(os.Getenv)
+	if err != nil {
+		b.Fatal(err)
+	}
+	a := New(&cfg, context.Background())
+	a.SetS3Options(options)
+	return a, bucket
+}
+
+func BenchmarkUploadStream(b *testing.B) {
+	a, bucket := benchmarkS3(b)
+	content := make([]byte, 64<<20)
+	rand.Read(content)
+	b.SetBytes(int64(len(content)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := a.UploadStream(bucket, "benchmark/upload", bytes.NewReader(content)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDownloadStream(b *testing.B) {
+	a, bucket := benchmarkS3(b)
+	content := make([]byte, 64<<20)
+	rand.Read(content)
+	if err := a.UploadStream(bucket, "benchmark/download", bytes.NewReader(content)); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(content)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		body, err := a.DownloadStream(bucket, "benchmark/download")
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = io.Copy(io.Discard, body)
+		body.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/rs/zerolog/log"
+)
+
+// TransferStats counts the files a sync transferred and those it skipped
+// because they were unchanged
+type TransferStats struct {
+	Files          int
+	Bytes          int64
+	Unchanged      int
+	UnchangedBytes int64
+	Deleted        int
+}
+
+func (s *TransferStats) add(mu *sync.Mutex, transferred bool, size int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	if transferred {
+		s.Files++
+		s.Bytes += size
+	} else {
+		s.Unchanged++
+		s.UnchangedBytes += size
+	}
+}
+
+// parallel calls f for 0..n-1 with at most concurrency calls running at once,
+// returning every error
+func parallel(n, concurrency int, f func(i int) error) error {
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(concurrency, 1))
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := f(i); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// unchanged is true when the local file matches the object. Objects are
+// downloaded with their last modified time, and uploaded after the file was
+// last modified, so a newer file has changed since it was synced.
+func unchanged(info fs.FileInfo, object s3Types.Object) bool {
+	return info.Size() == *object.Size && !info.ModTime().After(*object.LastModified)
+}
+
+// localPath joins the key's path below the prefix to dir, refusing keys
+// which would escape it
+func localPath(dir, prefix, key string) (string, error) {
+	path := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(key, prefix)))
+	if !strings.HasPrefix(path, filepath.Clean(dir)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("s3 key %s is outside %s", key, prefix)
+	}
+	return path, nil
+}
+
+// downloadFile writes the object to path through a temporary file, so an
+// interrupted download doesn't leave a truncated file behind
+func (a *AWS) downloadFile(bucket string, object s3Types.Object, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	body, err := a.DownloadStream(bucket, *object.Key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	f, err := os.CreateTemp(filepath.Dir(path), ".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("s3://%s/%s: %w", bucket, *object.Key, err)
+	}
+	if err = os.Chtimes(f.Name(), *object.LastModified, *object.LastModified); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// CopyFromS3 downloads the first of the prefixes which has any objects, so a
+// missing cache can fall back to another. It returns the prefix downloaded, or
+// an empty string if they were all empty.
+func (a *AWS) CopyFromS3(bucket string, prefixes []string, dest string) (string, TransferStats, error) {
+	logger := log.Ctx(a.context)
+	stats := TransferStats{}
+	var mu sync.Mutex
+	for _, prefix := range prefixes {
+		prefix = dirPrefix(prefix)
+		objects, err := a.listObjects(bucket, prefix)
+		if err != nil {
+			return "", stats, err
+		}
+		if len(objects) == 0 {
+			logger.Debug().Str("key", prefix).Msg("nothing to restore")
+			continue
+		}
+		err = parallel(len(objects), a.s3Options.Concurrency, func(i int) error {
+			object := objects[i]
+			if strings.HasSuffix(*object.Key, "/") {
+				return nil
+			}
+			path, err := localPath(dest, prefix, *object.Key)
+			if err != nil {
+				return err
+			}
+			if info, err := os.Stat(path); err == nil && unchanged(info, object) {
+				stats.add(&mu, false, *object.Size)
+				return nil
+			}
+			logger.Debug().Str("key", *object.Key).Msg("downloading")
+			if err = a.downloadFile(bucket, object, path); err != nil {
+				return err
+			}
+			stats.add(&mu, true, *object.Size)
+			return nil
+		})
+		if err != nil {
+			return "", stats, err
+		}
+		logger.Info().Str("key", prefix).Msg("restored from S3")
+		return prefix, stats, nil
+	}
+	logger.Info().Strs("keys", prefixes).Msg("nothing to restore from S3")
+	return "", stats, nil
+}
+
+func (a *AWS) uploadFile(bucket, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = a.uploader().Upload(a.context, &s3.PutObjectInput{
+		Bucket:            &bucket,
+		Key:               &key,
+		Body:              f,
+		ChecksumAlgorithm: a.s3Options.Checksum,
+	})
+	if err != nil {
+		return fmt.Errorf("s3://%s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
+
+// SyncToS3 makes the prefix a copy of the src directory. Changed and new
+// files are uploaded and objects without a file are deleted.
+func (a *AWS) SyncToS3(src, bucket, prefix string) (TransferStats, error) {
+	logger := log.Ctx(a.context)
+	stats := TransferStats{}
+	prefix = dirPrefix(prefix)
+	objects, err := a.listObjects(bucket, prefix)
+	if err != nil {
+		return stats, err
+	}
+	remote := map[string]s3Types.Object{}
+	for _, o := range objects {
+		remote[*o.Key] = o
+	}
+	uploads := []string{}
+	sizes := []int64{}
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		key := prefix + filepath.ToSlash(rel)
+		object, exists := remote[key]
+		delete(remote, key)
+		if exists && unchanged(info, object) {
+			stats.Unchanged++
+			stats.UnchangedBytes += info.Size()
+			return nil
+		}
+		uploads = append(uploads, rel)
+		sizes = append(sizes, info.Size())
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	var mu sync.Mutex
+	start := time.Now()
+	err = parallel(len(uploads), a.s3Options.Concurrency, func(i int) error {
+		key := prefix + filepath.ToSlash(uploads[i])
+		logger.Debug().Str("key", key).Msg("uploading")
+		if err := a.uploadFile(bucket, key, filepath.Join(src, uploads[i])); err != nil {
+			return err
+		}
+		stats.add(&mu, true, sizes[i])
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	stale := make([]string, 0, len(remote))
+	for key := range remote {
+		logger.Debug().Str("key", key).Msg("deleting")
+		stale = append(stale, key)
+	}
+	if stats.Deleted, err = a.DeleteObjects(bucket, stale); err != nil {
+		return stats, err
+	}
+	logger.Debug().
+		Int("uploaded", stats.Files).
+		Int("unchanged", stats.Unchanged).
+		Int("deleted", stats.Deleted).
+		Dur("duration", time.Since(start)).
+		Str("key", prefix).
+		Msg("synced to S3")
+	return stats, nil
+}
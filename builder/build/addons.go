@@ -0,0 +1,434 @@
+package build
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// DefaultAddonTimeout is how long to wait for addons to become ready
+// when `[test] addon_timeout` is not set
+const DefaultAddonTimeout = 60 * time.Second
+
+// addonProbeInterval is the delay between readiness checks
+var addonProbeInterval = 500 * time.Millisecond
+
+// ReadinessProbe describes how to check that an addon is accepting connections.
+// If Command is set, it is run inside the addon container and the addon is ready
+// when it exits zero. Otherwise, the addon is ready when Port accepts a TCP
+// connection on the build network.
+type ReadinessProbe struct {
+	Command []string
+	Port    int
+}
+
+// AddonSpec describes an in-dyno addon run as a container on the build network
+type AddonSpec struct {
+	Image string
+	// Alias is the hostname the addon is reachable at from the test container
+	Alias string
+	// Env and Cmd configure the addon container
+	Env []string
+	Cmd []string
+	// EnvVar is set in the test environment to URLTemplate rendered with the addon's Alias
+	EnvVar      string
+	URLTemplate string
+	// ExtraEnv is additional environment for the test container
+	ExtraEnv map[string]string
+	Probe    ReadinessProbe
+	// VersionImage is rendered with .Version to pick the image when a version is requested
+	VersionImage string
+	// DefaultVersion is used for ExtensionImages when no version is requested
+	DefaultVersion string
+	// ExtensionImages maps extensions which aren't in the default image to an
+	// image template (rendered with .Version) which provides them
+	ExtensionImages map[string]string
+	// ExtensionCommand is run in the addon container for each extension (rendered with .Extension)
+	ExtensionCommand []string
+}
+
+// AddonOptions are the per-addon settings from app.json or apppack.toml
+type AddonOptions struct {
+	Version    string   `json:"version,omitempty" toml:"version,omitempty"`
+	Extensions []string `json:"extensions,omitempty" toml:"extensions,omitempty"`
+}
+
+func renderTemplate(name string, text string, data interface{}) (string, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err = tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// URL renders the connection URL for the addon
+func (a AddonSpec) URL() (string, error) {
+	return renderTemplate(a.Alias, a.URLTemplate, a)
+}
+
+// ResolveImage picks the image which provides the requested version and extensions
+func (a AddonSpec) ResolveImage(options AddonOptions) (string, error) {
+	if len(options.Extensions) > 0 && len(a.ExtensionCommand) == 0 {
+		return "", fmt.Errorf("extensions are not supported")
+	}
+	version := options.Version
+	if version == "" {
+		version = a.DefaultVersion
+	}
+	data := map[string]string{"Version": version}
+	extensionImage := ""
+	for _, ext := range options.Extensions {
+		tmpl, ok := a.ExtensionImages[ext]
+		if !ok {
+			continue
+		}
+		if extensionImage != "" && extensionImage != tmpl {
+			return "", fmt.Errorf("no image provides all of the extensions %s", strings.Join(options.Extensions, ", "))
+		}
+		extensionImage = tmpl
+	}
+	if extensionImage != "" {
+		return renderTemplate(a.Alias, extensionImage, data)
+	}
+	if options.Version == "" {
+		return a.Image, nil
+	}
+	if a.VersionImage == "" {
+		return "", fmt.Errorf("version is not supported")
+	}
+	return renderTemplate(a.Alias, a.VersionImage, data)
+}
+
+// ExtensionCommands returns the commands which enable the requested extensions
+func (a AddonSpec) ExtensionCommands(options AddonOptions) ([][]string, error) {
+	commands := [][]string{}
+	for _, ext := range options.Extensions {
+		cmd := make([]string, len(a.ExtensionCommand))
+		for i, arg := range a.ExtensionCommand {
+			rendered, err := renderTemplate(a.Alias, arg, map[string]string{"Extension": ext})
+			if err != nil {
+				return nil, err
+			}
+			cmd[i] = rendered
+		}
+		commands = append(commands, cmd)
+	}
+	return commands, nil
+}
+
+// AddonRegistry maps the addon names allowed in app.json test environments to their containers
+var AddonRegistry = map[string]AddonSpec{
+	"heroku-redis:in-dyno": {
+		Image:        "redis:alpine",
+		Alias:        "redis",
+		EnvVar:       "REDIS_URL",
+		URLTemplate:  "redis://{{.Alias}}:6379",
+		Probe:        ReadinessProbe{Command: []string{"redis-cli", "ping"}},
+		VersionImage: "redis:{{.Version}}-alpine",
+	},
+	"heroku-postgresql:in-dyno": {
+		Image:       "postgres:alpine",
+		Alias:       "db",
+		Env:         []string{"POSTGRES_PASSWORD=postgres"},
+		EnvVar:      "DATABASE_URL",
+		URLTemplate: "postgres://postgres:postgres@{{.Alias}}:5432/postgres",
+		// connect over TCP so the temporary server used during initialization isn't mistaken for ready
+		Probe:          ReadinessProbe{Command: []string{"pg_isready", "-h", "127.0.0.1", "-U", "postgres"}},
+		VersionImage:   "postgres:{{.Version}}-alpine",
+		DefaultVersion: "16",
+		// contrib extensions (pg_trgm, hstore, citext, ...) are in the default image
+		ExtensionImages: map[string]string{
+			"postgis": "postgis/postgis:{{.Version}}-3.4-alpine",
+			"vector":  "pgvector/pgvector:pg{{.Version}}",
+		},
+		ExtensionCommand: []string{"psql", "-h", "127.0.0.1", "-U", "postgres", "-v", "ON_ERROR_STOP=1", "-c", `CREATE EXTENSION IF NOT EXISTS "{{.Extension}}"`},
+	},
+	"mysql:in-dyno": {
+		Image:        "mysql:8",
+		Alias:        "mysql",
+		Env:          []string{"MYSQL_ROOT_PASSWORD=mysql", "MYSQL_DATABASE=test"},
+		EnvVar:       "MYSQL_URL",
+		URLTemplate:  "mysql://root:mysql@{{.Alias}}:3306/test",
+		Probe:        ReadinessProbe{Command: []string{"mysqladmin", "ping", "-h", "127.0.0.1", "-uroot", "-pmysql"}},
+		VersionImage: "mysql:{{.Version}}",
+	},
+	"memcached:in-dyno": {
+		Image:        "memcached:alpine",
+		Alias:        "memcached",
+		EnvVar:       "MEMCACHED_URL",
+		URLTemplate:  "{{.Alias}}:11211",
+		Probe:        ReadinessProbe{Port: 11211},
+		VersionImage: "memcached:{{.Version}}-alpine",
+	},
+	"opensearch:in-dyno": {
+		Image: "opensearchproject/opensearch:2",
+		Alias: "opensearch",
+		Env: []string{
+			"discovery.type=single-node",
+			"DISABLE_SECURITY_PLUGIN=true",
+			"DISABLE_INSTALL_DEMO_CONFIG=true",
+			"OPENSEARCH_JAVA_OPTS=-Xms512m -Xmx512m",
+		},
+		EnvVar:       "OPENSEARCH_URL",
+		URLTemplate:  "http://{{.Alias}}:9200",
+		Probe:        ReadinessProbe{Port: 9200},
+		VersionImage: "opensearchproject/opensearch:{{.Version}}",
+	},
+	"rabbitmq:in-dyno": {
+		Image:        "rabbitmq:3-alpine",
+		Alias:        "rabbitmq",
+		EnvVar:       "RABBITMQ_URL",
+		URLTemplate:  "amqp://guest:guest@{{.Alias}}:5672",
+		Probe:        ReadinessProbe{Command: []string{"rabbitmq-diagnostics", "-q", "ping"}},
+		VersionImage: "rabbitmq:{{.Version}}-alpine",
+	},
+	"mongodb:in-dyno": {
+		Image:        "mongo:7",
+		Alias:        "mongo",
+		EnvVar:       "MONGODB_URL",
+		URLTemplate:  "mongodb://{{.Alias}}:27017/test",
+		Probe:        ReadinessProbe{Port: 27017},
+		VersionImage: "mongo:{{.Version}}",
+	},
+	"minio:in-dyno": {
+		Image:       "minio/minio",
+		Alias:       "minio",
+		Cmd:         []string{"server", "/data"},
+		EnvVar:      "AWS_ENDPOINT_URL_S3",
+		URLTemplate: "http://{{.Alias}}:9000",
+		ExtraEnv: map[string]string{
+			"AWS_ACCESS_KEY_ID":     "minioadmin",
+			"AWS_SECRET_ACCESS_KEY": "minioadmin",
+			"AWS_REGION":            "us-east-1",
+		},
+		Probe:        ReadinessProbe{Port: 9000},
+		VersionImage: "minio/minio:{{.Version}}",
+	},
+}
+
+// supportedAddons returns the registered addon names, sorted
+func supportedAddons() []string {
+	names := make([]string, 0, len(AddonRegistry))
+	for name := range AddonRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type testAddon struct {
+	Name    string
+	Spec    AddonSpec
+	Options AddonOptions
+}
+
+// addonOptions merges the options for an addon from app.json and apppack.toml,
+// with apppack.toml taking precedence
+func (b *Build) addonOptions(addon string) AddonOptions {
+	options := b.AppJSON.GetTestAddonOptions()[addon]
+	if b.AppPackToml == nil {
+		return options
+	}
+	if tomlOptions, ok := b.AppPackToml.Test.Addons[addon]; ok {
+		if tomlOptions.Version != "" {
+			options.Version = tomlOptions.Version
+		}
+		if len(tomlOptions.Extensions) > 0 {
+			options.Extensions = tomlOptions.Extensions
+		}
+	}
+	return options
+}
+
+// testAddons returns the deduplicated addons from app.json and `[test.addons]` in
+// apppack.toml with their specs, failing on any addon which isn't in the registry
+func (b *Build) testAddons() ([]testAddon, error) {
+	names := b.AppJSON.GetTestAddons()
+	if b.AppPackToml != nil {
+		tomlAddons := make([]string, 0, len(b.AppPackToml.Test.Addons))
+		for name := range b.AppPackToml.Test.Addons {
+			tomlAddons = append(tomlAddons, name)
+		}
+		sort.Strings(tomlAddons)
+		names = append(append([]string{}, names...), tomlAddons...)
+	}
+	addons := []testAddon{}
+	for _, name := range removeDuplicateStr(names) {
+		spec, ok := AddonRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown test addon %q (supported: %s)", name, strings.Join(supportedAddons(), ", "))
+		}
+		addons = append(addons, testAddon{Name: name, Spec: spec, Options: b.addonOptions(name)})
+	}
+	return addons, nil
+}
+
+// StartAddons starts a container for each test addon and returns the
+// environment variables the tests need to connect to them
+func (b *Build) StartAddons() (map[string]string, error) {
+	envOverides := map[string]string{}
+	addons, err := b.testAddons()
+	if err != nil {
+		return nil, err
+	}
+	for _, addon := range addons {
+		spec := addon.Spec
+		image, err := spec.ResolveImage(addon.Options)
+		if err != nil {
+			return nil, fmt.Errorf("addon %s: %w", addon.Name, err)
+		}
+		if err = b.containers.PullImage(image); err != nil {
+			return nil, err
+		}
+		config := b.labeled(&container.Config{Image: image, Env: spec.Env, Cmd: spec.Cmd})
+		if err = b.containers.RunContainer(b.addonContainerName(spec.Alias), b.CodebuildBuildId, []string{spec.Alias}, config, nil); err != nil {
+			return nil, err
+		}
+		url, err := spec.URL()
+		if err != nil {
+			return nil, err
+		}
+		envOverides[spec.EnvVar] = url
+		for k, v := range spec.ExtraEnv {
+			envOverides[k] = v
+		}
+	}
+	return envOverides, nil
+}
+
+// enableExtensions runs the extension commands for an addon once it is ready
+func (b *Build) enableExtensions(addon testAddon) error {
+	commands, err := addon.Spec.ExtensionCommands(addon.Options)
+	if err != nil {
+		return err
+	}
+	for i, cmd := range commands {
+		exitCode, err := b.containers.ExecInContainer(b.addonContainerName(addon.Spec.Alias), cmd)
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("enabling extension %s failed with exit code %d", addon.Options.Extensions[i], exitCode)
+		}
+	}
+	return nil
+}
+
+// addonContainerName returns the name of an addon container for this build.
+// Container names must be unique on the CodeBuild Docker daemon (which is
+// reused across builds), so they are prefixed with the build ID. The friendly
+// name ("redis"/"db") is kept as a network alias so other containers can
+// still reach the addon by that hostname.
+func (b *Build) addonContainerName(alias string) string {
+	return fmt.Sprintf("%s-%s", strings.ReplaceAll(b.CodebuildBuildId, ":", "-"), alias)
+}
+
+// probeOnce runs a single readiness check against the container
+func (b *Build) probeOnce(containerName string, probe ReadinessProbe) bool {
+	if len(probe.Command) > 0 {
+		exitCode, err := b.containers.ExecInContainer(containerName, probe.Command)
+		if err != nil {
+			b.Log().Debug().Err(err).Str("container", containerName).Msg("readiness probe failed")
+		}
+		return err == nil && exitCode == 0
+	}
+	ip, err := b.containers.ContainerIP(containerName, b.CodebuildBuildId)
+	if err != nil {
+		b.Log().Debug().Err(err).Str("container", containerName).Msg("readiness probe failed")
+		return false
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(probe.Port)), addonProbeInterval)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// waitForReady polls the probe until it succeeds or the timeout expires
+func (b *Build) waitForReady(containerName string, probe ReadinessProbe, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	for {
+		if b.probeOnce(containerName, probe) {
+			return time.Since(start), nil
+		}
+		if time.Since(start) >= timeout {
+			return time.Since(start), fmt.Errorf("%s was not ready after %s", containerName, timeout)
+		}
+		time.Sleep(addonProbeInterval)
+	}
+}
+
+// readinessTarget is a container which must pass its probe before tests start
+type readinessTarget struct {
+	label     string
+	container string
+	probe     ReadinessProbe
+	// onReady runs once the probe passes
+	onReady func() error
+}
+
+// WaitForAddons blocks until every in-dyno addon and test service with a
+// healthcheck passes its readiness probe, writing how long each one took to w
+func (b *Build) WaitForAddons(w io.Writer) error {
+	timeout := DefaultAddonTimeout
+	if b.AppPackToml != nil {
+		t, err := b.AppPackToml.Test.GetAddonTimeout()
+		if err != nil {
+			return err
+		}
+		if t > 0 {
+			timeout = t
+		}
+	}
+	addons, err := b.testAddons()
+	if err != nil {
+		return err
+	}
+	targets := []readinessTarget{}
+	for _, addon := range addons {
+		targets = append(targets, readinessTarget{
+			label:     "addon " + addon.Name,
+			container: b.addonContainerName(addon.Spec.Alias),
+			probe:     addon.Spec.Probe,
+			onReady:   func() error { return b.enableExtensions(addon) },
+		})
+	}
+	targets = append(targets, b.serviceReadinessTargets()...)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target readinessTarget) {
+			defer wg.Done()
+			elapsed, err := b.waitForReady(target.container, target.probe, timeout)
+			if err == nil && target.onReady != nil {
+				err = target.onReady()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", target.label, err))
+				return
+			}
+			fmt.Fprintf(w, "%s ready after %s\n", target.label, elapsed.Round(time.Millisecond))
+		}(target)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
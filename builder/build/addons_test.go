@@ -0,0 +1,259 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/mock"
+)
+
+// useAddonProbeInterval shortens the wait between readiness probes for the test
+func useAddonProbeInterval(t *testing.T, interval time.Duration) {
+	previous := addonProbeInterval
+	addonProbeInterval = interval
+	t.Cleanup(func() { addonProbeInterval = previous })
+}
+
+func TestWaitForAddons(t *testing.T) {
+	useAddonProbeInterval(t, time.Millisecond)
+	mockedContainers := new(MockContainers)
+	mockedContainers.On(
+		"ExecInContainer",
+		fmt.Sprintf("%s-redis", CodebuildBuildId), []string{"redis-cli", "ping"},
+	).Return(1, nil).Once()
+	mockedContainers.On(
+		"ExecInContainer",
+		fmt.Sprintf("%s-redis", CodebuildBuildId), []string{"redis-cli", "ping"},
+	).Return(0, nil)
+	mockedContainers.On(
+		"ExecInContainer",
+		fmt.Sprintf("%s-db", CodebuildBuildId), []string{"pg_isready", "-h", "127.0.0.1", "-U", "postgres"},
+	).Return(0, nil)
+	b := &Build{
+		CodebuildBuildId: CodebuildBuildId,
+		Ctx:              testContext,
+		AppJSON: &AppJSON{
+			Environments: map[string]Environment{
+				"test": {Addons: []string{"heroku-redis:in-dyno", "heroku-postgresql:in-dyno"}},
+			},
+		},
+		AppPackToml: &AppPackToml{Test: AppPackTomlTest{AddonTimeout: "50ms"}},
+		containers:  mockedContainers,
+	}
+	var out bytes.Buffer
+	if err := b.WaitForAddons(&out); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	for _, addon := range []string{"heroku-redis:in-dyno", "heroku-postgresql:in-dyno"} {
+		if !strings.Contains(out.String(), fmt.Sprintf("addon %s ready after", addon)) {
+			t.Errorf("expected %s wait duration to be reported, got %q", addon, out.String())
+		}
+	}
+	mockedContainers.AssertExpectations(t)
+}
+
+func TestWaitForAddonsTimeout(t *testing.T) {
+	useAddonProbeInterval(t, time.Millisecond)
+	mockedContainers := new(MockContainers)
+	mockedContainers.On(
+		"ExecInContainer",
+		fmt.Sprintf("%s-db", CodebuildBuildId), []string{"pg_isready", "-h", "127.0.0.1", "-U", "postgres"},
+	).Return(2, nil)
+	b := &Build{
+		CodebuildBuildId: CodebuildBuildId,
+		Ctx:              testContext,
+		AppJSON: &AppJSON{
+			Environments: map[string]Environment{
+				"test": {Addons: []string{"heroku-postgresql:in-dyno"}},
+			},
+		},
+		AppPackToml: &AppPackToml{Test: AppPackTomlTest{AddonTimeout: "50ms"}},
+		containers:  mockedContainers,
+	}
+	err := b.WaitForAddons(&bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "heroku-postgresql:in-dyno") {
+		t.Errorf("expected timeout error naming the addon, got %v", err)
+	}
+}
+
+func TestProbeOnceTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	mockedContainers := new(MockContainers)
+	mockedContainers.On("ContainerIP", "addon", CodebuildBuildId).Return("127.0.0.1", nil)
+	b := &Build{
+		CodebuildBuildId: CodebuildBuildId,
+		Ctx:              testContext,
+		AppJSON:          &AppJSON{},
+		AppPackToml:      &AppPackToml{Test: AppPackTomlTest{AddonTimeout: "50ms"}},
+		containers:       mockedContainers,
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	if !b.probeOnce("addon", ReadinessProbe{Port: port}) {
+		t.Error("expected TCP probe to succeed against listening port")
+	}
+	listener.Close()
+	if b.probeOnce("addon", ReadinessProbe{Port: port}) {
+		t.Error("expected TCP probe to fail against closed port")
+	}
+}
+
+func TestStartAddonsRegistry(t *testing.T) {
+	mockedContainers := new(MockContainers)
+	mockedContainers.On("PullImage", "minio/minio").Return(nil)
+	mockedContainers.On(
+		"RunContainer",
+		fmt.Sprintf("%s-minio", CodebuildBuildId), CodebuildBuildId, []string{"minio"},
+		&container.Config{Image: "minio/minio", Cmd: []string{"server", "/data"}, Labels: buildLabels}, (*container.HostConfig)(nil),
+	).Return(nil)
+	b := &Build{
+		CodebuildBuildId: CodebuildBuildId,
+		Ctx:              testContext,
+		AppJSON: &AppJSON{
+			Environments: map[string]Environment{
+				"test": {Addons: []string{"minio:in-dyno"}},
+			},
+		},
+		AppPackToml: &AppPackToml{Test: AppPackTomlTest{AddonTimeout: "50ms"}},
+		containers:  mockedContainers,
+	}
+	env, err := b.StartAddons()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if env["AWS_ENDPOINT_URL_S3"] != "http://minio:9000" {
+		t.Errorf("expected AWS_ENDPOINT_URL_S3=http://minio:9000, got %s", env["AWS_ENDPOINT_URL_S3"])
+	}
+	if env["AWS_ACCESS_KEY_ID"] != "minioadmin" {
+		t.Errorf("expected AWS_ACCESS_KEY_ID=minioadmin, got %s", env["AWS_ACCESS_KEY_ID"])
+	}
+	mockedContainers.AssertExpectations(t)
+}
+
+func TestStartAddonsUnknown(t *testing.T) {
+	mockedContainers := new(MockContainers)
+	b := &Build{
+		CodebuildBuildId: CodebuildBuildId,
+		Ctx:              testContext,
+		AppJSON: &AppJSON{
+			Environments: map[string]Environment{
+				"test": {Addons: []string{"heroku-redis:in-dyno", "heroku-kafka"}},
+			},
+		},
+		AppPackToml: &AppPackToml{Test: AppPackTomlTest{AddonTimeout: "50ms"}},
+		containers:  mockedContainers,
+	}
+	_, err := b.StartAddons()
+	if err == nil || !strings.Contains(err.Error(), "heroku-kafka") {
+		t.Errorf("expected error naming the unknown addon, got %v", err)
+	}
+	mockedContainers.AssertNotCalled(t, "PullImage", mock.Anything)
+}
+
+func TestAddonRegistryURLs(t *testing.T) {
+	for name, spec := range AddonRegistry {
+		url, err := spec.URL()
+		if err != nil {
+			t.Errorf("%s: expected no error, got %s", name, err)
+		}
+		if !strings.Contains(url, spec.Alias) {
+			t.Errorf("%s: expected URL to use alias %s, got %s", name, spec.Alias, url)
+		}
+		if spec.Probe.Port == 0 && len(spec.Probe.Command) == 0 {
+			t.Errorf("%s: no readiness probe", name)
+		}
+	}
+}
+
+func TestAddonResolveImage(t *testing.T) {
+	postgres := AddonRegistry["heroku-postgresql:in-dyno"]
+	tests := []struct {
+		options  AddonOptions
+		expected string
+	}{
+		{AddonOptions{}, "postgres:alpine"},
+		{AddonOptions{Version: "15"}, "postgres:15-alpine"},
+		{AddonOptions{Extensions: []string{"pg_trgm"}}, "postgres:alpine"},
+		{AddonOptions{Extensions: []string{"postgis"}}, "postgis/postgis:16-3.4-alpine"},
+		{AddonOptions{Version: "15", Extensions: []string{"vector", "hstore"}}, "pgvector/pgvector:pg15"},
+	}
+	for _, tt := range tests {
+		image, err := postgres.ResolveImage(tt.options)
+		if err != nil {
+			t.Errorf("%+v: expected no error, got %s", tt.options, err)
+		}
+		if image != tt.expected {
+			t.Errorf("%+v: expected %s, got %s", tt.options, tt.expected, image)
+		}
+	}
+	if _, err := postgres.ResolveImage(AddonOptions{Extensions: []string{"postgis", "vector"}}); err == nil {
+		t.Error("expected error when no image provides all extensions")
+	}
+	if _, err := AddonRegistry["heroku-redis:in-dyno"].ResolveImage(AddonOptions{Extensions: []string{"json"}}); err == nil {
+		t.Error("expected error for extensions on an addon without extension support")
+	}
+}
+
+func TestStartAddonsVersionFromAppPackToml(t *testing.T) {
+	mockedContainers := new(MockContainers)
+	mockedContainers.On("PullImage", "redis:7-alpine").Return(nil)
+	mockedContainers.On(
+		"RunContainer",
+		fmt.Sprintf("%s-redis", CodebuildBuildId), CodebuildBuildId, []string{"redis"},
+		&container.Config{Image: "redis:7-alpine", Labels: buildLabels}, (*container.HostConfig)(nil),
+	).Return(nil)
+	b := &Build{
+		CodebuildBuildId: CodebuildBuildId,
+		Ctx:              testContext,
+		AppJSON:          &AppJSON{},
+		AppPackToml:      &AppPackToml{Test: AppPackTomlTest{AddonTimeout: "50ms"}},
+		containers:       mockedContainers,
+	}
+	b.AppPackToml.Test.Addons = map[string]AddonOptions{"heroku-redis:in-dyno": {Version: "7"}}
+	if _, err := b.StartAddons(); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	mockedContainers.AssertExpectations(t)
+}
+
+func TestWaitForAddonsCreatesExtensions(t *testing.T) {
+	useAddonProbeInterval(t, time.Millisecond)
+	db := fmt.Sprintf("%s-db", CodebuildBuildId)
+	mockedContainers := new(MockContainers)
+	mockedContainers.On("ExecInContainer", db, []string{"pg_isready", "-h", "127.0.0.1", "-U", "postgres"}).Return(0, nil)
+	mockedContainers.On(
+		"ExecInContainer", db,
+		[]string{"psql", "-h", "127.0.0.1", "-U", "postgres", "-v", "ON_ERROR_STOP=1", "-c", `CREATE EXTENSION IF NOT EXISTS "vector"`},
+	).Return(0, nil)
+	mockedContainers.On(
+		"ExecInContainer", db,
+		[]string{"psql", "-h", "127.0.0.1", "-U", "postgres", "-v", "ON_ERROR_STOP=1", "-c", `CREATE EXTENSION IF NOT EXISTS "pg_trgm"`},
+	).Return(1, nil)
+	b := &Build{
+		CodebuildBuildId: CodebuildBuildId,
+		Ctx:              testContext,
+		AppJSON: &AppJSON{
+			Environments: map[string]Environment{
+				"test": {Addons: []string{"heroku-postgresql:in-dyno"}},
+			},
+		},
+		AppPackToml: &AppPackToml{Test: AppPackTomlTest{AddonTimeout: "50ms"}},
+		containers:  mockedContainers,
+	}
+	b.AppPackToml.Test.Addons = map[string]AddonOptions{
+		"heroku-postgresql:in-dyno": {Extensions: []string{"vector", "pg_trgm"}},
+	}
+	err := b.WaitForAddons(&bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "pg_trgm") {
+		t.Errorf("expected error naming the failed extension, got %v", err)
+	}
+	mockedContainers.AssertExpectations(t)
+}
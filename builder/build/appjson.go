@@ -12,7 +12,49 @@ import (
 type Environment struct {
 	Scripts map[string]string `json:"scripts"`
 	Env     map[string]string `json:"env"`
-	Addons  []string          `json:"addons"`
+	Addons  []string          `json:"-"`
+	// AddonOptions holds the options of addons given in object form
+	AddonOptions map[string]AddonOptions `json:"-"`
+}
+
+// appJSONAddon is the object form of an addon, e.g.
+// {"plan": "heroku-postgresql:in-dyno", "options": {"version": "16"}}
+type appJSONAddon struct {
+	Plan    string       `json:"plan"`
+	Options AddonOptions `json:"options"`
+}
+
+// UnmarshalJSON accepts addons as either plan strings or objects
+func (e *Environment) UnmarshalJSON(data []byte) error {
+	type environment Environment
+	var raw struct {
+		environment
+		Addons []json.RawMessage `json:"addons"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*e = Environment(raw.environment)
+	for _, a := range raw.Addons {
+		var plan string
+		if err := json.Unmarshal(a, &plan); err == nil {
+			e.Addons = append(e.Addons, plan)
+			continue
+		}
+		var addon appJSONAddon
+		if err := json.Unmarshal(a, &addon); err != nil {
+			return fmt.Errorf("invalid addon %s: %w", a, err)
+		}
+		if addon.Plan == "" {
+			return fmt.Errorf("invalid addon %s: plan is required", a)
+		}
+		e.Addons = append(e.Addons, addon.Plan)
+		if e.AddonOptions == nil {
+			e.AddonOptions = map[string]AddonOptions{}
+		}
+		e.AddonOptions[addon.Plan] = addon.Options
+	}
+	return nil
 }
 
 type Buildpack struct {
@@ -166,6 +208,11 @@ func (a *AppJSON) GetTestAddons() []string {
 	return a.Environments["test"].Addons
 }
 
+// GetTestAddonOptions returns the options of test addons given in object form
+func (a *AppJSON) GetTestAddonOptions() map[string]AddonOptions {
+	return a.Environments["test"].AddonOptions
+}
+
 // ToApppackToml converts app.json to an apppack.toml
 func (a *AppJSON) ToApppackToml() *AppPackToml {
 	t := AppPackToml{}
@@ -180,6 +180,47 @@ func TestAppJsonToApppackToml(t *testing.T) {
 		t.Errorf("expected %s, got %s", expected.Build, actual.Build)
 	}
 	if !reflect.DeepEqual(expected.Test, actual.Test) {
-		t.Errorf("expected %s, got %s", expected.Test, actual.Test)
+		t.Errorf("expected %v, got %v", expected.Test, actual.Test)
+	}
+}
+
+func TestAppJsonAddonObjects(t *testing.T) {
+	a := AppJSON{
+		reader: func() ([]byte, error) {
+			return []byte(`{"environments": {"test": {
+				"scripts": {"test": "pytest"},
+				"addons": [
+					"heroku-redis:in-dyno",
+					{"plan": "heroku-postgresql:in-dyno", "options": {"version": "15", "extensions": ["postgis"]}}
+				]
+			}}}`), nil
+		},
+		ctx: testContext,
+	}
+	if err := a.Unmarshal(); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	expected := []string{"heroku-redis:in-dyno", "heroku-postgresql:in-dyno"}
+	if !stringSliceEqual(a.GetTestAddons(), expected) {
+		t.Errorf("expected %s, got %s", expected, a.GetTestAddons())
+	}
+	options := a.GetTestAddonOptions()["heroku-postgresql:in-dyno"]
+	if options.Version != "15" || !stringSliceEqual(options.Extensions, []string{"postgis"}) {
+		t.Errorf("expected version 15 with postgis, got %+v", options)
+	}
+	if a.TestScript() != "pytest" {
+		t.Errorf("expected pytest, got %s", a.TestScript())
+	}
+}
+
+func TestAppJsonAddonObjectInvalid(t *testing.T) {
+	a := AppJSON{
+		reader: func() ([]byte, error) {
+			return []byte(`{"environments": {"test": {"addons": [{"options": {}}]}}}`), nil
+		},
+		ctx: testContext,
+	}
+	if err := a.Unmarshal(); err == nil {
+		t.Error("expected error for addon without a plan")
 	}
 }
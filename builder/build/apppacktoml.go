@@ -4,10 +4,14 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/apppackio/codebuild-image/builder/filesystem"
+	units "github.com/docker/go-units"
 	"github.com/rs/zerolog/log"
 )
 
@@ -21,11 +25,82 @@ type AppPackTomlBuild struct {
 	Buildpacks []string `toml:"buildpacks,omitempty"`
 	Builder    string   `toml:"builder,omitempty"`
 	Dockerfile string   `toml:"dockerfile,omitempty"`
+	// EnvAllowlist and EnvDenylist are glob patterns of config keys passed to the build
+	EnvAllowlist []string `toml:"env_allowlist,omitempty"`
+	EnvDenylist  []string `toml:"env_denylist,omitempty"`
+	// Cache is how the build cache is stored, "sync" (file by file) or "archive"
+	Cache string `toml:"cache,omitempty"`
+	// CacheMaxSize limits the size of an archived build cache (e.g. "5g")
+	CacheMaxSize string `toml:"cache_max_size,omitempty"`
+}
+
+const (
+	CacheModeSync    = "sync"
+	CacheModeArchive = "archive"
+	// DefaultCacheMaxSize limits archived build caches when no size is configured
+	DefaultCacheMaxSize = 5 << 30
+)
+
+// GetCacheMaxSize returns the largest build cache archived in bytes, falling back to the default
+func (b AppPackTomlBuild) GetCacheMaxSize() (int64, error) {
+	if b.CacheMaxSize == "" {
+		return DefaultCacheMaxSize, nil
+	}
+	return units.RAMInBytes(b.CacheMaxSize)
 }
 
 type AppPackTomlTest struct {
 	Command string   `toml:"command,omitempty"`
 	Env     []string `toml:"env,omitempty"`
+	Reports []string `toml:"reports,omitempty"`
+	Timeout string   `toml:"timeout,omitempty"`
+	Memory  string   `toml:"memory,omitempty"`
+	CPUs    float64  `toml:"cpus,omitempty"`
+	// AddonTimeout is how long to wait for in-dyno addons and services to become ready
+	AddonTimeout string                            `toml:"addon_timeout,omitempty"`
+	Services     map[string]AppPackTomlTestService `toml:"services,omitempty"`
+	// Addons sets options for (and enables) test addons, keyed by plan name
+	Addons map[string]AddonOptions `toml:"addons,omitempty"`
+}
+
+type AppPackTomlHealthcheck struct {
+	Command []string `toml:"command,omitempty"`
+	Port    int      `toml:"port,omitempty"`
+}
+
+// AppPackTomlTestService is a sidecar container started on the build network for tests
+type AppPackTomlTestService struct {
+	Image   string   `toml:"image"`
+	Env     []string `toml:"env,omitempty"`
+	Aliases []string `toml:"aliases,omitempty"`
+	Command []string `toml:"command,omitempty"`
+	// ConnectionEnv is added to the test container's environment (KEY=VALUE)
+	ConnectionEnv []string                `toml:"connection_env,omitempty"`
+	Healthcheck   *AppPackTomlHealthcheck `toml:"healthcheck,omitempty"`
+}
+
+// GetTimeout returns the maximum duration of the test run (zero is no limit)
+func (t AppPackTomlTest) GetTimeout() (time.Duration, error) {
+	if t.Timeout == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(t.Timeout)
+}
+
+// GetAddonTimeout returns the addon readiness timeout (zero uses the default)
+func (t AppPackTomlTest) GetAddonTimeout() (time.Duration, error) {
+	if t.AddonTimeout == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(t.AddonTimeout)
+}
+
+// GetMemory returns the memory limit of the test container in bytes (zero is no limit)
+func (t AppPackTomlTest) GetMemory() (int64, error) {
+	if t.Memory == "" {
+		return 0, nil
+	}
+	return units.RAMInBytes(t.Memory)
 }
 
 type AppPackTomlDeploy struct {
@@ -35,6 +110,20 @@ type AppPackTomlDeploy struct {
 type AppPackTomlReviewApp struct {
 	InitializeCommand string `toml:"initialize_command,omitempty"`
 	PreDestroyCommand string `toml:"pre_destroy_command,omitempty"`
+	PreDestroyTimeout string `toml:"pre_destroy_timeout,omitempty"`
+	// Branches are globs of branch names which get preview environments, e.g. `release/*`
+	Branches []string `toml:"branches,omitempty"`
+}
+
+// DefaultPreDestroyTimeout limits the pre-destroy command when no timeout is configured
+const DefaultPreDestroyTimeout = 10 * time.Minute
+
+// GetPreDestroyTimeout returns the pre-destroy command timeout, falling back to the default
+func (r AppPackTomlReviewApp) GetPreDestroyTimeout() (time.Duration, error) {
+	if r.PreDestroyTimeout == "" {
+		return DefaultPreDestroyTimeout, nil
+	}
+	return time.ParseDuration(r.PreDestroyTimeout)
 }
 
 type AppPackTomlService struct {
@@ -64,11 +153,62 @@ func (a AppPackToml) Validate() error {
 	if a.UseBuildpacks() && len(a.Services) > 0 {
 		return fmt.Errorf("apppack.toml: [build] buildpacks cannot be used with services -- use Procfile instead")
 	}
+	for _, glob := range a.Build.EnvAllowlist {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("apppack.toml: [build] env_allowlist %s is not a valid glob pattern", glob)
+		}
+	}
+	for _, glob := range a.Build.EnvDenylist {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("apppack.toml: [build] env_denylist %s is not a valid glob pattern", glob)
+		}
+	}
+	if a.Build.Cache != "" && a.Build.Cache != CacheModeSync && a.Build.Cache != CacheModeArchive {
+		return fmt.Errorf("apppack.toml: [build] cache must be %q or %q", CacheModeSync, CacheModeArchive)
+	}
+	if size, err := a.Build.GetCacheMaxSize(); err != nil || size <= 0 {
+		return fmt.Errorf("apppack.toml: [build] cache_max_size %s is not a valid size (e.g. \"5g\")", a.Build.CacheMaxSize)
+	}
 	for _, e := range a.Test.Env {
 		if !strings.Contains(e, "=") {
 			return fmt.Errorf("apppack.toml: [test] env %s is not in KEY=VALUE format", e)
 		}
 	}
+	for _, r := range a.Test.Reports {
+		if _, err := path.Match(r, ""); err != nil {
+			return fmt.Errorf("apppack.toml: [test] reports %s is not a valid glob pattern", r)
+		}
+	}
+	for name := range a.Test.Addons {
+		if _, ok := AddonRegistry[name]; !ok {
+			return fmt.Errorf("apppack.toml: [test.addons] unknown addon %s", name)
+		}
+	}
+	for name, svc := range a.Test.Services {
+		if err := svc.validate(name); err != nil {
+			return err
+		}
+	}
+	if timeout, err := a.Test.GetTimeout(); err != nil || timeout < 0 {
+		return fmt.Errorf("apppack.toml: [test] timeout %s is not a valid duration (e.g. \"15m\")", a.Test.Timeout)
+	}
+	if timeout, err := a.Test.GetAddonTimeout(); err != nil || timeout < 0 {
+		return fmt.Errorf("apppack.toml: [test] addon_timeout %s is not a valid duration (e.g. \"2m\")", a.Test.AddonTimeout)
+	}
+	if memory, err := a.Test.GetMemory(); err != nil || memory < 0 {
+		return fmt.Errorf("apppack.toml: [test] memory %s is not a valid size (e.g. \"2g\")", a.Test.Memory)
+	}
+	if a.Test.CPUs < 0 {
+		return fmt.Errorf("apppack.toml: [test] cpus must be a positive number")
+	}
+	for _, glob := range a.ReviewApp.Branches {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("apppack.toml: [review_app] branches %s is not a valid glob pattern", glob)
+		}
+	}
+	if timeout, err := a.ReviewApp.GetPreDestroyTimeout(); err != nil || timeout <= 0 {
+		return fmt.Errorf("apppack.toml: [review_app] pre_destroy_timeout %s is not a valid duration (e.g. \"5m\")", a.ReviewApp.PreDestroyTimeout)
+	}
 	// all validation below is for dockerfile builds
 	if !a.UseDockerfile() {
 		return nil
@@ -88,6 +228,26 @@ func (a AppPackToml) Validate() error {
 	return nil
 }
 
+var serviceNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+func (s AppPackTomlTestService) validate(name string) error {
+	if !serviceNameRegex.MatchString(name) {
+		return fmt.Errorf("apppack.toml: [test.services] %s is not a valid name (lowercase letters, numbers and dashes)", name)
+	}
+	if s.Image == "" {
+		return fmt.Errorf("apppack.toml: [test.services.%s] image is required", name)
+	}
+	for _, e := range append(append([]string{}, s.Env...), s.ConnectionEnv...) {
+		if !strings.Contains(e, "=") {
+			return fmt.Errorf("apppack.toml: [test.services.%s] env %s is not in KEY=VALUE format", name, e)
+		}
+	}
+	if s.Healthcheck != nil && len(s.Healthcheck.Command) == 0 && s.Healthcheck.Port <= 0 {
+		return fmt.Errorf("apppack.toml: [test.services.%s] healthcheck requires a command or port", name)
+	}
+	return nil
+}
+
 func (a *AppPackToml) GetTestEnv() map[string]string {
 	env := map[string]string{
 		"CI": "true",
@@ -84,3 +84,102 @@ func TestAppPackTomlTestEnvEmpty(t *testing.T) {
 		t.Errorf("expected CI=true, got %s", env["CI"])
 	}
 }
+
+func TestAppPackTomlValidateTestLimits(t *testing.T) {
+	for _, test := range []AppPackTomlTest{
+		{Timeout: "15"},
+		{Timeout: "-1m"},
+		{Memory: "lots"},
+		{CPUs: -1},
+	} {
+		c := AppPackToml{Test: test}
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected error for %+v", test)
+		}
+	}
+	c := AppPackToml{Test: AppPackTomlTest{Timeout: "15m", Memory: "2g", CPUs: 1.5}}
+	if err := c.Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestAppPackTomlValidateBuildCache(t *testing.T) {
+	for _, build := range []AppPackTomlBuild{
+		{Cache: "tarball"},
+		{Cache: CacheModeArchive, CacheMaxSize: "big"},
+		{Cache: CacheModeArchive, CacheMaxSize: "0"},
+	} {
+		c := AppPackToml{Build: build}
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected error for %+v", build)
+		}
+	}
+	c := AppPackToml{Build: AppPackTomlBuild{Cache: CacheModeArchive, CacheMaxSize: "2g"}}
+	if err := c.Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if size, _ := c.Build.GetCacheMaxSize(); size != 2<<30 {
+		t.Errorf("expected 2GiB, got %d", size)
+	}
+}
+
+func TestAppPackTomlValidateBuildEnvPatterns(t *testing.T) {
+	for _, build := range []AppPackTomlBuild{
+		{EnvAllowlist: []string{"NODE_["}},
+		{EnvDenylist: []string{"*_TOKEN", "SECRET_["}},
+	} {
+		c := AppPackToml{Build: build}
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected error for %+v", build)
+		}
+	}
+	c := AppPackToml{Build: AppPackTomlBuild{EnvAllowlist: []string{"NODE_*"}, EnvDenylist: []string{"*_TOKEN"}}}
+	if err := c.Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestAppPackTomlValidateTestServices(t *testing.T) {
+	for name, svc := range map[string]AppPackTomlTestService{
+		"no-image":  {},
+		"Bad_Name":  {Image: "nginx"},
+		"bad-env":   {Image: "nginx", Env: []string{"FOO"}},
+		"bad-conn":  {Image: "nginx", ConnectionEnv: []string{"URL"}},
+		"bad-check": {Image: "nginx", Healthcheck: &AppPackTomlHealthcheck{}},
+	} {
+		c := AppPackToml{Test: AppPackTomlTest{Services: map[string]AppPackTomlTestService{name: svc}}}
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected error for service %s", name)
+		}
+	}
+	c := AppPackToml{Test: AppPackTomlTest{Services: map[string]AppPackTomlTestService{
+		"postgis": {Image: "postgis/postgis:16-3.4", Healthcheck: &AppPackTomlHealthcheck{Port: 5432}},
+	}}}
+	if err := c.Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestAppPackTomlValidateTestAddons(t *testing.T) {
+	c := AppPackToml{Test: AppPackTomlTest{Addons: map[string]AddonOptions{"heroku-kafka": {}}}}
+	if err := c.Validate(); err == nil {
+		t.Error("expected error for unknown addon")
+	}
+	c = AppPackToml{Test: AppPackTomlTest{Addons: map[string]AddonOptions{"heroku-postgresql:in-dyno": {Version: "16"}}}}
+	if err := c.Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestAppPackTomlValidatePreDestroyTimeout(t *testing.T) {
+	for _, timeout := range []string{"10", "0s", "-5m"} {
+		c := AppPackToml{ReviewApp: AppPackTomlReviewApp{PreDestroyTimeout: timeout}}
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected error for pre_destroy_timeout %s", timeout)
+		}
+	}
+	r := AppPackTomlReviewApp{}
+	if timeout, err := r.GetPreDestroyTimeout(); err != nil || timeout != DefaultPreDestroyTimeout {
+		t.Errorf("expected default timeout, got %s, %v", timeout, err)
+	}
+}
@@ -0,0 +1,92 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apppackio/codebuild-image/builder/aws"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultArchiveTTL is how long the status of a merged or closed review app is
+// kept, so its history is available after the review app is gone
+const DefaultArchiveTTL = 30 * 24 * time.Hour
+
+// archiveReviewApp deletes the config of a merged or closed review app and
+// marks its status as archived
+func (b *Build) archiveReviewApp(status *PRStatus) error {
+	configPath := reviewAppConfigPath(b.Appname, b.reviewAppID())
+	deleted, err := b.aws.DeleteParametersByPath(configPath)
+	if err != nil {
+		return err
+	}
+	b.Log().Info().Str("path", configPath).Int("count", deleted).Msg("deleted review app config")
+	now := time.Now().UTC()
+	status.ArchivedAt = &now
+	return b.writePRStatus(status)
+}
+
+// reviewAppStatuses returns the raw status of every PR review app and branch preview, by ID
+func reviewAppStatuses(a aws.AWSInterface, appName string) (map[string]string, []string, error) {
+	params := map[string]string{}
+	for _, prefix := range []string{"pr/", "branch/"} {
+		path := reviewAppParameterName(appName, prefix)
+		values, err := a.GetParametersByPath(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		for name, value := range values {
+			params[prefix+strings.TrimPrefix(name, path)] = value
+		}
+	}
+	ids := make([]string, 0, len(params))
+	for id := range params {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return params, ids, nil
+}
+
+// PurgeArchivedReviewApps deletes the status, and any remaining config, of
+// review apps archived more than olderThan ago. With dryRun, the review apps
+// are only reported.
+func PurgeArchivedReviewApps(ctx context.Context, a aws.AWSInterface, appName string, olderThan time.Duration, dryRun bool) ([]string, error) {
+	logger := log.Ctx(ctx)
+	now := time.Now()
+	params, ids, err := reviewAppStatuses(a, appName)
+	if err != nil {
+		return nil, err
+	}
+	purged := []string{}
+	var errs []error
+	for _, pr := range ids {
+		var status PRStatus
+		if err := json.Unmarshal([]byte(params[pr]), &status); err != nil {
+			continue
+		}
+		if status.ArchivedAt == nil || now.Sub(*status.ArchivedAt) <= olderThan {
+			continue
+		}
+		if dryRun {
+			logger.Info().Str("pr", pr).Msg("would purge archived review app")
+			purged = append(purged, pr)
+			continue
+		}
+		logger.Info().Str("pr", pr).Msg("purging archived review app")
+		if _, err := a.DeleteParametersByPath(reviewAppConfigPath(appName, pr)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", pr, err))
+			continue
+		}
+		if err := a.DeleteParameter(reviewAppParameterName(appName, pr)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", pr, err))
+			continue
+		}
+		purged = append(purged, pr)
+	}
+	return purged, errors.Join(errs...)
+}
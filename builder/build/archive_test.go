@@ -0,0 +1,168 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apppackio/codebuild-image/builder/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// fakeParameterStore keeps SSM parameters in a map. Calls it doesn't
+// override go to the embedded mock.
+type fakeParameterStore struct {
+	*MockAWS
+	params map[string]string
+}
+
+func (f *fakeParameterStore) GetParameter(name string) (string, error) {
+	value, ok := f.params[name]
+	if !ok {
+		return "", fmt.Errorf("ParameterNotFound: %s", name)
+	}
+	return value, nil
+}
+
+func (f *fakeParameterStore) SetParameter(name string, value string) error {
+	f.params[name] = value
+	return nil
+}
+
+// GetParametersByPath only returns parameters directly under the path, like SSM without Recursive
+func (f *fakeParameterStore) GetParametersByPath(path string) (map[string]string, error) {
+	params := map[string]string{}
+	for name, value := range f.params {
+		if strings.HasPrefix(name, path) && !strings.Contains(strings.TrimPrefix(name, path), "/") {
+			params[name] = value
+		}
+	}
+	return params, nil
+}
+
+func (f *fakeParameterStore) DeleteParameter(name string) error {
+	delete(f.params, name)
+	return nil
+}
+
+func (f *fakeParameterStore) DeleteParametersByPath(path string) (int, error) {
+	deleted := 0
+	for name := range f.params {
+		if strings.HasPrefix(name, path) {
+			delete(f.params, name)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func archivedStatus(t *testing.T, pr string, archivedAt *time.Time) string {
+	value, err := json.Marshal(PRStatus{PullRequest: pr, Status: MergedPRStatus, ArchivedAt: archivedAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(value)
+}
+
+func TestHandlePRClosedArchivesConfig(t *testing.T) {
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("DescribeStack", "apppack-reviewapp-test-app123").Return((*types.Stack)(nil), aws.ErrStackNotFound)
+	fake := &fakeParameterStore{MockAWS: mockedAWS, params: map[string]string{
+		"/apppack/pipelines/test-app/config/SECRET_KEY":                  "pipeline",
+		"/apppack/pipelines/test-app/review-apps/pr/123":                 `{"pull_request":"pr/123","status":"created"}`,
+		"/apppack/pipelines/test-app/review-apps/pr/123/config/DEBUG":    "1",
+		"/apppack/pipelines/test-app/review-apps/pr/123/config/API_KEY":  "abc",
+		"/apppack/pipelines/test-app/review-apps/pr/1234/config/API_KEY": "def",
+	}}
+	mockedState := emptyState()
+	b := Build{
+		Appname:               "test-app",
+		Pipeline:              true,
+		PullRequest:           "pr/123",
+		CodebuildWebhookEvent: "PULL_REQUEST_CLOSED",
+		CodebuildBuildId:      CodebuildBuildId,
+		aws:                   fake,
+		state:                 mockedState,
+		Ctx:                   testContext,
+	}
+	skip, err := b.HandlePR()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if !skip {
+		t.Error("HandlePR should skip the build when the PR is closed")
+	}
+	if len(fake.params) != 3 {
+		t.Errorf("expected only the review app config to be deleted, got %v", fake.params)
+	}
+	var status PRStatus
+	if err := json.Unmarshal([]byte(fake.params["/apppack/pipelines/test-app/review-apps/pr/123"]), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != ClosedPRStatus || status.ArchivedAt == nil {
+		t.Errorf("expected a closed, archived status, got %+v", status)
+	}
+	mockedAWS.AssertExpectations(t)
+	mockedState.AssertExpectations(t)
+}
+
+func TestTransitionClearsArchivedAt(t *testing.T) {
+	archivedAt := time.Now()
+	status := PRStatus{PullRequest: "pr/123", Status: ClosedPRStatus, ArchivedAt: &archivedAt}
+	if err := status.Transition(ReopenedPRStatus, "PULL_REQUEST_REOPENED", CodebuildBuildId, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if status.ArchivedAt != nil {
+		t.Error("expected a reopened review app not to be archived")
+	}
+}
+
+func archivedReviewApps(t *testing.T) *fakeParameterStore {
+	old := time.Now().Add(-2 * DefaultArchiveTTL)
+	recent := time.Now().Add(-time.Hour)
+	return &fakeParameterStore{MockAWS: new(MockAWS), params: map[string]string{
+		reviewAppsPath + "1":                   archivedStatus(t, "pr/1", &old),
+		reviewAppsPath + "1/config/DEBUG":      "1",
+		reviewAppsPath + "2":                   archivedStatus(t, "pr/2", &recent),
+		reviewAppsPath + "3":                   archivedStatus(t, "pr/3", nil),
+		reviewAppsPath + "4":                   "not json",
+		branchPreviewsPath + "release-2-0":     archivedStatus(t, "branch/release-2-0", &old),
+		branchPreviewsPath + "release-2-1":     archivedStatus(t, "branch/release-2-1", &recent),
+		"/apppack/pipelines/test-app/config/A": "a",
+	}}
+}
+
+func TestPurgeArchivedReviewApps(t *testing.T) {
+	fake := archivedReviewApps(t)
+	purged, err := PurgeArchivedReviewApps(testContext, fake, "test-app", DefaultArchiveTTL, false)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if len(purged) != 2 || purged[0] != "branch/release-2-0" || purged[1] != "pr/1" {
+		t.Errorf("expected branch/release-2-0 and pr/1 to be purged, got %v", purged)
+	}
+	for _, name := range []string{reviewAppsPath + "1", reviewAppsPath + "1/config/DEBUG", branchPreviewsPath + "release-2-0"} {
+		if _, ok := fake.params[name]; ok {
+			t.Errorf("expected %s to be deleted", name)
+		}
+	}
+	if len(fake.params) != 5 {
+		t.Errorf("expected recent and unarchived review apps to be kept, got %v", fake.params)
+	}
+}
+
+func TestPurgeArchivedReviewAppsDryRun(t *testing.T) {
+	fake := archivedReviewApps(t)
+	purged, err := PurgeArchivedReviewApps(testContext, fake, "test-app", DefaultArchiveTTL, true)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if len(purged) != 2 {
+		t.Errorf("expected branch/release-2-0 and pr/1 to be reported, got %v", purged)
+	}
+	if len(fake.params) != 8 {
+		t.Errorf("expected nothing to be deleted, got %v", fake.params)
+	}
+}
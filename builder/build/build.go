@@ -10,6 +10,7 @@ import (
 
 	"github.com/apppackio/codebuild-image/builder/containers"
 	"github.com/apppackio/codebuild-image/builder/filesystem"
+	"github.com/apppackio/codebuild-image/builder/redact"
 	"github.com/docker/docker/api/types/container"
 	"github.com/google/go-containerregistry/pkg/crane"
 	cp "github.com/otiai10/copy"
@@ -28,8 +29,54 @@ func stripParamPrefix(params map[string]string, prefix string, final *map[string
 	}
 }
 
-func (b *Build) LoadBuildEnv() (map[string]string, error) {
+// loadConfig reads the config parameters, overlaying any additional paths
+// (for review apps), and resolves Secrets Manager references. The values are
+// remembered so they can be masked in the build and test logs, and fingerprinted
+// to report config changes between builds when there's an artifact bucket to
+// store the fingerprint in.
+func (b *Build) loadConfig() (map[string]string, error) {
 	paths := b.ConfigParameterPaths()
+	config := map[string]string{}
+	for _, path := range paths {
+		params, err := b.aws.GetParametersByPath(path)
+		if err != nil {
+			return nil, err
+		}
+		stripParamPrefix(params, path, &config)
+	}
+	if err := b.resolveSecretReferences(config); err != nil {
+		return nil, err
+	}
+	b.redact = make([]string, 0, len(config))
+	for _, v := range config {
+		b.redact = append(b.redact, v)
+	}
+	b.configFingerprint = nil
+	if b.ArtifactBucket == "" {
+		return config, nil
+	}
+	secret, err := b.fingerprintSecret()
+	if err != nil {
+		b.Log().Warn().Err(err).Msg("unable to read the config fingerprint secret, config changes won't be reported")
+		return config, nil
+	}
+	b.configFingerprint = fingerprintConfig(secret, config)
+	return config, nil
+}
+
+// LoadBuildEnv returns the environment for the build, with only the config
+// which is visible to the build
+func (b *Build) LoadBuildEnv() (map[string]string, error) {
+	return b.loadEnv(true)
+}
+
+// LoadRuntimeEnv returns the environment with all of the app's config, for
+// commands run in the built image
+func (b *Build) LoadRuntimeEnv() (map[string]string, error) {
+	return b.loadEnv(false)
+}
+
+func (b *Build) loadEnv(buildOnly bool) (map[string]string, error) {
 	env := map[string]string{
 		"CI": "true",
 	}
@@ -50,21 +97,18 @@ func (b *Build) LoadBuildEnv() (map[string]string, error) {
 			env[k] = v
 		}
 	}
-	params, err := b.aws.GetParametersByPath(paths[0])
-	stripParamPrefix(params, paths[0], &env)
+	config, err := b.loadConfig()
 	if err != nil {
 		return nil, err
 	}
-	if len(paths) > 1 {
-		// overlay vars from additional paths (for review apps)
-		for _, path := range paths[1:] {
-			params, err := b.aws.GetParametersByPath(path)
-			if err != nil {
-				return nil, err
-			}
-			stripParamPrefix(params, path, &env)
+	if buildOnly {
+		if config, err = b.filterBuildConfig(config); err != nil {
+			return nil, err
 		}
 	}
+	for k, v := range config {
+		env[k] = v
+	}
 	envOverride, err := b.state.ReadEnvFile()
 	if err != nil {
 		b.Log().Debug().Err(err).Msg("cannot read env file")
@@ -83,12 +127,13 @@ func (b *Build) BuildpackBuilders() []string {
 	return b.AppJSON.GetBuilders()
 }
 
-func (b *Build) RunBuild() error {
+func (b *Build) RunBuild() (err error) {
 	skipBuild, _ := b.state.ShouldSkipBuild(b.CodebuildBuildId)
 	if skipBuild {
 		b.Log().Info().Msg("skipping build")
 		return nil
 	}
+	defer func() { b.notifyResult(BuildStatusContext, "Build", err) }()
 	logFileName := "build.log"
 	logFile, err := os.CreateTemp("", logFileName)
 	if err != nil {
@@ -101,11 +146,13 @@ func (b *Build) RunBuild() error {
 	if err != nil {
 		return err
 	}
+	b.reportConfigDrift()
 	imageName, err := b.ImageName()
 	if err != nil {
 		return err
 	}
 	buildConfig := containers.NewBuildConfig(imageName, b.CodebuildBuildNumber, appEnv, logFile, CacheDirectory)
+	buildConfig.Redact = b.redact
 	PrintStartMarker("build")
 	defer PrintEndMarker("build")
 	if b.System() == DockerBuildSystemKeyword {
@@ -116,21 +163,37 @@ func (b *Build) RunBuild() error {
 	if err != nil {
 		return err
 	}
+	cacheReport := b.readCacheRestore()
+	if cacheReport.Reuse, err = b.cacheReuse(logFile.Name()); err != nil {
+		b.Log().Debug().Err(err).Msg("cannot read cache reuse from the build log")
+	}
 	fmt.Println("===> PUBLISHING")
 	var wg sync.WaitGroup
 	wg.Add(1)
 	var cacheArchiveError error
 	go func() {
 		defer wg.Done()
-		cacheArchiveError = b.archiveCache()
+		cacheReport.Save, cacheArchiveError = b.archiveCache()
 	}()
 	if err = b.pushImages(buildConfig); err != nil {
 		return err
 	}
+	if b.Pipeline {
+		if err = b.recordReviewAppImage(buildConfig.Image); err != nil {
+			b.Log().Warn().Err(err).Msg("failed to record review app image")
+		}
+	}
 	wg.Wait()
 	if cacheArchiveError != nil {
 		return cacheArchiveError
 	}
+	b.logCacheReport(cacheReport)
+	if err = b.state.WriteJsonToFile(CacheReportFilename, cacheReport); err != nil {
+		b.Log().Warn().Err(err).Msg("failed to write cache report")
+	}
+	if err = b.expireCaches(); err != nil {
+		b.Log().Warn().Err(err).Msg("failed to expire stale build caches")
+	}
 	if err = cp.Copy(logFile.Name(), "build.log"); err != nil {
 		return err
 	}
@@ -177,16 +240,20 @@ func (b *Build) buildWithPack(config *containers.BuildConfig) error {
 	packArgs = append(packArgs, config.Image)
 	b.Log().Debug().Str("builder", builder).Str("buildpacks", buildpacks).Msg("building image")
 	cmd = exec.Command("pack", packArgs...)
-	out := io.MultiWriter(os.Stdout, config.LogFile)
+	out := redact.NewWriter(io.MultiWriter(os.Stdout, config.LogFile), config.Redact)
 	cmd.Stdout = out
 	cmd.Stderr = out
-	if err := cmd.Run(); err != nil {
+	err := cmd.Run()
+	if flushErr := out.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
 		return err
 	}
 	fmt.Println("Extracting buildpack metadata")
 	defer b.containers.Close()
 	containerID := fmt.Sprintf("%s-%s", b.Appname, strings.ReplaceAll(b.CodebuildBuildId, ":", "-"))
-	cid, err := b.containers.CreateContainer(containerID, &container.Config{Image: config.Image})
+	cid, err := b.containers.CreateContainer(containerID, b.labeled(&container.Config{Image: config.Image}))
 	if err != nil {
 		return err
 	}
@@ -225,9 +292,3 @@ func (b *Build) pushImages(config *containers.BuildConfig) error {
 	}
 	return nil
 }
-
-func (b *Build) archiveCache() error {
-	fmt.Println("Archiving build cache to S3 ...")
-	quiet := b.Log().GetLevel() > zerolog.DebugLevel
-	return b.aws.SyncToS3(CacheDirectory, b.ArtifactBucket, "cache", quiet)
-}
@@ -1,8 +1,14 @@
 package build
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
 )
 
 func TestLoadEnv(t *testing.T) {
@@ -13,6 +19,7 @@ func TestLoadEnv(t *testing.T) {
 		"GetParametersByPath",
 		appConfigPrefix,
 	).Return(map[string]string{appConfigPrefix + "FOO": "bar"}, nil)
+	mockedAWS.On("ListParametersByTag", mock.Anything, BuildVisibleTag, BuildVisibleTagValue).Return([]string{}, nil)
 	mockedState := emptyState()
 	mockedState.On("ReadEnvFile").Return(&map[string]string{"FOO": "override"}, nil)
 	b := Build{
@@ -32,6 +39,10 @@ func TestLoadEnv(t *testing.T) {
 	if env["FOO"] != "override" {
 		t.Errorf("expected FOO=override, got %s", env["FOO"])
 	}
+	// only values from SSM are masked in the logs
+	if len(b.redact) != 1 || b.redact[0] != "bar" {
+		t.Errorf("expected the config value to be redacted, got %v", b.redact)
+	}
 }
 
 func TestLoadEnvInheritance(t *testing.T) {
@@ -48,16 +59,17 @@ func TestLoadEnvInheritance(t *testing.T) {
 		"GetParametersByPath",
 		reviewAppConfigPrefix,
 	).Return(map[string]string{reviewAppConfigPrefix + "FOO": "bar2"}, nil)
+	mockedAWS.On("ListParametersByTag", mock.Anything, BuildVisibleTag, BuildVisibleTagValue).Return([]string{}, nil)
 	mockedState := emptyState()
 	envFileCall := mockedState.On("ReadEnvFile").Return(&map[string]string{}, nil)
 	b := Build{
-		Appname:                appName,
-		Pipeline:               true,
-		CodebuildBuildId:       CodebuildBuildId,
-		CodebuildSourceVersion: pr,
-		aws:                    mockedAWS,
-		state:                  mockedState,
-		Ctx:                    testContext,
+		Appname:          appName,
+		Pipeline:         true,
+		CodebuildBuildId: CodebuildBuildId,
+		PullRequest:      pr,
+		aws:              mockedAWS,
+		state:            mockedState,
+		Ctx:              testContext,
 	}
 
 	// Test that review app config overrides pipeline config
@@ -85,6 +97,7 @@ func TestLoadBuildEnvCIVars(t *testing.T) {
 	mockedAWS := new(MockAWS)
 	appConfigPrefix := fmt.Sprintf("/apppack/apps/%s/config/", appName)
 	mockedAWS.On("GetParametersByPath", appConfigPrefix).Return(map[string]string{}, nil)
+	mockedAWS.On("ListParametersByTag", mock.Anything, BuildVisibleTag, BuildVisibleTagValue).Return([]string{}, nil)
 	mockedState := emptyState()
 	mockedState.On("ReadEnvFile").Return(&map[string]string{}, nil)
 
@@ -124,6 +137,7 @@ func TestLoadBuildEnvCIVarsFallback(t *testing.T) {
 	mockedAWS := new(MockAWS)
 	appConfigPrefix := fmt.Sprintf("/apppack/apps/%s/config/", appName)
 	mockedAWS.On("GetParametersByPath", appConfigPrefix).Return(map[string]string{}, nil)
+	mockedAWS.On("ListParametersByTag", mock.Anything, BuildVisibleTag, BuildVisibleTagValue).Return([]string{}, nil)
 	mockedState := emptyState()
 	mockedState.On("ReadEnvFile").Return(&map[string]string{}, nil)
 
@@ -160,3 +174,43 @@ func TestGenerateDockerEnvStrings(t *testing.T) {
 		t.Errorf("expected %d elements, got %d", len(expected), len(actual))
 	}
 }
+
+func TestTestHostConfig(t *testing.T) {
+	b := Build{
+		AppPackToml: &AppPackToml{Test: AppPackTomlTest{Memory: "512m", CPUs: 1.5}},
+	}
+	hostConfig, err := b.testHostConfig()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if hostConfig.Memory != 512*1024*1024 {
+		t.Errorf("expected 512MiB memory limit, got %d", hostConfig.Memory)
+	}
+	if hostConfig.NanoCPUs != 1500000000 {
+		t.Errorf("expected 1.5 CPUs, got %d", hostConfig.NanoCPUs)
+	}
+}
+
+func TestHandleTestTimeout(t *testing.T) {
+	containerID := "test-container"
+	mockedContainers := new(MockContainers)
+	mockedContainers.On("ListProcesses", containerID, mock.Anything).Return(nil)
+	mockedContainers.On("KillContainer", containerID).Return(nil)
+	mockedContainers.On("TailLogs", containerID, timeoutLogLines, mock.Anything, mock.Anything).Return(nil)
+	b := Build{
+		containers: mockedContainers,
+		Ctx:        testContext,
+	}
+	logsDone := make(chan error, 1)
+	logsDone <- nil
+	var out bytes.Buffer
+	err := b.handleTestTimeout(containerID, 15*time.Minute, logsDone, &out)
+	var timeoutErr *TestTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected TestTimeoutError, got %v", err)
+	}
+	if !strings.Contains(out.String(), "test timed out after 15m0s") {
+		t.Errorf("expected timeout in test log, got %q", out.String())
+	}
+	mockedContainers.AssertExpectations(t)
+}
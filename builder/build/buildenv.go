@@ -0,0 +1,100 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/apppackio/codebuild-image/builder/aws"
+)
+
+const (
+	// BuildVisibleTag marks an SSM config parameter as passed to the build,
+	// when set to BuildVisibleTagValue
+	BuildVisibleTag      = "apppack:build"
+	BuildVisibleTagValue = "true"
+)
+
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid config key pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// splitBuildConfig decides which config keys are visible to the build. Keys
+// matching the denylist never are. When there is an allowlist, or any key is
+// tagged, only allowlisted or tagged keys are. Otherwise all keys are.
+func splitBuildConfig(config map[string]string, tagged map[string]bool, allowlist, denylist []string) (exposed map[string]string, withheld []string) {
+	filtered := len(allowlist) > 0 || len(tagged) > 0
+	exposed = map[string]string{}
+	withheld = []string{}
+	for k, v := range config {
+		if matchesAny(denylist, k) || (filtered && !tagged[k] && !matchesAny(allowlist, k)) {
+			withheld = append(withheld, k)
+			continue
+		}
+		exposed[k] = v
+	}
+	sort.Strings(withheld)
+	return exposed, withheld
+}
+
+// buildVisibleKeys returns the config keys tagged as visible to the build. A
+// role without permission to read tags is treated as having no tagged keys.
+func (b *Build) buildVisibleKeys() (map[string]bool, error) {
+	keys := map[string]bool{}
+	for _, path := range b.ConfigParameterPaths() {
+		names, err := b.aws.ListParametersByTag(path, BuildVisibleTag, BuildVisibleTagValue)
+		if errors.Is(err, aws.ErrAccessDenied) {
+			b.Log().Warn().Err(err).Msg("cannot read config tags, add ssm:DescribeParameters to use apppack:build tags")
+			return map[string]bool{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			keys[strings.TrimPrefix(name, path)] = true
+		}
+	}
+	return keys, nil
+}
+
+// filterBuildConfig removes the config which isn't visible to the build and
+// logs the keys which are
+func (b *Build) filterBuildConfig(config map[string]string) (map[string]string, error) {
+	var allowlist, denylist []string
+	if b.AppPackToml != nil {
+		allowlist, denylist = b.AppPackToml.Build.EnvAllowlist, b.AppPackToml.Build.EnvDenylist
+	}
+	for _, patterns := range [][]string{allowlist, denylist} {
+		if err := validatePatterns(patterns); err != nil {
+			return nil, err
+		}
+	}
+	tagged, err := b.buildVisibleKeys()
+	if err != nil {
+		return nil, err
+	}
+	exposed, withheld := splitBuildConfig(config, tagged, allowlist, denylist)
+	keys := make([]string, 0, len(exposed))
+	for k := range exposed {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b.Log().Info().Strs("keys", keys).Strs("withheld", withheld).Msg("config exposed to the build")
+	return exposed, nil
+}
@@ -0,0 +1,140 @@
+package build
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/apppackio/codebuild-image/builder/aws"
+)
+
+func TestSplitBuildConfig(t *testing.T) {
+	config := map[string]string{
+		"NODE_ENV":          "production",
+		"NPM_TOKEN":         "npm",
+		"SENTRY_AUTH_TOKEN": "sentry",
+		"DATABASE_URL":      "postgres://",
+		"SECRET_KEY":        "secret",
+	}
+	cases := []struct {
+		name      string
+		tagged    map[string]bool
+		allowlist []string
+		denylist  []string
+		exposed   []string
+	}{
+		{"everything by default", nil, nil, nil, []string{"DATABASE_URL", "NODE_ENV", "NPM_TOKEN", "SECRET_KEY", "SENTRY_AUTH_TOKEN"}},
+		{"denylist", nil, nil, []string{"SECRET_*", "DATABASE_URL"}, []string{"NODE_ENV", "NPM_TOKEN", "SENTRY_AUTH_TOKEN"}},
+		{"allowlist", nil, []string{"NODE_ENV", "*_TOKEN"}, nil, []string{"NODE_ENV", "NPM_TOKEN", "SENTRY_AUTH_TOKEN"}},
+		{"denylist wins", nil, []string{"*_TOKEN"}, []string{"SENTRY_*"}, []string{"NPM_TOKEN"}},
+		{"tagged", map[string]bool{"NODE_ENV": true}, nil, nil, []string{"NODE_ENV"}},
+		{"tagged or allowlisted", map[string]bool{"NODE_ENV": true}, []string{"NPM_TOKEN"}, nil, []string{"NODE_ENV", "NPM_TOKEN"}},
+	}
+	for _, c := range cases {
+		exposed, withheld := splitBuildConfig(config, c.tagged, c.allowlist, c.denylist)
+		keys := []string{}
+		for _, k := range []string{"DATABASE_URL", "NODE_ENV", "NPM_TOKEN", "SECRET_KEY", "SENTRY_AUTH_TOKEN"} {
+			if _, ok := exposed[k]; ok {
+				keys = append(keys, k)
+			}
+		}
+		if !reflect.DeepEqual(keys, c.exposed) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.exposed, keys)
+		}
+		if len(withheld)+len(exposed) != len(config) {
+			t.Errorf("%s: expected every key to be exposed or withheld, got %v", c.name, withheld)
+		}
+	}
+}
+
+func TestLoadBuildEnvFiltersConfig(t *testing.T) {
+	mockedAWS := new(MockAWS)
+	configPrefix := "/apppack/apps/test-app/config/"
+	mockedAWS.On("GetParametersByPath", configPrefix).Return(map[string]string{
+		configPrefix + "NODE_ENV":     "production",
+		configPrefix + "NPM_TOKEN":    "npm-token-value",
+		configPrefix + "DATABASE_URL": "postgres://user:password@db/app",
+	}, nil)
+	mockedAWS.On("ListParametersByTag", configPrefix, BuildVisibleTag, BuildVisibleTagValue).Return([]string{configPrefix + "NPM_TOKEN"}, nil)
+	mockedState := emptyState()
+	mockedState.On("ReadEnvFile").Return(&map[string]string{}, nil)
+	b := Build{
+		Appname:          "test-app",
+		CodebuildBuildId: CodebuildBuildId,
+		AppPackToml:      &AppPackToml{Build: AppPackTomlBuild{EnvAllowlist: []string{"NODE_*"}}},
+		aws:              mockedAWS,
+		state:            mockedState,
+		Ctx:              testContext,
+	}
+	env, err := b.LoadBuildEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if env["NODE_ENV"] != "production" || env["NPM_TOKEN"] != "npm-token-value" || env["CI"] != "true" {
+		t.Errorf("expected allowlisted, tagged and CI vars, got %v", env)
+	}
+	if _, ok := env["DATABASE_URL"]; ok {
+		t.Error("expected DATABASE_URL to be withheld from the build")
+	}
+	// withheld values are still masked in the logs
+	if len(b.redact) != 3 {
+		t.Errorf("expected all config values to be redacted, got %v", b.redact)
+	}
+	env, err = b.LoadRuntimeEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if _, ok := env["DATABASE_URL"]; !ok {
+		t.Error("expected the runtime env to have all config")
+	}
+}
+
+func TestLoadBuildEnvInvalidPattern(t *testing.T) {
+	b := Build{
+		Appname:     "test-app",
+		AppPackToml: &AppPackToml{Build: AppPackTomlBuild{EnvDenylist: []string{"SECRET_["}}},
+		aws:         new(MockAWS),
+		Ctx:         testContext,
+	}
+	if _, err := b.filterBuildConfig(map[string]string{}); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+}
+
+func TestFilterBuildConfigTagsAccessDenied(t *testing.T) {
+	mockedAWS := new(MockAWS)
+	configPrefix := "/apppack/apps/test-app/config/"
+	mockedAWS.On("ListParametersByTag", configPrefix, BuildVisibleTag, BuildVisibleTagValue).Return([]string(nil), fmt.Errorf("%w: DescribeParameters", aws.ErrAccessDenied))
+	b := Build{
+		Appname: "test-app",
+		aws:     mockedAWS,
+		Ctx:     testContext,
+	}
+	config := map[string]string{"NODE_ENV": "production", "DATABASE_URL": "postgres://db/app"}
+	exposed, err := b.filterBuildConfig(config)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if !reflect.DeepEqual(exposed, config) {
+		t.Errorf("expected all config without tags, got %v", exposed)
+	}
+}
+
+func TestFilterBuildConfigKeepsAllowlist(t *testing.T) {
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("ListParametersByTag", "/apppack/apps/test-app/config/", BuildVisibleTag, BuildVisibleTagValue).Return([]string{}, nil)
+	allowlist := make([]string, 1, 2)
+	allowlist[0] = "NODE_*"
+	b := Build{
+		Appname:     "test-app",
+		AppPackToml: &AppPackToml{Build: AppPackTomlBuild{EnvAllowlist: allowlist, EnvDenylist: []string{"*_TOKEN"}}},
+		aws:         mockedAWS,
+		Ctx:         testContext,
+	}
+	if _, err := b.filterBuildConfig(map[string]string{}); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if extended := allowlist[:2]; extended[1] != "" {
+		t.Errorf("expected the allowlist to be left alone, got %v", extended)
+	}
+}
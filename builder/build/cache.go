@@ -0,0 +1,475 @@
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apppackio/codebuild-image/builder/aws"
+	"github.com/apppackio/codebuild-image/builder/tarzst"
+	units "github.com/docker/go-units"
+)
+
+const (
+	// cacheKeyPrefix holds the build caches in the artifact bucket, one per
+	// branch or pull request
+	cacheKeyPrefix = "cache/"
+	// pull request and branch caches are kept apart, so no branch name can
+	// collide with a pull request
+	prCacheNamespace     = "pr/"
+	branchCacheNamespace = "branch/"
+	// legacyCacheExpiredKey marks the cache shared by every build before
+	// caches were scoped as deleted
+	legacyCacheExpiredKey = "cache-legacy-expired"
+	// cacheIndexPrefix holds an object per cache which is rewritten every time
+	// the cache is saved. Unchanged files aren't uploaded again, so the age of
+	// the cache's own objects doesn't say when it was last used.
+	cacheIndexPrefix = "cache-index/"
+	// cacheArchivePrefix holds the archived build caches, named after the
+	// digest of their content
+	cacheArchivePrefix = "cache-archive/"
+	// DefaultCacheMaxAge is how long a branch's cache is kept after its last build
+	DefaultCacheMaxAge = 14 * 24 * time.Hour
+)
+
+// cacheDirectory is CacheDirectory, replaced by tests
+var cacheDirectory = CacheDirectory
+
+// cacheMaxAge parses CACHE_MAX_AGE, zero disables expiry
+func cacheMaxAge() (time.Duration, error) {
+	value := os.Getenv("CACHE_MAX_AGE")
+	if value == "" {
+		return DefaultCacheMaxAge, nil
+	}
+	maxAge, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid CACHE_MAX_AGE %q: %w", value, err)
+	}
+	return maxAge, nil
+}
+
+// branchCacheScope names a branch's cache. The name is escaped rather than
+// sanitized, so branches which differ only in case or punctuation don't share
+// a cache, and a branch can't be a prefix of another's cache.
+func branchCacheScope(branch string) string {
+	return branchCacheNamespace + url.PathEscape(branch)
+}
+
+// cacheScope names the cache of this build's pull request (e.g. `pr/12`) or
+// branch
+func (b *Build) cacheScope() string {
+	if b.PullRequest != "" {
+		return b.PullRequest
+	}
+	branch := b.HeadRef
+	if branch == "" {
+		branch = strings.TrimPrefix(b.Branch, "refs/heads/")
+	}
+	if branch == "" {
+		branch = b.DefaultBranch
+	}
+	if branch == "" {
+		return "default"
+	}
+	return branchCacheScope(branch)
+}
+
+func cacheKey(scope string) string {
+	return cacheKeyPrefix + scope + "/"
+}
+
+func cacheIndexKey(scope string) string {
+	return cacheIndexPrefix + scope + ".json"
+}
+
+func cacheArchiveKey(scope, digest string) string {
+	return cacheArchivePrefix + scope + "/" + digest + ".tar.zst"
+}
+
+// cacheScopes are the caches to restore from, in order of preference. A pull
+// request falls back to the branch it targets, and everything falls back to
+// the default branch.
+func (b *Build) cacheScopes() []string {
+	candidates := []string{b.cacheScope()}
+	if b.PullRequest != "" && b.BaseRef != "" {
+		candidates = append(candidates, branchCacheScope(b.BaseRef))
+	}
+	if b.DefaultBranch != "" {
+		candidates = append(candidates, branchCacheScope(b.DefaultBranch))
+	}
+	scopes := []string{}
+	seen := map[string]bool{}
+	for _, s := range candidates {
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+func (b *Build) cacheKeys() []string {
+	keys := []string{}
+	for _, s := range b.cacheScopes() {
+		keys = append(keys, cacheKey(s))
+	}
+	return keys
+}
+
+// cacheArchived is true when the build cache is stored as a single archive
+// instead of file by file
+func (b *Build) cacheArchived() bool {
+	return b.AppPackToml != nil && b.AppPackToml.Build.Cache == CacheModeArchive
+}
+
+// restoreCache downloads the closest cache there is to the cache directory,
+// reporting which one it was and how long it took
+func (b *Build) restoreCache() (*CacheReport, error) {
+	report := b.newCacheReport()
+	var scope string
+	var err error
+	if b.cacheArchived() {
+		scope, report.Restore, err = b.restoreCacheArchive()
+	} else {
+		scope, report.Restore, err = b.restoreCacheSync()
+	}
+	report.Hit = b.cacheHit(scope)
+	return report, err
+}
+
+// restoreCacheSync downloads the first cache synced file by file, returning its
+// scope
+func (b *Build) restoreCacheSync() (string, *CacheTransfer, error) {
+	start := time.Now()
+	key, stats, err := b.aws.CopyFromS3(b.ArtifactBucket, b.cacheKeys(), cacheDirectory)
+	if err != nil || key == "" {
+		return "", nil, err
+	}
+	transfer := &CacheTransfer{
+		Key:         key,
+		Files:       stats.Files + stats.Unchanged,
+		Bytes:       stats.Bytes + stats.UnchangedBytes,
+		Transferred: stats.Bytes,
+		Unchanged:   stats.Unchanged,
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(key, cacheKeyPrefix), "/"), transfer.finish(start), nil
+}
+
+// cacheIndexEntry is written to the cache index when a cache is saved
+type cacheIndexEntry struct {
+	// Key is the prefix of a cache synced file by file
+	Key     string    `json:"key,omitempty"`
+	Branch  string    `json:"branch,omitempty"`
+	BuildID string    `json:"build_id"`
+	SavedAt time.Time `json:"saved_at"`
+	// Archive is the key of an archived cache
+	Archive string `json:"archive,omitempty"`
+	Digest  string `json:"digest,omitempty"`
+	Files   int    `json:"files,omitempty"`
+	Bytes   int64  `json:"bytes,omitempty"`
+}
+
+func (b *Build) readCacheIndex(scope string) (*cacheIndexEntry, error) {
+	content, err := b.aws.GetObject(b.ArtifactBucket, cacheIndexKey(scope))
+	if err != nil {
+		return nil, err
+	}
+	entry := cacheIndexEntry{}
+	if err = json.Unmarshal(content, &entry); err != nil {
+		return nil, fmt.Errorf("%s: %w", cacheIndexKey(scope), err)
+	}
+	return &entry, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// logCacheTransfer logs the size of a cache archive and how fast it moved
+func (b *Build) logCacheTransfer(msg, key string, stats tarzst.Stats, transferred int64, duration time.Duration) {
+	b.Log().Info().
+		Str("key", key).
+		Int("files", stats.Files).
+		Str("size", units.HumanSize(float64(stats.Bytes))).
+		Str("compressed", units.HumanSize(float64(transferred))).
+		Dur("duration", duration).
+		Str("throughput", units.HumanSize(float64(transferred)/duration.Seconds())+"/s").
+		Msg(msg)
+}
+
+// restoreCacheArchive extracts the archive of the first scope which has one,
+// returning the scope. Caches saved file by file are skipped.
+func (b *Build) restoreCacheArchive() (string, *CacheTransfer, error) {
+	for _, scope := range b.cacheScopes() {
+		entry, err := b.readCacheIndex(scope)
+		if errors.Is(err, aws.ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if entry.Archive == "" {
+			continue
+		}
+		start := time.Now()
+		body, err := b.aws.DownloadStream(b.ArtifactBucket, entry.Archive)
+		// the archive is replaced when the cache is saved again
+		if errors.Is(err, aws.ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		counter := &countingReader{r: body}
+		stats, err := tarzst.Extract(counter, cacheDirectory)
+		body.Close()
+		if err != nil {
+			// a partial cache is worse than none
+			if cleanupErr := removeContents(cacheDirectory); cleanupErr != nil {
+				b.Log().Warn().Err(cleanupErr).Msg("failed to clear partially restored build cache")
+			}
+			return "", nil, fmt.Errorf("%s: %w", entry.Archive, err)
+		}
+		b.logCacheTransfer("restored build cache", entry.Archive, stats, counter.n, time.Since(start))
+		transfer := &CacheTransfer{Key: entry.Archive, Files: stats.Files, Bytes: stats.Bytes, Transferred: counter.n}
+		return scope, transfer.finish(start), nil
+	}
+	b.Log().Info().Strs("scopes", b.cacheScopes()).Msg("no build cache to restore")
+	return "", nil, nil
+}
+
+// removeContents empties a directory without removing it, so it stays
+// usable as a bind mount
+func removeContents(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err = os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveCache saves the cache directory to this build's cache and marks it as
+// used. The transfer is nil when the cache wasn't saved.
+func (b *Build) archiveCache() (*CacheTransfer, error) {
+	fmt.Println("Archiving build cache to S3 ...")
+	scope := b.cacheScope()
+	entry := cacheIndexEntry{
+		Branch:  strings.TrimPrefix(b.Branch, "refs/heads/"),
+		BuildID: b.CodebuildBuildId,
+	}
+	start := time.Now()
+	var transfer *CacheTransfer
+	if b.cacheArchived() {
+		var err error
+		transfer, err = b.saveCacheArchive(scope, &entry)
+		if err != nil || transfer == nil {
+			return nil, err
+		}
+	} else {
+		entry.Key = cacheKey(scope)
+		stats, err := b.aws.SyncToS3(cacheDirectory, b.ArtifactBucket, cacheKey(scope))
+		if err != nil {
+			return nil, err
+		}
+		transfer = &CacheTransfer{
+			Key:         entry.Key,
+			Files:       stats.Files + stats.Unchanged,
+			Bytes:       stats.Bytes + stats.UnchangedBytes,
+			Transferred: stats.Bytes,
+			Unchanged:   stats.Unchanged,
+		}
+	}
+	entry.SavedAt = time.Now().UTC()
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if err = b.aws.PutObject(b.ArtifactBucket, cacheIndexKey(scope), content); err != nil {
+		return nil, err
+	}
+	return transfer.finish(start), nil
+}
+
+// saveCacheArchive uploads the cache directory as a zstd-compressed tar named after
+// the digest of its content. The upload is skipped when the last archive of
+// this scope has the same digest. It returns nil, without an error, when the
+// cache is larger than the configured maximum and isn't saved.
+func (b *Build) saveCacheArchive(scope string, entry *cacheIndexEntry) (*CacheTransfer, error) {
+	maxSize, err := b.AppPackToml.Build.GetCacheMaxSize()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := tarzst.Stat(cacheDirectory)
+	if err != nil {
+		return nil, err
+	}
+	if stats.Bytes > maxSize {
+		b.Log().Warn().
+			Str("size", units.HumanSize(float64(stats.Bytes))).
+			Str("max_size", units.HumanSize(float64(maxSize))).
+			Msg("build cache is larger than cache_max_size and was not saved")
+		return nil, nil
+	}
+	digest, err := tarzst.Digest(cacheDirectory)
+	if err != nil {
+		return nil, err
+	}
+	entry.Archive = cacheArchiveKey(scope, digest)
+	entry.Digest, entry.Files, entry.Bytes = digest, stats.Files, stats.Bytes
+	previous, err := b.readCacheIndex(scope)
+	if err != nil && !errors.Is(err, aws.ErrObjectNotFound) {
+		b.Log().Debug().Err(err).Msg("unable to read the previous build cache")
+	}
+	if previous != nil && previous.Archive == entry.Archive {
+		b.Log().Info().Str("key", entry.Archive).Msg("build cache unchanged, skipping upload")
+		return &CacheTransfer{Key: entry.Archive, Files: stats.Files, Bytes: stats.Bytes, Unchanged: stats.Files}, nil
+	}
+	start := time.Now()
+	reader, writer := io.Pipe()
+	counter := &countingWriter{w: writer}
+	written := make(chan tarzst.Stats, 1)
+	go func() {
+		stats, err := tarzst.Write(counter, cacheDirectory)
+		writer.CloseWithError(err)
+		written <- stats
+	}()
+	err = b.aws.UploadStream(b.ArtifactBucket, entry.Archive, reader)
+	// unblock the writer if the upload stopped reading
+	reader.CloseWithError(err)
+	stats = <-written
+	if err != nil {
+		return nil, err
+	}
+	b.logCacheTransfer("saved build cache", entry.Archive, stats, counter.n, time.Since(start))
+	if previous != nil && previous.Archive != "" {
+		if err = b.aws.DeleteObject(b.ArtifactBucket, previous.Archive); err != nil {
+			b.Log().Warn().Err(err).Str("key", previous.Archive).Msg("failed to delete the previous build cache")
+		}
+	}
+	return &CacheTransfer{Key: entry.Archive, Files: stats.Files, Bytes: stats.Bytes, Transferred: counter.n}, nil
+}
+
+// expireCaches deletes the caches which haven't been saved for longer than
+// CacheMaxAge, and the legacy shared cache. This build's cache and the default
+// branch's are kept.
+func (b *Build) expireCaches() error {
+	if b.CacheMaxAge <= 0 {
+		return nil
+	}
+	var errs []error
+	if err := b.expireLegacyCache(); err != nil {
+		errs = append(errs, fmt.Errorf("legacy cache: %w", err))
+	}
+	index, err := b.aws.ListObjects(b.ArtifactBucket, cacheIndexPrefix)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	keep := map[string]bool{b.cacheScope(): true}
+	if b.DefaultBranch != "" {
+		keep[branchCacheScope(b.DefaultBranch)] = true
+	}
+	now := time.Now()
+	for key, savedAt := range index {
+		scope := strings.TrimSuffix(strings.TrimPrefix(key, cacheIndexPrefix), ".json")
+		if !strings.HasPrefix(scope, prCacheNamespace) && !strings.HasPrefix(scope, branchCacheNamespace) {
+			continue
+		}
+		age := now.Sub(savedAt)
+		if keep[scope] || age <= b.CacheMaxAge {
+			continue
+		}
+		deleted, err := b.aws.DeleteObjectsByPrefix(b.ArtifactBucket, cacheKey(scope))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cache %s: %w", scope, err))
+			continue
+		}
+		archives, err := b.aws.DeleteObjectsByPrefix(b.ArtifactBucket, cacheArchivePrefix+scope+"/")
+		deleted += archives
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cache %s: %w", scope, err))
+			continue
+		}
+		// the index entry goes last, so a failed delete is retried by the next build
+		if err = b.aws.DeleteObject(b.ArtifactBucket, key); err != nil {
+			errs = append(errs, fmt.Errorf("cache %s: %w", scope, err))
+			continue
+		}
+		b.Log().Info().Str("key", cacheKey(scope)).Int("objects", deleted).Dur("age", age).Msg("expired stale build cache")
+	}
+	return errors.Join(errs...)
+}
+
+// isScopedCacheKey is true for the objects of the caches of pull requests,
+// branches and builds without a branch
+func isScopedCacheKey(key string) bool {
+	for _, prefix := range []string{prCacheNamespace, branchCacheNamespace, "default/"} {
+		if strings.HasPrefix(key, cacheKeyPrefix+prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// expireLegacyCache deletes the cache every build shared before caches were
+// scoped by pull request and branch. It is never restored, so it is deleted
+// once, by the first build which expires caches.
+func (b *Build) expireLegacyCache() error {
+	_, err := b.aws.GetObject(b.ArtifactBucket, legacyCacheExpiredKey)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, aws.ErrObjectNotFound) {
+		return err
+	}
+	objects, err := b.aws.ListObjects(b.ArtifactBucket, cacheKeyPrefix)
+	if err != nil {
+		return err
+	}
+	legacy := []string{}
+	for key := range objects {
+		if !isScopedCacheKey(key) {
+			legacy = append(legacy, key)
+		}
+	}
+	sort.Strings(legacy)
+	if len(legacy) > 0 {
+		deleted, err := b.aws.DeleteObjects(b.ArtifactBucket, legacy)
+		if err != nil {
+			return err
+		}
+		b.Log().Info().Str("key", cacheKeyPrefix).Int("objects", deleted).Msg("expired the legacy shared build cache")
+	}
+	return b.aws.PutObject(b.ArtifactBucket, legacyCacheExpiredKey, []byte(time.Now().UTC().Format(time.RFC3339)))
+}
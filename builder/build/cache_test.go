@@ -0,0 +1,267 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apppackio/codebuild-image/builder/aws"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCacheKeys(t *testing.T) {
+	cases := []struct {
+		build    Build
+		expected []string
+	}{
+		{Build{Branch: "main", DefaultBranch: "main"}, []string{"cache/branch/main/"}},
+		{Build{Branch: "refs/heads/feature/Login"}, []string{"cache/branch/feature%2FLogin/"}},
+		// branches which sanitize to the same name keep separate caches
+		{Build{Branch: "Feature"}, []string{"cache/branch/Feature/"}},
+		{Build{Branch: "pr-12"}, []string{"cache/branch/pr-12/"}},
+		{Build{Branch: "PR/12"}, []string{"cache/branch/PR%2F12/"}},
+		{Build{Branch: "feature", DefaultBranch: "main"}, []string{"cache/branch/feature/", "cache/branch/main/"}},
+		{Build{}, []string{"cache/default/"}},
+		{Build{DefaultBranch: "main"}, []string{"cache/branch/main/"}},
+		{
+			Build{PullRequest: "pr/12", HeadRef: "feature", BaseRef: "develop", DefaultBranch: "main"},
+			[]string{"cache/pr/12/", "cache/branch/develop/", "cache/branch/main/"},
+		},
+		{Build{PullRequest: "pr/12", BaseRef: "main", DefaultBranch: "main"}, []string{"cache/pr/12/", "cache/branch/main/"}},
+	}
+	for _, c := range cases {
+		if keys := c.build.cacheKeys(); !reflect.DeepEqual(keys, c.expected) {
+			t.Errorf("expected %v, got %v", c.expected, keys)
+		}
+	}
+}
+
+func TestRestoreCacheFallback(t *testing.T) {
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("CopyFromS3", "artifacts", []string{"cache/pr/3/", "cache/branch/main/"}, CacheDirectory).Return("cache/branch/main/", aws.TransferStats{Files: 2, Bytes: 300, Unchanged: 1, UnchangedBytes: 100}, nil)
+	b := Build{
+		ArtifactBucket: "artifacts",
+		PullRequest:    "pr/3",
+		BaseRef:        "main",
+		aws:            mockedAWS,
+		Ctx:            testContext,
+	}
+	report, err := b.restoreCache()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if report.Restore == nil || report.Restore.Key != "cache/branch/main/" {
+		t.Fatalf("expected the base branch's cache, got %+v", report.Restore)
+	}
+	if report.Hit != CacheHitFallback || report.Scope != "pr/3" || report.Mode != CacheModeSync {
+		t.Errorf("expected a fallback for pr/3, got %+v", report)
+	}
+	if r := report.Restore; r.Files != 3 || r.Bytes != 400 || r.Transferred != 300 || r.Unchanged != 1 {
+		t.Errorf("unexpected restore %+v", r)
+	}
+	mockedAWS.AssertExpectations(t)
+}
+
+func TestArchiveCache(t *testing.T) {
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("SyncToS3", CacheDirectory, "artifacts", "cache/pr/3/").Return(aws.TransferStats{Files: 1, Bytes: 10, Unchanged: 4, UnchangedBytes: 40, Deleted: 2}, nil)
+	mockedAWS.On("PutObject", "artifacts", "cache-index/pr/3.json", mock.MatchedBy(func(body []byte) bool {
+		var entry cacheIndexEntry
+		return json.Unmarshal(body, &entry) == nil && entry.Key == "cache/pr/3/" && entry.BuildID == CodebuildBuildId
+	})).Return(nil)
+	b := Build{
+		ArtifactBucket:   "artifacts",
+		CodebuildBuildId: CodebuildBuildId,
+		PullRequest:      "pr/3",
+		aws:              mockedAWS,
+		Ctx:              testContext,
+	}
+	saved, err := b.archiveCache()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if saved.Files != 5 || saved.Bytes != 50 || saved.Transferred != 10 || saved.Unchanged != 4 {
+		t.Errorf("unexpected save %+v", saved)
+	}
+	mockedAWS.AssertExpectations(t)
+}
+
+func TestExpireCaches(t *testing.T) {
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetObject", "artifacts", "cache-legacy-expired").Return([]byte("2026-07-01T00:00:00Z"), nil)
+	mockedAWS.On("ListObjects", "artifacts", "cache-index/").Return(map[string]time.Time{
+		"cache-index/branch/main.json":    old,
+		"cache-index/branch/feature.json": old,
+		"cache-index/pr/1.json":           old,
+		"cache-index/pr/2.json":           time.Now().Add(-time.Hour),
+		// left over from before caches had namespaces
+		"cache-index/branch.json": old,
+	}, nil)
+	mockedAWS.On("DeleteObjectsByPrefix", "artifacts", "cache/pr/1/").Return(120, nil)
+	mockedAWS.On("DeleteObjectsByPrefix", "artifacts", "cache-archive/pr/1/").Return(0, nil)
+	mockedAWS.On("DeleteObject", "artifacts", "cache-index/pr/1.json").Return(nil)
+	b := Build{
+		ArtifactBucket: "artifacts",
+		Branch:         "feature",
+		DefaultBranch:  "main",
+		CacheMaxAge:    DefaultCacheMaxAge,
+		aws:            mockedAWS,
+		Ctx:            testContext,
+	}
+	// the default branch's and this build's caches are kept however old they
+	// are, and entries outside the namespaces never match a cache
+	if err := b.expireCaches(); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	mockedAWS.AssertExpectations(t)
+	mockedAWS.AssertNumberOfCalls(t, "DeleteObjectsByPrefix", 2)
+}
+
+func TestExpireLegacyCache(t *testing.T) {
+	now := time.Now()
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetObject", "artifacts", "cache-legacy-expired").Return([]byte(nil), fmt.Errorf("%w: cache-legacy-expired", aws.ErrObjectNotFound))
+	mockedAWS.On("ListObjects", "artifacts", "cache/").Return(map[string]time.Time{
+		"cache/layers/node.tgz":           now,
+		"cache/pip/wheel.whl":             now,
+		"cache/pr/1/layers/node.tgz":      now,
+		"cache/branch/main/pip/wheel.whl": now,
+		"cache/default/pip/wheel.whl":     now,
+	}, nil)
+	mockedAWS.On("DeleteObjects", "artifacts", []string{"cache/layers/node.tgz", "cache/pip/wheel.whl"}).Return(2, nil)
+	mockedAWS.On("PutObject", "artifacts", "cache-legacy-expired", mock.Anything).Return(nil)
+	b := Build{ArtifactBucket: "artifacts", aws: mockedAWS, Ctx: testContext}
+	if err := b.expireLegacyCache(); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	mockedAWS.AssertExpectations(t)
+}
+
+func TestExpireCachesDisabled(t *testing.T) {
+	b := Build{ArtifactBucket: "artifacts", aws: new(MockAWS), Ctx: testContext}
+	if err := b.expireCaches(); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+}
+
+// useCacheDirectory points the cache at a temporary directory with a file in it
+func useCacheDirectory(t *testing.T, content string) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "layer.tgz"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	previous := cacheDirectory
+	cacheDirectory = dir
+	t.Cleanup(func() { cacheDirectory = previous })
+	return dir
+}
+
+func TestCacheArchiveRoundTrip(t *testing.T) {
+	useCacheDirectory(t, "node modules")
+	var archive []byte
+	var index []byte
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetObject", "artifacts", "cache-index/branch/main.json").Return([]byte(nil), fmt.Errorf("%w: branch/main.json", aws.ErrObjectNotFound)).Once()
+	mockedAWS.On("UploadStream", "artifacts", mock.MatchedBy(func(key string) bool {
+		return strings.HasPrefix(key, "cache-archive/branch/main/") && strings.HasSuffix(key, ".tar.zst")
+	}), mock.Anything).Run(func(args mock.Arguments) {
+		archive = args.Get(2).([]byte)
+	}).Return(nil).Once()
+	mockedAWS.On("PutObject", "artifacts", "cache-index/branch/main.json", mock.Anything).Run(func(args mock.Arguments) {
+		index = args.Get(2).([]byte)
+	}).Return(nil)
+	b := Build{
+		ArtifactBucket:   "artifacts",
+		CodebuildBuildId: CodebuildBuildId,
+		Branch:           "main",
+		AppPackToml:      &AppPackToml{Build: AppPackTomlBuild{Cache: CacheModeArchive}},
+		aws:              mockedAWS,
+		Ctx:              testContext,
+	}
+	saved, err := b.archiveCache()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if saved.Files != 1 || saved.Transferred != int64(len(archive)) {
+		t.Errorf("unexpected save %+v", saved)
+	}
+	entry := cacheIndexEntry{}
+	if err := json.Unmarshal(index, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Files != 1 || entry.Bytes != 12 || entry.Archive != cacheArchiveKey("branch/main", entry.Digest) {
+		t.Errorf("unexpected index entry %+v", entry)
+	}
+
+	// the same content isn't uploaded again
+	mockedAWS.On("GetObject", "artifacts", "cache-index/branch/main.json").Return(index, nil)
+	if saved, err = b.archiveCache(); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	mockedAWS.AssertNumberOfCalls(t, "UploadStream", 1)
+	if saved.Transferred != 0 || saved.Unchanged != 1 {
+		t.Errorf("expected nothing to be transferred, got %+v", saved)
+	}
+
+	dir := useCacheDirectory(t, "")
+	os.Remove(filepath.Join(dir, "layer.tgz"))
+	mockedAWS.On("DownloadStream", "artifacts", entry.Archive).Return(io.NopCloser(bytes.NewReader(archive)), nil)
+	report, err := b.restoreCache()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if report.Hit != CacheHitExact || report.Restore == nil || report.Restore.Key != entry.Archive {
+		t.Errorf("expected %s to be restored, got %+v", entry.Archive, report)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "layer.tgz")); string(content) != "node modules" {
+		t.Errorf("expected the cache to be restored, got %q", content)
+	}
+}
+
+func TestRestoreCacheArchiveSkipsSyncedCaches(t *testing.T) {
+	useCacheDirectory(t, "")
+	synced, _ := json.Marshal(cacheIndexEntry{Key: "cache/branch/main/"})
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetObject", "artifacts", "cache-index/pr/4.json").Return([]byte(nil), fmt.Errorf("%w: pr/4.json", aws.ErrObjectNotFound))
+	mockedAWS.On("GetObject", "artifacts", "cache-index/branch/main.json").Return(synced, nil)
+	b := Build{
+		ArtifactBucket:   "artifacts",
+		CodebuildBuildId: CodebuildBuildId,
+		PullRequest:      "pr/4",
+		BaseRef:          "main",
+		AppPackToml:      &AppPackToml{Build: AppPackTomlBuild{Cache: CacheModeArchive}},
+		aws:              mockedAWS,
+		Ctx:              testContext,
+	}
+	report, err := b.restoreCache()
+	if err != nil || report.Hit != CacheMiss || report.Restore != nil {
+		t.Errorf("expected a miss, got %+v, %v", report, err)
+	}
+	mockedAWS.AssertExpectations(t)
+}
+
+func TestSaveCacheArchiveTooLarge(t *testing.T) {
+	useCacheDirectory(t, "more than a kilobyte "+strings.Repeat("x", 1024))
+	mockedAWS := new(MockAWS)
+	b := Build{
+		ArtifactBucket:   "artifacts",
+		CodebuildBuildId: CodebuildBuildId,
+		Branch:           "main",
+		AppPackToml:      &AppPackToml{Build: AppPackTomlBuild{Cache: CacheModeArchive, CacheMaxSize: "1k"}},
+		aws:              mockedAWS,
+		Ctx:              testContext,
+	}
+	// nothing is uploaded or recorded in the index
+	if saved, err := b.archiveCache(); err != nil || saved != nil {
+		t.Errorf("expected nothing to be saved, got %+v, %v", saved, err)
+	}
+	mockedAWS.AssertExpectations(t)
+}
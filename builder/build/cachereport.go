@@ -0,0 +1,186 @@
+package build
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+)
+
+const (
+	// CacheReportFilename is the build artifact describing how the build cache was used
+	CacheReportFilename = "cache-report.json"
+	// cacheRestoreFilename passes the restore half of the report from prebuild to build
+	cacheRestoreFilename = "cache-restore.json"
+
+	// CacheHitExact is a restore of this build's own cache
+	CacheHitExact = "exact"
+	// CacheHitFallback is a restore of the base or default branch's cache
+	CacheHitFallback = "fallback"
+	// CacheMiss is a build which started without a cache
+	CacheMiss = "miss"
+)
+
+// CacheTransfer is a restore or save of the build cache
+type CacheTransfer struct {
+	Key   string `json:"key,omitempty"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+	// Transferred is what went over the network, compressed for archived caches
+	Transferred int64 `json:"transferred"`
+	// Unchanged files were already up to date and weren't transferred
+	Unchanged int     `json:"unchanged,omitempty"`
+	Seconds   float64 `json:"seconds"`
+}
+
+func (t *CacheTransfer) finish(start time.Time) *CacheTransfer {
+	t.Seconds = time.Since(start).Seconds()
+	return t
+}
+
+// CacheReuse is how many of the build's cacheable steps or layers came from the cache
+type CacheReuse struct {
+	Tool   string  `json:"tool"`
+	Reused int     `json:"reused"`
+	Total  int     `json:"total"`
+	Ratio  float64 `json:"ratio"`
+}
+
+func newCacheReuse(tool string, reused, total int) *CacheReuse {
+	reuse := CacheReuse{Tool: tool, Reused: reused, Total: total}
+	if total > 0 {
+		reuse.Ratio = float64(reused) / float64(total)
+	}
+	return &reuse
+}
+
+// CacheReport is written to CacheReportFilename at the end of the build
+type CacheReport struct {
+	Mode    string         `json:"mode"`
+	Scope   string         `json:"scope"`
+	Hit     string         `json:"hit,omitempty"`
+	Restore *CacheTransfer `json:"restore,omitempty"`
+	Reuse   *CacheReuse    `json:"reuse,omitempty"`
+	Save    *CacheTransfer `json:"save,omitempty"`
+}
+
+func (b *Build) newCacheReport() *CacheReport {
+	mode := CacheModeSync
+	if b.cacheArchived() {
+		mode = CacheModeArchive
+	}
+	return &CacheReport{Mode: mode, Scope: b.cacheScope()}
+}
+
+// cacheHit says whether the restored scope was this build's own, or one it
+// fell back to
+func (b *Build) cacheHit(restored string) string {
+	switch restored {
+	case "":
+		return CacheMiss
+	case b.cacheScope():
+		return CacheHitExact
+	default:
+		return CacheHitFallback
+	}
+}
+
+// writeCacheRestore saves the restore report for the build phase
+func (b *Build) writeCacheRestore(report *CacheReport) error {
+	return b.state.WriteJsonToFile(filepath.Join(os.TempDir(), cacheRestoreFilename), report)
+}
+
+// readCacheRestore loads the report started in prebuild. A new one is returned
+// if prebuild didn't write one.
+func (b *Build) readCacheRestore() *CacheReport {
+	report := CacheReport{}
+	if err := b.state.ReadJsonFile(filepath.Join(os.TempDir(), cacheRestoreFilename), &report); err != nil {
+		b.Log().Debug().Err(err).Msg("cannot read cache restore report")
+		return b.newCacheReport()
+	}
+	return &report
+}
+
+// logCacheReport summarises the report in a single log line
+func (b *Build) logCacheReport(report *CacheReport) {
+	event := b.Log().Info().Str("mode", report.Mode).Str("scope", report.Scope).Str("hit", report.Hit)
+	if t := report.Restore; t != nil {
+		event = event.Int("restored_files", t.Files).
+			Str("restored_size", units.HumanSize(float64(t.Bytes))).
+			Float64("restore_seconds", t.Seconds)
+	}
+	if r := report.Reuse; r != nil {
+		event = event.Int("reused", r.Reused).Int("cacheable", r.Total).Float64("reuse_ratio", r.Ratio)
+	}
+	if t := report.Save; t != nil {
+		event = event.Int("saved_files", t.Files).
+			Str("saved_size", units.HumanSize(float64(t.Bytes))).
+			Float64("save_seconds", t.Seconds)
+	}
+	event.Msg("build cache summary")
+}
+
+var (
+	// a buildx step which could have been cached, e.g. "#7 [builder 3/6] RUN npm ci"
+	buildxStepRegexp   = regexp.MustCompile(`^(#\d+) \[(?:[^\]]+ )?\d+/\d+\] `)
+	buildxCachedRegexp = regexp.MustCompile(`^(#\d+) CACHED\s*$`)
+)
+
+// parseBuildxReuse counts the Dockerfile steps in plain buildx progress output,
+// and how many of them were cached
+func parseBuildxReuse(r io.Reader) (*CacheReuse, error) {
+	steps := map[string]bool{}
+	cached := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := buildxStepRegexp.FindStringSubmatch(line); m != nil {
+			steps[m[1]] = true
+		} else if m := buildxCachedRegexp.FindStringSubmatch(line); m != nil {
+			cached[m[1]] = true
+		}
+	}
+	reused := 0
+	for step := range steps {
+		if cached[step] {
+			reused++
+		}
+	}
+	return newCacheReuse("buildx", reused, len(steps)), scanner.Err()
+}
+
+// parsePackReuse counts the cache layers the lifecycle exporter reused or had
+// to add
+func parsePackReuse(r io.Reader) (*CacheReuse, error) {
+	reused, added := 0, 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "Reusing cache layer '") {
+			reused++
+		} else if strings.Contains(line, "Adding cache layer '") {
+			added++
+		}
+	}
+	return newCacheReuse("pack", reused, reused+added), scanner.Err()
+}
+
+// cacheReuse reads the build log to find how much of the cache was used
+func (b *Build) cacheReuse(logFilename string) (*CacheReuse, error) {
+	f, err := os.Open(logFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if b.System() == DockerBuildSystemKeyword {
+		return parseBuildxReuse(f)
+	}
+	return parsePackReuse(f)
+}
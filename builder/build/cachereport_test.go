@@ -0,0 +1,91 @@
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+const buildxLog = `#1 [internal] load build definition from Dockerfile
+#1 transferring dockerfile: 412B done
+#1 DONE 0.0s
+#4 [base 1/4] FROM docker.io/library/node:20-slim@sha256:abc
+#4 CACHED
+#5 [base 2/4] WORKDIR /app
+#5 CACHED
+#6 [internal] load build context
+#6 DONE 0.1s
+#7 [base 3/4] RUN npm ci
+#7 CACHED
+#8 [4/4] COPY . .
+#8 DONE 0.4s
+#9 exporting to image
+#9 DONE 1.2s
+`
+
+const packLog = `===> RESTORING
+Restoring data for "heroku/nodejs-engine:dist" from cache
+===> EXPORTING
+Reusing layer 'heroku/nodejs-engine:dist'
+2024/05/01 12:00:00.000000 Reusing cache layer 'heroku/nodejs-engine:dist'
+Reusing cache layer 'heroku/nodejs-npm:toolbox'
+Adding cache layer 'heroku/nodejs-npm:npm_cache'
+`
+
+func TestParseBuildxReuse(t *testing.T) {
+	reuse, err := parseBuildxReuse(strings.NewReader(buildxLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reuse.Tool != "buildx" || reuse.Reused != 3 || reuse.Total != 4 || reuse.Ratio != 0.75 {
+		t.Errorf("expected 3 of 4 steps cached, got %+v", reuse)
+	}
+}
+
+func TestParsePackReuse(t *testing.T) {
+	reuse, err := parsePackReuse(strings.NewReader(packLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reuse.Tool != "pack" || reuse.Reused != 2 || reuse.Total != 3 {
+		t.Errorf("expected 2 of 3 cache layers reused, got %+v", reuse)
+	}
+	if reuse, _ = parsePackReuse(strings.NewReader("")); reuse.Ratio != 0 {
+		t.Errorf("expected no ratio without cache layers, got %+v", reuse)
+	}
+}
+
+func TestCacheReuseFromLog(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "build.log")
+	if err := os.WriteFile(logFile, []byte(buildxLog), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b := Build{AppPackToml: &AppPackToml{Build: AppPackTomlBuild{System: DockerBuildSystemKeyword}}}
+	reuse, err := b.cacheReuse(logFile)
+	if err != nil || reuse.Tool != "buildx" {
+		t.Errorf("expected the buildx log to be parsed, got %+v, %v", reuse, err)
+	}
+}
+
+func TestCacheHit(t *testing.T) {
+	b := Build{PullRequest: "pr/7", BaseRef: "main"}
+	for restored, expected := range map[string]string{"pr/7": CacheHitExact, "branch/main": CacheHitFallback, "": CacheMiss} {
+		if hit := b.cacheHit(restored); hit != expected {
+			t.Errorf("expected %s for %q, got %s", expected, restored, hit)
+		}
+	}
+}
+
+func TestReadCacheRestoreMissing(t *testing.T) {
+	mockedState := new(MockFilesystem)
+	mockedState.On("ReadJsonFile", filepath.Join(os.TempDir(), cacheRestoreFilename), mock.Anything).Return(os.ErrNotExist)
+	b := Build{Branch: "main", state: mockedState, Ctx: testContext}
+	report := b.readCacheRestore()
+	if report.Scope != "branch/main" || report.Mode != CacheModeSync || report.Hit != "" {
+		t.Errorf("expected an empty report for main, got %+v", report)
+	}
+	mockedState.AssertExpectations(t)
+}
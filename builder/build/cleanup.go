@@ -0,0 +1,162 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/apppackio/codebuild-image/builder/containers"
+	"github.com/docker/docker/api/types/container"
+	units "github.com/docker/go-units"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultGCThreshold is CodeBuild's maximum build timeout, so no resource
+// older than it can belong to a build which is still running
+const DefaultGCThreshold = 8 * time.Hour
+
+// resourceLabels are set on the Docker resources created for this build
+func (b *Build) resourceLabels() map[string]string {
+	labels := map[string]string{containers.BuildIDLabel: b.CodebuildBuildId}
+	if !b.StartedAt.IsZero() {
+		labels[containers.CreatedAtLabel] = b.StartedAt.UTC().Format(time.RFC3339)
+	}
+	return labels
+}
+
+// labeled adds the build's resource labels to a container config
+func (b *Build) labeled(config *container.Config) *container.Config {
+	if config.Labels == nil {
+		config.Labels = map[string]string{}
+	}
+	for k, v := range b.resourceLabels() {
+		config.Labels[k] = v
+	}
+	return config
+}
+
+// Teardown removes every container and network created for this build.
+// The Docker daemon is reused across builds, so anything left behind
+// accumulates until the host is recycled.
+func (b *Build) Teardown() error {
+	if b.containers == nil || b.CodebuildBuildId == "" {
+		return nil
+	}
+	labels := map[string]string{containers.BuildIDLabel: b.CodebuildBuildId}
+	var errs []error
+	ctainers, err := b.containers.ListContainers(labels)
+	if err != nil {
+		return err
+	}
+	for _, c := range ctainers {
+		b.Log().Debug().Str("container", c.Name).Msg("removing build container")
+		if err := b.containers.DeleteContainer(c.ID); err != nil {
+			errs = append(errs, fmt.Errorf("container %s: %w", c.Name, err))
+		}
+	}
+	// networks can only be removed once their containers are gone
+	networks, err := b.containers.ListNetworks(labels)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	for _, n := range networks {
+		b.Log().Debug().Str("network", n.Name).Msg("removing build network")
+		if err := b.containers.DeleteNetwork(n.ID); err != nil {
+			errs = append(errs, fmt.Errorf("network %s: %w", n.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resourceAge uses the created-at label when present, falling back to the
+// creation time reported by Docker
+func resourceAge(r containers.Resource, now time.Time) time.Duration {
+	created := r.Created
+	if v, ok := r.Labels[containers.CreatedAtLabel]; ok {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			created = t
+		}
+	}
+	return now.Sub(created)
+}
+
+// isStale is true for resources from other builds which are older than the threshold
+func isStale(r containers.Resource, currentBuildID string, olderThan time.Duration, now time.Time) bool {
+	if currentBuildID != "" && r.Labels[containers.BuildIDLabel] == currentBuildID {
+		return false
+	}
+	return resourceAge(r, now) > olderThan
+}
+
+// GarbageCollect removes containers, networks and dangling images left on the
+// reused Docker daemon by builds which ended more than olderThan ago, and
+// stopped buildx builders other than the selected one. Resources belonging to
+// currentBuildID are never removed.
+func GarbageCollect(ctx context.Context, c containers.ContainersI, currentBuildID string, olderThan time.Duration) error {
+	logger := log.Ctx(ctx)
+	now := time.Now()
+	var errs []error
+	labels := map[string]string{containers.BuildIDLabel: ""}
+	ctainers, err := c.ListContainers(labels)
+	if err != nil {
+		return err
+	}
+	for _, r := range ctainers {
+		if !isStale(r, currentBuildID, olderThan, now) {
+			continue
+		}
+		logger.Info().Str("container", r.Name).Str("build", r.Labels[containers.BuildIDLabel]).Msg("removing orphaned container")
+		if err := c.DeleteContainer(r.ID); err != nil {
+			errs = append(errs, fmt.Errorf("container %s: %w", r.Name, err))
+		}
+	}
+	// builders outlive the build which created them, because later builds
+	// reuse the selected one. Only stopped builders are idle.
+	selected, err := c.SelectedBuildxBuilder()
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	builders, err := c.ListBuildxBuilders()
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	for _, r := range builders {
+		if r.Name == selected || r.Running || (currentBuildID != "" && r.Labels[containers.BuildIDLabel] == currentBuildID) {
+			continue
+		}
+		logger.Info().Str("container", r.Name).Str("build", r.Labels[containers.BuildIDLabel]).Msg("removing idle buildx builder")
+		if err := c.DeleteContainer(r.ID); err != nil {
+			errs = append(errs, fmt.Errorf("buildx builder %s: %w", r.Name, err))
+			continue
+		}
+		if err := c.DeleteVolume(r.Name + "_state"); err != nil {
+			logger.Debug().Err(err).Str("volume", r.Name+"_state").Msg("unable to remove buildx builder state")
+		}
+	}
+	networks, err := c.ListNetworks(labels)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	for _, r := range networks {
+		if !isStale(r, currentBuildID, olderThan, now) {
+			continue
+		}
+		logger.Info().Str("network", r.Name).Msg("removing orphaned network")
+		if err := c.DeleteNetwork(r.ID); err != nil {
+			errs = append(errs, fmt.Errorf("network %s: %w", r.Name, err))
+		}
+	}
+	reclaimed, err := c.PruneDanglingImages(olderThan)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("pruning images: %w", err))
+	} else if reclaimed > 0 {
+		logger.Info().Str("reclaimed", units.HumanSize(float64(reclaimed))).Msg("removed dangling images")
+	}
+	return errors.Join(errs...)
+}
+
+// GarbageCollect cleans up after previous builds on the reused Docker daemon
+func (b *Build) GarbageCollect() error {
+	return GarbageCollect(b.Ctx, b.containers, b.CodebuildBuildId, DefaultGCThreshold)
+}
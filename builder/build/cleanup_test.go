@@ -0,0 +1,96 @@
+package build
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/apppackio/codebuild-image/builder/containers"
+)
+
+func TestTeardown(t *testing.T) {
+	mockedContainers := new(MockContainers)
+	mockedContainers.On("ListContainers", buildLabels).Return([]containers.Resource{
+		{ID: "abc", Name: CodebuildBuildId + "-db"},
+		{ID: "def", Name: CodebuildBuildId + "-redis"},
+	}, nil)
+	mockedContainers.On("DeleteContainer", "abc").Return(nil)
+	mockedContainers.On("DeleteContainer", "def").Return(fmt.Errorf("removal in progress"))
+	mockedContainers.On("ListNetworks", buildLabels).Return([]containers.Resource{{ID: "net", Name: CodebuildBuildId}}, nil)
+	mockedContainers.On("DeleteNetwork", "net").Return(nil)
+	b := Build{
+		CodebuildBuildId: CodebuildBuildId,
+		containers:       mockedContainers,
+		Ctx:              testContext,
+	}
+	err := b.Teardown()
+	if err == nil {
+		t.Error("expected error for the container which couldn't be removed")
+	}
+	// the network is still removed after a container fails
+	mockedContainers.AssertExpectations(t)
+}
+
+func TestTeardownNoContainers(t *testing.T) {
+	b := Build{CodebuildBuildId: CodebuildBuildId, Ctx: testContext}
+	if err := b.Teardown(); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+}
+
+func TestGarbageCollect(t *testing.T) {
+	old := time.Now().Add(-10 * time.Hour)
+	recent := time.Now().Add(-time.Hour)
+	anyBuild := map[string]string{containers.BuildIDLabel: ""}
+	mockedContainers := new(MockContainers)
+	mockedContainers.On("ListContainers", anyBuild).Return([]containers.Resource{
+		// stale container from another build
+		{ID: "stale", Name: "old-build-db", Labels: map[string]string{
+			containers.BuildIDLabel:   "old-build",
+			containers.CreatedAtLabel: old.UTC().Format(time.RFC3339),
+		}},
+		// in-flight build
+		{ID: "recent", Name: "other-build-db", Labels: map[string]string{containers.BuildIDLabel: "other-build"}, Created: recent},
+		// current build is never removed, regardless of age
+		{ID: "current", Name: CodebuildBuildId + "-db", Labels: buildLabels, Created: old},
+	}, nil)
+	mockedContainers.On("DeleteContainer", "stale").Return(nil)
+	mockedContainers.On("SelectedBuildxBuilder").Return("buildx_buildkit_reused-build0", nil)
+	mockedContainers.On("ListBuildxBuilders").Return([]containers.Resource{
+		{ID: "idle-builder", Name: "buildx_buildkit_old-build0", Labels: map[string]string{containers.BuildIDLabel: "old-build"}, Created: recent},
+		// builders in use are kept however old they are
+		{ID: "reused-builder", Name: "buildx_buildkit_reused-build0", Labels: map[string]string{containers.BuildIDLabel: "reused-build"}, Created: old},
+		{ID: "running-builder", Name: "buildx_buildkit_other-build0", Labels: map[string]string{containers.BuildIDLabel: "other-build"}, Created: old, Running: true},
+		{ID: "current-builder", Name: "buildx_buildkit_current0", Labels: buildLabels, Created: old},
+	}, nil)
+	mockedContainers.On("DeleteContainer", "idle-builder").Return(nil)
+	mockedContainers.On("DeleteVolume", "buildx_buildkit_old-build0_state").Return(nil)
+	mockedContainers.On("ListNetworks", anyBuild).Return([]containers.Resource{
+		{ID: "old-net", Name: "old-build", Labels: map[string]string{containers.BuildIDLabel: "old-build"}, Created: old},
+	}, nil)
+	mockedContainers.On("DeleteNetwork", "old-net").Return(nil)
+	mockedContainers.On("PruneDanglingImages", DefaultGCThreshold).Return(uint64(1024), nil)
+
+	err := GarbageCollect(testContext, mockedContainers, CodebuildBuildId, DefaultGCThreshold)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	mockedContainers.AssertExpectations(t)
+	mockedContainers.AssertNotCalled(t, "DeleteContainer", "recent")
+	mockedContainers.AssertNotCalled(t, "DeleteContainer", "current")
+	mockedContainers.AssertNotCalled(t, "DeleteContainer", "current-builder")
+	mockedContainers.AssertNotCalled(t, "DeleteContainer", "reused-builder")
+	mockedContainers.AssertNotCalled(t, "DeleteContainer", "running-builder")
+}
+
+func TestResourceLabelsCreatedAt(t *testing.T) {
+	started := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+	b := Build{CodebuildBuildId: CodebuildBuildId, StartedAt: started}
+	labels := b.resourceLabels()
+	if labels[containers.CreatedAtLabel] != "2026-07-01T12:00:00Z" {
+		t.Errorf("expected created-at label, got %v", labels)
+	}
+	if age := resourceAge(containers.Resource{Labels: labels}, started.Add(time.Hour)); age != time.Hour {
+		t.Errorf("expected age of 1h, got %s", age)
+	}
+}
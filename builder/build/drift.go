@@ -0,0 +1,162 @@
+package build
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/apppackio/codebuild-image/builder/aws"
+)
+
+// ConfigFingerprint maps each config key to a hash of its value, so config
+// changes can be detected without storing the values
+type ConfigFingerprint map[string]string
+
+// fingerprintConfig hashes each value and its key with an HMAC keyed by the
+// app's fingerprint secret. Without the secret, which is only in SSM, short
+// values can't be guessed from the fingerprints in the artifact bucket. Hashes
+// are shortened to 64 bits, plenty to detect a change.
+func fingerprintConfig(secret []byte, config map[string]string) ConfigFingerprint {
+	fingerprint := ConfigFingerprint{}
+	for k, v := range config {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(k + "\x00" + v))
+		fingerprint[k] = hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	return fingerprint
+}
+
+// fingerprintSecretParameter holds the app's fingerprint secret, outside its
+// config path so it is never passed to the app
+func (b *Build) fingerprintSecretParameter() string {
+	if b.Pipeline {
+		return fmt.Sprintf("/apppack/pipelines/%s/config-fingerprint-secret", b.Appname)
+	}
+	return fmt.Sprintf("/apppack/apps/%s/config-fingerprint-secret", b.Appname)
+}
+
+// fingerprintSecret reads the app's fingerprint secret, creating it on the
+// first build
+func (b *Build) fingerprintSecret() ([]byte, error) {
+	name := b.fingerprintSecretParameter()
+	secret, err := b.aws.GetParameter(name)
+	if err == nil {
+		return []byte(secret), nil
+	}
+	if !errors.Is(err, aws.ErrParameterNotFound) {
+		return nil, err
+	}
+	random := make([]byte, 32)
+	if _, err = rand.Read(random); err != nil {
+		return nil, err
+	}
+	secret = hex.EncodeToString(random)
+	if err = b.aws.SetParameter(name, secret); err != nil {
+		return nil, err
+	}
+	return []byte(secret), nil
+}
+
+// ConfigDrift lists the config keys which changed between two fingerprints
+type ConfigDrift struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+func (d ConfigDrift) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Diff returns the changes from the previous fingerprint to this one
+func (f ConfigFingerprint) Diff(previous ConfigFingerprint) ConfigDrift {
+	drift := ConfigDrift{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	for k, hash := range f {
+		previousHash, ok := previous[k]
+		if !ok {
+			drift.Added = append(drift.Added, k)
+		} else if previousHash != hash {
+			drift.Changed = append(drift.Changed, k)
+		}
+	}
+	for k := range previous {
+		if _, ok := f[k]; !ok {
+			drift.Removed = append(drift.Removed, k)
+		}
+	}
+	sort.Strings(drift.Added)
+	sort.Strings(drift.Removed)
+	sort.Strings(drift.Changed)
+	return drift
+}
+
+// configFingerprintKey is where the fingerprint of the last successful build
+// is stored in the artifact bucket, one per review app or branch
+func (b *Build) configFingerprintKey() string {
+	scope := strings.TrimPrefix(b.Branch, "refs/heads/")
+	if b.Pipeline && b.reviewAppID() != "" {
+		scope = b.reviewAppID()
+	}
+	if scope == "" {
+		scope = "default"
+	}
+	return "config-fingerprints/" + scope + ".json"
+}
+
+// ConfigDrift compares the config loaded for this build with the config of
+// the last successful build
+func (b *Build) ConfigDrift() (*ConfigDrift, error) {
+	content, err := b.aws.GetObject(b.ArtifactBucket, b.configFingerprintKey())
+	if err != nil {
+		return nil, err
+	}
+	var previous ConfigFingerprint
+	if err = json.Unmarshal(content, &previous); err != nil {
+		return nil, err
+	}
+	drift := b.configFingerprint.Diff(previous)
+	return &drift, nil
+}
+
+// reportConfigDrift logs the config keys which changed since the last successful build
+func (b *Build) reportConfigDrift() {
+	if b.ArtifactBucket == "" || b.configFingerprint == nil {
+		return
+	}
+	drift, err := b.ConfigDrift()
+	if errors.Is(err, aws.ErrObjectNotFound) {
+		b.Log().Debug().Msg("no config fingerprint from a previous build")
+		return
+	}
+	if err != nil {
+		b.Log().Warn().Err(err).Msg("failed to compare config with the last successful build")
+		return
+	}
+	if drift.Empty() {
+		b.Log().Info().Msg("config unchanged since the last successful build")
+		return
+	}
+	b.Log().Info().
+		Strs("added", drift.Added).
+		Strs("removed", drift.Removed).
+		Strs("changed", drift.Changed).
+		Msg("config changed since the last successful build")
+}
+
+// saveConfigFingerprint stores the fingerprint of the config for the next build
+func (b *Build) saveConfigFingerprint() error {
+	if b.ArtifactBucket == "" || b.configFingerprint == nil {
+		return nil
+	}
+	content, err := json.Marshal(b.configFingerprint)
+	if err != nil {
+		return err
+	}
+	return b.aws.PutObject(b.ArtifactBucket, b.configFingerprintKey(), content)
+}
@@ -0,0 +1,167 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/apppackio/codebuild-image/builder/aws"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestFingerprintConfig(t *testing.T) {
+	config := map[string]string{"SECRET_KEY": "hunter2", "OTHER_KEY": "hunter2"}
+	fingerprint := fingerprintConfig([]byte("secret"), config)
+	if len(fingerprint) != 2 || len(fingerprint["SECRET_KEY"]) != 16 {
+		t.Errorf("expected a 16 character hash per key, got %v", fingerprint)
+	}
+	if fingerprint["SECRET_KEY"] == fingerprint["OTHER_KEY"] {
+		t.Error("expected equal values under different keys to hash differently")
+	}
+	if !reflect.DeepEqual(fingerprint, fingerprintConfig([]byte("secret"), config)) {
+		t.Error("expected the fingerprint to be stable")
+	}
+	if reflect.DeepEqual(fingerprint, fingerprintConfig([]byte("other-secret"), config)) {
+		t.Error("expected the fingerprint to differ between secrets")
+	}
+	content, _ := json.Marshal(fingerprint)
+	if strings.Contains(string(content), "hunter2") {
+		t.Error("expected the fingerprint not to contain values")
+	}
+}
+
+func TestFingerprintSecret(t *testing.T) {
+	name := "/apppack/apps/test-app/config-fingerprint-secret"
+	var created string
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetParameter", name).Return("", fmt.Errorf("%w: %s", aws.ErrParameterNotFound, name)).Once()
+	mockedAWS.On("SetParameter", name, mock.MatchedBy(func(value string) bool { return len(value) == 64 })).Run(func(args mock.Arguments) {
+		created = args.String(1)
+	}).Return(nil)
+	b := Build{Appname: "test-app", aws: mockedAWS, Ctx: testContext}
+	secret, err := b.fingerprintSecret()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if string(secret) != created {
+		t.Errorf("expected the created secret, got %q", secret)
+	}
+	// later builds reuse it
+	mockedAWS.On("GetParameter", name).Return(created, nil)
+	if again, err := b.fingerprintSecret(); err != nil || string(again) != created {
+		t.Errorf("expected the same secret, got %q, %v", again, err)
+	}
+	mockedAWS.AssertNumberOfCalls(t, "SetParameter", 1)
+}
+
+func TestFingerprintSecretPipeline(t *testing.T) {
+	b := Build{Appname: "test-app", Pipeline: true}
+	if name := b.fingerprintSecretParameter(); name != "/apppack/pipelines/test-app/config-fingerprint-secret" {
+		t.Errorf("unexpected parameter %s", name)
+	}
+}
+
+func TestLoadConfigFingerprintSecretUnreadable(t *testing.T) {
+	configPrefix := "/apppack/apps/test-app/config/"
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetParametersByPath", configPrefix).Return(map[string]string{configPrefix + "A": "1"}, nil)
+	mockedAWS.On("GetParameter", "/apppack/apps/test-app/config-fingerprint-secret").Return("", fmt.Errorf("AccessDeniedException"))
+	b := Build{Appname: "test-app", ArtifactBucket: "artifacts", aws: mockedAWS, Ctx: testContext}
+	// the build goes on without a drift report
+	if _, err := b.loadConfig(); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if b.configFingerprint != nil {
+		t.Errorf("expected no fingerprint, got %v", b.configFingerprint)
+	}
+}
+
+func TestConfigFingerprintDiff(t *testing.T) {
+	previous := fingerprintConfig([]byte("secret"), map[string]string{"A": "1", "B": "2", "C": "3"})
+	current := fingerprintConfig([]byte("secret"), map[string]string{"A": "1", "B": "changed", "D": "4"})
+	drift := current.Diff(previous)
+	expected := ConfigDrift{Added: []string{"D"}, Removed: []string{"C"}, Changed: []string{"B"}}
+	if !reflect.DeepEqual(drift, expected) {
+		t.Errorf("expected %+v, got %+v", expected, drift)
+	}
+	if !current.Diff(current).Empty() {
+		t.Error("expected no drift from the same config")
+	}
+}
+
+func TestConfigFingerprintKey(t *testing.T) {
+	cases := []struct {
+		build    Build
+		expected string
+	}{
+		{Build{Branch: "main"}, "config-fingerprints/main.json"},
+		{Build{Branch: "refs/heads/feature/login"}, "config-fingerprints/feature/login.json"},
+		{Build{}, "config-fingerprints/default.json"},
+		{Build{Pipeline: true, Branch: "feature", PullRequest: "pr/12"}, "config-fingerprints/pr/12.json"},
+	}
+	for _, c := range cases {
+		if key := c.build.configFingerprintKey(); key != c.expected {
+			t.Errorf("expected %s, got %s", c.expected, key)
+		}
+	}
+}
+
+func TestConfigDrift(t *testing.T) {
+	previous, _ := json.Marshal(fingerprintConfig([]byte("secret"), map[string]string{"A": "1", "B": "2"}))
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetObject", "artifacts", "config-fingerprints/main.json").Return(previous, nil)
+	b := Build{
+		Appname:           "test-app",
+		ArtifactBucket:    "artifacts",
+		Branch:            "main",
+		configFingerprint: fingerprintConfig([]byte("secret"), map[string]string{"A": "1", "B": "3"}),
+		aws:               mockedAWS,
+		Ctx:               testContext,
+	}
+	drift, err := b.ConfigDrift()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if !reflect.DeepEqual(drift.Changed, []string{"B"}) || len(drift.Added) != 0 || len(drift.Removed) != 0 {
+		t.Errorf("expected B to be changed, got %+v", drift)
+	}
+}
+
+func TestReportConfigDriftFirstBuild(t *testing.T) {
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetObject", "artifacts", "config-fingerprints/main.json").Return([]byte(nil), fmt.Errorf("%w: main.json", aws.ErrObjectNotFound))
+	b := Build{
+		Appname:           "test-app",
+		ArtifactBucket:    "artifacts",
+		Branch:            "main",
+		configFingerprint: ConfigFingerprint{},
+		aws:               mockedAWS,
+		Ctx:               testContext,
+	}
+	// a missing fingerprint is expected on the first build
+	b.reportConfigDrift()
+	mockedAWS.AssertExpectations(t)
+}
+
+func TestSaveConfigFingerprint(t *testing.T) {
+	fingerprint := fingerprintConfig([]byte("secret"), map[string]string{"A": "1"})
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("PutObject", "artifacts", "config-fingerprints/main.json", mock.MatchedBy(func(body []byte) bool {
+		var saved ConfigFingerprint
+		return json.Unmarshal(body, &saved) == nil && reflect.DeepEqual(saved, fingerprint)
+	})).Return(nil)
+	b := Build{
+		Appname:           "test-app",
+		ArtifactBucket:    "artifacts",
+		Branch:            "main",
+		configFingerprint: fingerprint,
+		aws:               mockedAWS,
+		Ctx:               testContext,
+	}
+	if err := b.saveConfigFingerprint(); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+	mockedAWS.AssertExpectations(t)
+}
@@ -0,0 +1,165 @@
+package build
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// TestReportFilename is the merged JUnit report archived for CodeBuild report groups
+const TestReportFilename = "junit.xml"
+
+type JUnitResult struct {
+	Message string `xml:"message,attr,omitempty"`
+	Type    string `xml:"type,attr,omitempty"`
+	Body    string `xml:",chardata"`
+}
+
+type JUnitTestCase struct {
+	Name      string       `xml:"name,attr"`
+	Classname string       `xml:"classname,attr,omitempty"`
+	Time      string       `xml:"time,attr,omitempty"`
+	Failure   *JUnitResult `xml:"failure,omitempty"`
+	Error     *JUnitResult `xml:"error,omitempty"`
+	Skipped   *JUnitResult `xml:"skipped,omitempty"`
+	SystemOut string       `xml:"system-out,omitempty"`
+	SystemErr string       `xml:"system-err,omitempty"`
+}
+
+type JUnitTestSuite struct {
+	XMLName   xml.Name         `xml:"testsuite"`
+	Name      string           `xml:"name,attr"`
+	Tests     int              `xml:"tests,attr"`
+	Failures  int              `xml:"failures,attr"`
+	Errors    int              `xml:"errors,attr"`
+	Skipped   int              `xml:"skipped,attr"`
+	Time      string           `xml:"time,attr,omitempty"`
+	Timestamp string           `xml:"timestamp,attr,omitempty"`
+	TestCases []JUnitTestCase  `xml:"testcase"`
+	Suites    []JUnitTestSuite `xml:"testsuite"`
+	SystemOut string           `xml:"system-out,omitempty"`
+	SystemErr string           `xml:"system-err,omitempty"`
+}
+
+type JUnitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr,omitempty"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Suites   []JUnitTestSuite `xml:"testsuite"`
+}
+
+// TestSummary counts test cases by result. Failed counts failed assertions and
+// Errors counts tests which errored before they could fail.
+type TestSummary struct {
+	Passed  int
+	Failed  int
+	Errors  int
+	Skipped int
+}
+
+func (s TestSummary) String() string {
+	if s.Errors > 0 {
+		return fmt.Sprintf("%d passed, %d failed, %d errored, %d skipped", s.Passed, s.Failed, s.Errors, s.Skipped)
+	}
+	return fmt.Sprintf("%d passed, %d failed, %d skipped", s.Passed, s.Failed, s.Skipped)
+}
+
+func (s *TestSummary) add(other TestSummary) {
+	s.Passed += other.Passed
+	s.Failed += other.Failed
+	s.Errors += other.Errors
+	s.Skipped += other.Skipped
+}
+
+// summarize counts the test cases in the suite and any nested suites
+func (s *JUnitTestSuite) summarize() TestSummary {
+	summary := TestSummary{}
+	for _, tc := range s.TestCases {
+		switch {
+		case tc.Error != nil:
+			summary.Errors++
+		case tc.Failure != nil:
+			summary.Failed++
+		case tc.Skipped != nil:
+			summary.Skipped++
+		default:
+			summary.Passed++
+		}
+	}
+	for i := range s.Suites {
+		summary.add(s.Suites[i].summarize())
+	}
+	return summary
+}
+
+// ParseJUnitReport parses a JUnit XML document whose root is either
+// <testsuites> or a single <testsuite>
+func ParseJUnitReport(content []byte) ([]JUnitTestSuite, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no testsuites or testsuite element found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "testsuites":
+			var suites JUnitTestSuites
+			if err := decoder.DecodeElement(&suites, &start); err != nil {
+				return nil, err
+			}
+			return suites.Suites, nil
+		case "testsuite":
+			var suite JUnitTestSuite
+			if err := decoder.DecodeElement(&suite, &start); err != nil {
+				return nil, err
+			}
+			return []JUnitTestSuite{suite}, nil
+		default:
+			return nil, fmt.Errorf("unexpected root element <%s>", start.Name.Local)
+		}
+	}
+}
+
+// MergeJUnitReports combines the JUnit documents (keyed by filename) into a single
+// <testsuites> document with the totals recalculated from the test cases
+func MergeJUnitReports(reports map[string][]byte) (*JUnitTestSuites, error) {
+	filenames := make([]string, 0, len(reports))
+	for filename := range reports {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	merged := JUnitTestSuites{}
+	for _, filename := range filenames {
+		suites, err := ParseJUnitReport(reports[filename])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		merged.Suites = append(merged.Suites, suites...)
+	}
+	summary := merged.Summary()
+	merged.Tests = summary.Passed + summary.Failed + summary.Errors + summary.Skipped
+	merged.Failures = summary.Failed
+	merged.Errors = summary.Errors
+	merged.Skipped = summary.Skipped
+	return &merged, nil
+}
+
+func (s *JUnitTestSuites) Summary() TestSummary {
+	summary := TestSummary{}
+	for i := range s.Suites {
+		summary.add(s.Suites[i].summarize())
+	}
+	return summary
+}
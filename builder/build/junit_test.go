@@ -0,0 +1,102 @@
+package build
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+const junitSuites = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="models" tests="3">
+    <testcase name="test_create" classname="models"/>
+    <testcase name="test_update" classname="models">
+      <failure message="assert 1 == 2">Traceback</failure>
+    </testcase>
+    <testcase name="test_delete" classname="models">
+      <skipped/>
+    </testcase>
+  </testsuite>
+</testsuites>`
+
+const junitSuite = `<testsuite name="views" tests="2">
+  <testcase name="test_index" classname="views"/>
+  <testcase name="test_detail" classname="views">
+    <error message="boom"/>
+  </testcase>
+</testsuite>`
+
+func TestParseJUnitReport(t *testing.T) {
+	suites, err := ParseJUnitReport([]byte(junitSuites))
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if len(suites) != 1 || len(suites[0].TestCases) != 3 {
+		t.Errorf("expected 1 suite with 3 test cases, got %v", suites)
+	}
+	suites, err = ParseJUnitReport([]byte(junitSuite))
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if len(suites) != 1 || suites[0].Name != "views" {
+		t.Errorf("expected views suite, got %v", suites)
+	}
+}
+
+func TestParseJUnitReportInvalid(t *testing.T) {
+	for _, content := range []string{"", "<html></html>", "<testsuite"} {
+		if _, err := ParseJUnitReport([]byte(content)); err == nil {
+			t.Errorf("expected error for %q", content)
+		}
+	}
+}
+
+func TestMergeJUnitReports(t *testing.T) {
+	merged, err := MergeJUnitReports(map[string][]byte{
+		"/workspace/test-results/b.xml": []byte(junitSuite),
+		"/workspace/test-results/a.xml": []byte(junitSuites),
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if len(merged.Suites) != 2 || merged.Suites[0].Name != "models" {
+		t.Errorf("expected suites ordered by filename, got %v", merged.Suites)
+	}
+	expected := TestSummary{Passed: 2, Failed: 1, Errors: 1, Skipped: 1}
+	if merged.Summary() != expected {
+		t.Errorf("expected %s, got %s", expected, merged.Summary())
+	}
+	// the <error> in views is an error, not a failure, as it is in the suite's own counts
+	if merged.Tests != 5 || merged.Failures != 1 || merged.Errors != 1 || merged.Skipped != 1 {
+		t.Errorf("expected totals 5/1/1/1, got %d/%d/%d/%d", merged.Tests, merged.Failures, merged.Errors, merged.Skipped)
+	}
+	if s := merged.Summary().String(); s != "2 passed, 1 failed, 1 errored, 1 skipped" {
+		t.Errorf("unexpected summary %q", s)
+	}
+}
+
+func TestCollectTestReports(t *testing.T) {
+	mockedContainers := new(MockContainers)
+	mockedContainers.On("GetContainerFiles", "test-container", "test-results/*.xml").Return(
+		map[string][]byte{"/workspace/test-results/a.xml": []byte(junitSuites)}, nil,
+	)
+	mockedState := new(MockFilesystem)
+	mockedState.On("WriteXmlToFile", TestReportFilename, mock.AnythingOfType("*build.JUnitTestSuites")).Return(nil)
+	b := Build{
+		AppPackToml: &AppPackToml{Test: AppPackTomlTest{Reports: []string{"test-results/*.xml"}}},
+		containers:  mockedContainers,
+		state:       mockedState,
+		Ctx:         testContext,
+	}
+	var out bytes.Buffer
+	if err := b.collectTestReports("test-container", &out); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if !strings.Contains(out.String(), "1 passed, 1 failed, 1 skipped") {
+		t.Errorf("expected summary in test log, got %q", out.String())
+	}
+	mockedContainers.AssertExpectations(t)
+	mockedState.AssertExpectations(t)
+}
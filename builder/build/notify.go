@@ -0,0 +1,235 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+)
+
+// Commit status contexts, shown as separate checks on the pull request
+const (
+	BuildStatusContext = "apppack/build"
+	TestStatusContext  = "apppack/test"
+)
+
+// Commit states, mapped to each provider's own names
+const (
+	StatePending = "pending"
+	StateSuccess = "success"
+	StateFailure = "failure"
+)
+
+// maxStatusDescription is GitHub's limit on the length of a status description
+const maxStatusDescription = 140
+
+// notifierTimeout bounds each request so an unresponsive provider can't hold up the build
+const notifierTimeout = 10 * time.Second
+
+// CommitStatus is posted to the source provider for the commit being built
+type CommitStatus struct {
+	Context     string
+	State       string
+	Description string
+	TargetURL   string
+}
+
+// Notifier posts commit statuses to GitHub, GitLab or Bitbucket
+type Notifier struct {
+	Provider string
+	// BaseURL is the provider's API root, overridable for self-hosted providers and tests
+	BaseURL string
+	// Repository is the `owner/name` path of the repository
+	Repository string
+	Commit     string
+	Token      string
+	Client     *http.Client
+}
+
+var defaultAPIURLs = map[string]string{
+	GitHubProvider:    "https://api.github.com",
+	GitLabProvider:    "https://gitlab.com/api/v4",
+	BitbucketProvider: "https://api.bitbucket.org/2.0",
+}
+
+var repositoryPathRegex = regexp.MustCompile(`^/?(.+?)(\.git)?/?$`)
+
+// repositoryPath extracts `owner/name` from a clone URL
+func repositoryPath(repoURL string) (string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", err
+	}
+	m := repositoryPathRegex.FindStringSubmatch(u.Path)
+	if m == nil {
+		return "", fmt.Errorf("no repository in %s", repoURL)
+	}
+	return m[1], nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+// request builds the provider's API request for a commit status
+func (n *Notifier) request(ctx context.Context, status CommitStatus) (*http.Request, error) {
+	baseURL := n.BaseURL
+	if baseURL == "" {
+		baseURL = defaultAPIURLs[n.Provider]
+	}
+	var endpoint string
+	var body map[string]string
+	switch n.Provider {
+	case GitHubProvider:
+		endpoint = fmt.Sprintf("%s/repos/%s/statuses/%s", baseURL, n.Repository, n.Commit)
+		body = map[string]string{
+			"context":     status.Context,
+			"state":       status.State,
+			"description": status.Description,
+			"target_url":  status.TargetURL,
+		}
+	case GitLabProvider:
+		state := status.State
+		if state == StateFailure {
+			state = "failed"
+		}
+		endpoint = fmt.Sprintf("%s/projects/%s/statuses/%s", baseURL, url.PathEscape(n.Repository), n.Commit)
+		body = map[string]string{
+			"name":        status.Context,
+			"state":       state,
+			"description": status.Description,
+			"target_url":  status.TargetURL,
+		}
+	case BitbucketProvider:
+		state := map[string]string{StatePending: "INPROGRESS", StateSuccess: "SUCCESSFUL", StateFailure: "FAILED"}[status.State]
+		endpoint = fmt.Sprintf("%s/repositories/%s/commit/%s/statuses/build", baseURL, n.Repository, n.Commit)
+		body = map[string]string{
+			"key":         status.Context,
+			"state":       state,
+			"description": status.Description,
+			"url":         status.TargetURL,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported provider %s", n.Provider)
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.Provider == GitLabProvider {
+		req.Header.Set("PRIVATE-TOKEN", n.Token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	return req, nil
+}
+
+// Post sends the commit status to the provider
+func (n *Notifier) Post(ctx context.Context, status CommitStatus) error {
+	status.Description = truncate(status.Description, maxStatusDescription)
+	ctx, cancel := context.WithTimeout(ctx, notifierTimeout)
+	defer cancel()
+	req, err := n.request(ctx, status)
+	if err != nil {
+		return err
+	}
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s commit status returned %s: %s", n.Provider, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// statusNotifier sets up the notifier when STATUS_TOKEN_PARAMETER names the
+// SSM parameter holding the provider's API token. It returns nil when commit
+// statuses aren't enabled.
+func (b *Build) statusNotifier() (*Notifier, error) {
+	if b.notifier != nil {
+		return b.notifier, nil
+	}
+	parameter := os.Getenv("STATUS_TOKEN_PARAMETER")
+	if parameter == "" {
+		return nil, nil
+	}
+	repo, err := repositoryPath(os.Getenv("CODEBUILD_SOURCE_REPO_URL"))
+	if err != nil {
+		return nil, err
+	}
+	token, err := b.aws.GetParameter(parameter)
+	if err != nil {
+		return nil, err
+	}
+	b.notifier = &Notifier{
+		Provider:   b.SourceProvider,
+		BaseURL:    os.Getenv("STATUS_API_URL"),
+		Repository: repo,
+		Commit:     os.Getenv("CODEBUILD_RESOLVED_SOURCE_VERSION"),
+		Token:      token,
+	}
+	return b.notifier, nil
+}
+
+// notify posts a commit status for the build. Failures are only logged since
+// the status is informational.
+func (b *Build) notify(statusContext, state, description string) {
+	notifier, err := b.statusNotifier()
+	if err != nil {
+		b.Log().Warn().Err(err).Msg("unable to set up commit status notifications")
+		return
+	}
+	if notifier == nil {
+		return
+	}
+	err = notifier.Post(b.Ctx, CommitStatus{
+		Context:     statusContext,
+		State:       state,
+		Description: description,
+		TargetURL:   os.Getenv("CODEBUILD_BUILD_URL"),
+	})
+	if err != nil {
+		b.Log().Warn().Err(err).Str("context", statusContext).Msg("failed to post commit status")
+	}
+}
+
+// notifyResult posts the outcome of a phase. A failed build also fails the
+// test status, since the tests won't run.
+func (b *Build) notifyResult(statusContext, phase string, err error) {
+	if err != nil {
+		b.notify(statusContext, StateFailure, fmt.Sprintf("%s failed: %s", phase, err))
+		if statusContext == BuildStatusContext {
+			b.notify(TestStatusContext, StateFailure, "Not run because the build failed")
+		}
+		return
+	}
+	description := fmt.Sprintf("%s succeeded", phase)
+	if statusContext == TestStatusContext && b.noTests {
+		// tests which never ran didn't pass
+		description = "No tests defined"
+	} else if statusContext == TestStatusContext && b.testSummary != nil {
+		description = fmt.Sprintf("%s: %s", description, b.testSummary)
+	}
+	b.notify(statusContext, StateSuccess, description)
+}
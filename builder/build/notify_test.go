@@ -0,0 +1,143 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type postedStatus struct {
+	Path   string
+	Header http.Header
+	Body   map[string]string
+}
+
+func statusServer(t *testing.T, code int) (*httptest.Server, *[]postedStatus) {
+	posted := []postedStatus{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("invalid status body: %s", err)
+		}
+		posted = append(posted, postedStatus{Path: r.URL.EscapedPath(), Header: r.Header, Body: body})
+		w.WriteHeader(code)
+		fmt.Fprint(w, `{"message": "ok"}`)
+	}))
+	t.Cleanup(server.Close)
+	return server, &posted
+}
+
+func TestNotifierProviders(t *testing.T) {
+	for _, test := range []struct {
+		provider string
+		path     string
+		header   string
+		state    string
+	}{
+		{GitHubProvider, "/repos/apppackio/example/statuses/abc123", "Authorization", "failure"},
+		{GitLabProvider, "/projects/apppackio%2Fexample/statuses/abc123", "Private-Token", "failed"},
+		{BitbucketProvider, "/repositories/apppackio/example/commit/abc123/statuses/build", "Authorization", "FAILED"},
+	} {
+		server, posted := statusServer(t, http.StatusCreated)
+		n := Notifier{
+			Provider:   test.provider,
+			BaseURL:    server.URL,
+			Repository: "apppackio/example",
+			Commit:     "abc123",
+			Token:      "secret",
+			Client:     server.Client(),
+		}
+		err := n.Post(testContext, CommitStatus{Context: TestStatusContext, State: StateFailure, Description: "Tests failed", TargetURL: "https://codebuild"})
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %s", test.provider, err)
+		}
+		if len(*posted) != 1 {
+			t.Fatalf("%s: expected 1 status, got %d", test.provider, len(*posted))
+		}
+		p := (*posted)[0]
+		if p.Path != test.path {
+			t.Errorf("%s: expected path %s, got %s", test.provider, test.path, p.Path)
+		}
+		if !strings.Contains(p.Header.Get(test.header), "secret") {
+			t.Errorf("%s: expected token in %s header", test.provider, test.header)
+		}
+		if p.Body["state"] != test.state {
+			t.Errorf("%s: expected state %s, got %s", test.provider, test.state, p.Body["state"])
+		}
+	}
+}
+
+func TestNotifierError(t *testing.T) {
+	server, _ := statusServer(t, http.StatusUnauthorized)
+	n := Notifier{Provider: GitHubProvider, BaseURL: server.URL, Repository: "apppackio/example", Commit: "abc123", Client: server.Client()}
+	err := n.Post(testContext, CommitStatus{Context: BuildStatusContext, State: StatePending})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected 401 error, got %v", err)
+	}
+}
+
+func TestNotifyResult(t *testing.T) {
+	server, posted := statusServer(t, http.StatusCreated)
+	b := Build{
+		Ctx: testContext,
+		notifier: &Notifier{
+			Provider:   GitHubProvider,
+			BaseURL:    server.URL,
+			Repository: "apppackio/example",
+			Commit:     "abc123",
+			Client:     server.Client(),
+		},
+	}
+	b.notifyResult(BuildStatusContext, "Build", fmt.Errorf("pack exited with code 1: %s", strings.Repeat("x", 200)))
+	if len(*posted) != 2 {
+		t.Fatalf("expected build and test statuses, got %v", *posted)
+	}
+	if desc := (*posted)[0].Body["description"]; len(desc) != maxStatusDescription || !strings.HasPrefix(desc, "Build failed: pack exited") {
+		t.Errorf("expected truncated failure description, got %q", desc)
+	}
+	if (*posted)[1].Body["context"] != TestStatusContext || (*posted)[1].Body["state"] != StateFailure {
+		t.Errorf("expected tests to be failed with the build, got %v", (*posted)[1].Body)
+	}
+	b.testSummary = &TestSummary{Passed: 3, Skipped: 1}
+	b.notifyResult(TestStatusContext, "Tests", nil)
+	if desc := (*posted)[2].Body["description"]; desc != "Tests succeeded: 3 passed, 0 failed, 1 skipped" {
+		t.Errorf("expected test summary in description, got %q", desc)
+	}
+	b.testSummary = nil
+	b.noTests = true
+	b.notifyResult(TestStatusContext, "Tests", nil)
+	if desc := (*posted)[3].Body["description"]; desc != "No tests defined" {
+		t.Errorf("expected tests which didn't run not to be reported as passing, got %q", desc)
+	}
+}
+
+func TestNotifyDisabled(t *testing.T) {
+	server, posted := statusServer(t, http.StatusCreated)
+	t.Setenv("STATUS_TOKEN_PARAMETER", "")
+	t.Setenv("STATUS_API_URL", server.URL)
+	t.Setenv("CODEBUILD_SOURCE_REPO_URL", "https://github.com/apppackio/example.git")
+	mockedAWS := new(MockAWS)
+	b := Build{aws: mockedAWS, Ctx: testContext}
+	b.notify(BuildStatusContext, StatePending, "Build started")
+	if len(*posted) != 0 {
+		t.Errorf("expected no status to be posted, got %v", *posted)
+	}
+	mockedAWS.AssertNotCalled(t, "GetParameter", mock.Anything)
+}
+
+func TestRepositoryPath(t *testing.T) {
+	for url, expected := range map[string]string{
+		"https://github.com/apppackio/example.git":     "apppackio/example",
+		"https://gitlab.com/group/subgroup/example":    "group/subgroup/example",
+		"https://bitbucket.org/apppackio/example.git/": "apppackio/example",
+	} {
+		if actual, err := repositoryPath(url); err != nil || actual != expected {
+			t.Errorf("expected %s for %s, got %s (%v)", expected, url, actual, err)
+		}
+	}
+}
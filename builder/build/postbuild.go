@@ -1,16 +1,33 @@
 package build
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/apppackio/codebuild-image/builder/containers"
+	"github.com/apppackio/codebuild-image/builder/redact"
 	"github.com/docker/docker/api/types/container"
 )
 
+// timeoutLogLines is the number of lines of output shown when the test times out
+const timeoutLogLines = 50
+
 type envLoader func() map[string]string
 
+// TestTimeoutError is returned when the test container runs longer than `[test] timeout`
+type TestTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *TestTimeoutError) Error() string {
+	return fmt.Sprintf("test timed out after %s", e.Timeout)
+}
+
 // LoadTestEnv uses the environment defined in app.json
 // with overrides for any in-dyno services
 func (b *Build) LoadTestEnv(e envLoader) (map[string]string, error) {
@@ -34,24 +51,79 @@ func generateDockerEnvStrings(env map[string]string) []string {
 	return envStrings
 }
 
-// testLogWriters returns a writer that writes to stdout/err and a file
-func testLogWriters(file *os.File) (io.Writer, io.Writer) {
-	return io.MultiWriter(os.Stdout, file), io.MultiWriter(os.Stderr, file)
+// testLogWriters returns a writer that writes to stdout/err and a file,
+// masking the redacted values
+func testLogWriters(file *os.File, values []string) (*redact.Writer, *redact.Writer) {
+	return redact.NewWriter(io.MultiWriter(os.Stdout, file), values), redact.NewWriter(io.MultiWriter(os.Stderr, file), values)
 }
 
-func (b *Build) RunPostbuild() error {
+// collectTestReports copies the JUnit reports matching `[test] reports` out of
+// the test container, merges them into a single report for CodeBuild, and
+// writes a summary to the test log
+func (b *Build) collectTestReports(containerID string, writer io.Writer) error {
+	if b.AppPackToml == nil || len(b.AppPackToml.Test.Reports) == 0 {
+		return nil
+	}
+	reports := map[string][]byte{}
+	for _, pattern := range b.AppPackToml.Test.Reports {
+		files, err := b.containers.GetContainerFiles(containerID, pattern)
+		if err != nil {
+			return err
+		}
+		for name, content := range files {
+			reports[name] = content
+		}
+	}
+	if len(reports) == 0 {
+		_, err := writer.Write([]byte("no test reports found\n"))
+		return err
+	}
+	merged, err := MergeJUnitReports(reports)
+	if err != nil {
+		return err
+	}
+	if err = b.state.WriteXmlToFile(TestReportFilename, merged); err != nil {
+		return err
+	}
+	summary := merged.Summary()
+	b.testSummary = &summary
+	_, err = writer.Write([]byte(fmt.Sprintf("test reports (%d files): %s\n", len(reports), merged.Summary())))
+	return err
+}
+
+func (b *Build) RunPostbuild() (err error) {
+	// addons, services and the build network aren't needed once the tests are done
+	defer func() {
+		if err := b.Teardown(); err != nil {
+			b.Log().Warn().Err(err).Msg("failed to remove build containers and networks")
+		}
+	}()
+	// only config the tests passed with becomes the baseline for the drift report
+	defer func() {
+		if err != nil {
+			return
+		}
+		if err := b.saveConfigFingerprint(); err != nil {
+			b.Log().Warn().Err(err).Msg("failed to save config fingerprint")
+		}
+	}()
 	skipBuild, _ := b.state.ShouldSkipBuild(b.CodebuildBuildId)
 	if skipBuild {
 		b.Log().Info().Msg("skipping test")
 		return nil
 	}
+	defer func() { b.notifyResult(TestStatusContext, "Tests", err) }()
 	logFileName := "test.log"
 	testLogFile, err := os.CreateTemp("", logFileName)
 	if err != nil {
 		return err
 	}
 	defer b.state.EndLogging(testLogFile, logFileName)
-	writer, errWriter := testLogWriters(testLogFile)
+	// config isn't passed to the tests, but can leak into the output from the image
+	if _, err = b.loadConfig(); err != nil {
+		return err
+	}
+	writer, errWriter := testLogWriters(testLogFile, b.redact)
 
 	var testEnvLoader envLoader
 	testScript := b.AppPackToml.Test.Command
@@ -62,8 +134,17 @@ func (b *Build) RunPostbuild() error {
 		testEnvLoader = b.AppPackToml.GetTestEnv
 	}
 	PrintStartMarker("test")
-	defer PrintEndMarker("test")
+	defer func() {
+		// output held back by the writers belongs before the end marker
+		for _, w := range []*redact.Writer{writer, errWriter} {
+			if flushErr := w.Flush(); err == nil {
+				err = flushErr
+			}
+		}
+		PrintEndMarker("test")
+	}()
 	if testScript == "" {
+		b.noTests = true
 		_, err := writer.Write([]byte("no tests defined in app.json or apppack.toml\n"))
 		return err
 	}
@@ -86,25 +167,48 @@ func (b *Build) RunPostbuild() error {
 	if b.System() == BuildpackBuildSystemKeyword {
 		entrypoint = []string{"/cnb/lifecycle/launcher"}
 	}
-	err = b.containers.RunContainer(containerID, b.CodebuildBuildId, nil, &container.Config{
+	// tests often connect to addons at startup, so make sure they're accepting connections
+	if err = b.WaitForAddons(writer); err != nil {
+		return err
+	}
+	hostConfig, err := b.testHostConfig()
+	if err != nil {
+		return err
+	}
+	timeout, err := b.AppPackToml.Test.GetTimeout()
+	if err != nil {
+		return err
+	}
+	err = b.containers.RunContainer(containerID, b.CodebuildBuildId, nil, b.labeled(&container.Config{
 		Image:      imageName,
 		Cmd:        []string{"/bin/sh", "-c", testScript},
 		Entrypoint: entrypoint,
 		Env:        envStrings,
-	})
+	}), hostConfig)
 	if err != nil {
 		return err
 	}
 	defer b.containers.DeleteContainer(containerID)
-	err = b.containers.AttachLogs(containerID, writer, errWriter)
+	// stream logs in the background so a hung test can't block past the timeout
+	logsDone := make(chan error, 1)
+	go func() {
+		logsDone <- b.containers.AttachLogs(containerID, writer, errWriter)
+	}()
+	// wait for container to finish
+	exitCode, err := b.containers.WaitForExit(containerID, timeout)
+	if errors.Is(err, containers.ErrWaitTimeout) {
+		return b.handleTestTimeout(containerID, timeout, logsDone, errWriter)
+	}
 	if err != nil {
 		return err
 	}
-	// wait for container to finish
-	exitCode, err := b.containers.WaitForExit(containerID)
-	if err != nil {
+	if err = <-logsDone; err != nil {
 		return err
 	}
+	// reports must be copied out before the container is deleted
+	if err = b.collectTestReports(containerID, writer); err != nil {
+		b.Log().Warn().Err(err).Msg("failed to collect test reports")
+	}
 	if exitCode != 0 {
 		_, err := errWriter.Write([]byte(fmt.Sprintf("test script failed with exit code %d\n", exitCode)))
 		if err != nil {
@@ -114,3 +218,41 @@ func (b *Build) RunPostbuild() error {
 	}
 	return nil
 }
+
+// testHostConfig applies the `[test]` resource limits to the test container
+func (b *Build) testHostConfig() (*container.HostConfig, error) {
+	memory, err := b.AppPackToml.Test.GetMemory()
+	if err != nil {
+		return nil, err
+	}
+	return &container.HostConfig{
+		Resources: container.Resources{
+			Memory:   memory,
+			NanoCPUs: int64(b.AppPackToml.Test.CPUs * 1e9),
+		},
+	}, nil
+}
+
+// handleTestTimeout dumps diagnostics for a test container which exceeded
+// `[test] timeout`, then kills it
+func (b *Build) handleTestTimeout(containerID string, timeout time.Duration, logsDone chan error, errWriter io.Writer) error {
+	b.Log().Error().Dur("timeout", timeout).Msg("test timed out")
+	// the process list is only available while the container is running
+	processes := &bytes.Buffer{}
+	if err := b.containers.ListProcesses(containerID, processes); err != nil {
+		b.Log().Warn().Err(err).Msg("failed to list test container processes")
+	}
+	if err := b.containers.KillContainer(containerID); err != nil {
+		b.Log().Warn().Err(err).Msg("failed to kill test container")
+	}
+	// killing the container ends the log stream
+	<-logsDone
+	timeoutErr := &TestTimeoutError{Timeout: timeout}
+	fmt.Fprintf(errWriter, "\n!!! %s !!!\n", timeoutErr)
+	fmt.Fprintf(errWriter, "--- last %d lines of test output ---\n", timeoutLogLines)
+	if err := b.containers.TailLogs(containerID, timeoutLogLines, errWriter, errWriter); err != nil {
+		b.Log().Warn().Err(err).Msg("failed to read test container logs")
+	}
+	fmt.Fprintf(errWriter, "--- processes running at timeout ---\n%s", processes.String())
+	return timeoutErr
+}
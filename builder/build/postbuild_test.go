@@ -0,0 +1,115 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/apppackio/codebuild-image/builder/containers"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRunPostbuildNoTestsSavesConfigFingerprint(t *testing.T) {
+	mockedAWS := new(MockAWS)
+	configPrefix := "/apppack/apps/test-app/config/"
+	mockedAWS.On("GetParametersByPath", configPrefix).Return(map[string]string{configPrefix + "A": "1"}, nil)
+	mockedAWS.On("GetParameter", "/apppack/apps/test-app/config-fingerprint-secret").Return("secret", nil)
+	mockedAWS.On("PutObject", "artifacts", "config-fingerprints/main.json", mock.Anything).Return(nil)
+	mockedState := emptyState()
+	mockedState.On("ShouldSkipBuild", CodebuildBuildId).Return(false, nil)
+	mockedState.On("EndLogging", mock.Anything, "test.log").Return(nil)
+	b := Build{
+		Appname:          "test-app",
+		ArtifactBucket:   "artifacts",
+		Branch:           "main",
+		CodebuildBuildId: CodebuildBuildId,
+		AppPackToml:      &AppPackToml{},
+		AppJSON:          &AppJSON{},
+		aws:              mockedAWS,
+		state:            mockedState,
+		Ctx:              testContext,
+	}
+	if err := b.RunPostbuild(); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	mockedAWS.AssertExpectations(t)
+}
+
+func TestRunPostbuildFailureKeepsConfigFingerprint(t *testing.T) {
+	mockedAWS := new(MockAWS)
+	configPrefix := "/apppack/apps/test-app/config/"
+	mockedAWS.On("GetParametersByPath", configPrefix).Return(map[string]string{configPrefix + "A": "1"}, nil)
+	mockedAWS.On("GetParameter", "/apppack/apps/test-app/config-fingerprint-secret").Return("secret", nil)
+	mockedState := emptyState()
+	mockedState.On("ShouldSkipBuild", CodebuildBuildId).Return(false, nil)
+	mockedState.On("EndLogging", mock.Anything, "test.log").Return(nil)
+	mockedState.On("GitSha").Return("", errors.New("not a git repository"))
+	b := Build{
+		Appname:          "test-app",
+		ArtifactBucket:   "artifacts",
+		Branch:           "main",
+		CodebuildBuildId: CodebuildBuildId,
+		AppPackToml:      &AppPackToml{Test: AppPackTomlTest{Command: "pytest"}},
+		AppJSON:          &AppJSON{},
+		aws:              mockedAWS,
+		state:            mockedState,
+		Ctx:              testContext,
+	}
+	if err := b.RunPostbuild(); err == nil {
+		t.Fatal("expected an error")
+	}
+	mockedAWS.AssertNotCalled(t, "PutObject", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestRunPostbuildFlushesBeforeEndMarker(t *testing.T) {
+	containerID := strings.ReplaceAll(CodebuildBuildId, ":", "-")
+	mockedAWS := new(MockAWS)
+	configPrefix := "/apppack/apps/test-app/config/"
+	mockedAWS.On("GetParametersByPath", configPrefix).Return(map[string]string{configPrefix + "DATABASE_URL": "postgres://review-db"}, nil)
+	mockedState := emptyState()
+	mockedState.On("ShouldSkipBuild", CodebuildBuildId).Return(false, nil)
+	mockedState.On("EndLogging", mock.Anything, "test.log").Return(nil)
+	mockedState.On("GitSha").Return("abc123", nil)
+	mockedState.On("ReadEnvFile").Return(&map[string]string{}, nil)
+	mockedContainers := new(MockContainers)
+	mockedContainers.On("RunContainer", containerID, CodebuildBuildId, []string(nil), mock.Anything, mock.Anything).Return(nil)
+	// the end of the output could be the start of a config value, so it is held back
+	mockedContainers.On("AttachLogs", containerID, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		fmt.Fprint(args.Get(1).(io.Writer), "connecting to postgres://rev")
+	}).Return(nil)
+	mockedContainers.On("WaitForExit", containerID, mock.Anything).Return(0, nil)
+	mockedContainers.On("DeleteContainer", containerID).Return(nil)
+	mockedContainers.On("Close").Return(nil)
+	mockedContainers.On("ListContainers", buildLabels).Return([]containers.Resource{}, nil)
+	mockedContainers.On("ListNetworks", buildLabels).Return([]containers.Resource{}, nil)
+	b := Build{
+		Appname:          "test-app",
+		CodebuildBuildId: CodebuildBuildId,
+		AppPackToml:      &AppPackToml{Test: AppPackTomlTest{Command: "pytest"}},
+		AppJSON:          &AppJSON{},
+		aws:              mockedAWS,
+		state:            mockedState,
+		containers:       mockedContainers,
+		Ctx:              testContext,
+	}
+	stdout, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := os.Stdout
+	os.Stdout = stdout
+	err = b.RunPostbuild()
+	os.Stdout = previous
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	output, _ := os.ReadFile(stdout.Name())
+	tail := strings.Index(string(output), "connecting to postgres://rev")
+	end := strings.Index(string(output), "apppack-test-end")
+	if tail < 0 || end < 0 || tail > end {
+		t.Errorf("expected the held back output before the end marker, got %q", output)
+	}
+}
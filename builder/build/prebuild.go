@@ -4,19 +4,21 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/apppackio/codebuild-image/builder/aws"
 	"github.com/apppackio/codebuild-image/builder/containers"
 	"github.com/apppackio/codebuild-image/builder/filesystem"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/docker/docker/api/types/container"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -30,10 +32,11 @@ var buildkitdConfig = map[string]map[string]map[string][]string{
 }
 
 const (
-	ClosedPRStatus  = "closed"
-	MergedPRStatus  = "merged"
-	OpenPRStatus    = "open"
-	CreatedPRStatus = "created"
+	ClosedPRStatus   = "closed"
+	MergedPRStatus   = "merged"
+	OpenPRStatus     = "open"
+	ReopenedPRStatus = "reopened"
+	CreatedPRStatus  = "created"
 )
 
 // define a struct named Build
@@ -45,22 +48,43 @@ type Build struct {
 	CodebuildWebhookEvent  string
 	CodebuildBuildNumber   string
 	CodebuildSourceVersion string
+	SourceProvider         string
+	PullRequest            string
+	HeadRef                string
+	BaseRef                string
+	StartedAt              time.Time
 	DockerHubUsername      string
 	DockerHubAccessToken   string
 	ECRRepo                string
 	Pipeline               bool
 	CreateReviewApp        bool
+	ReviewAppDeleteTimeout time.Duration
+	DefaultBranch          string
+	CacheMaxAge            time.Duration
 	AppJSON                *AppJSON
 	AppPackToml            *AppPackToml
 	Ctx                    context.Context
 	aws                    aws.AWSInterface
 	state                  filesystem.State
 	containers             containers.ContainersI
+	notifier               *Notifier
+	testSummary            *TestSummary
+	noTests                bool
+	// redact is the config values masked in the build and test logs
+	redact []string
+	// configFingerprint is the hash of each config value, to detect config changes
+	configFingerprint ConfigFingerprint
 }
 
 type PRStatus struct {
 	PullRequest string `json:"pull_request"`
 	Status      string `json:"status"`
+	Image       string `json:"image,omitempty"`
+	// LastActivity is updated on every write and used to prune idle review apps
+	LastActivity time.Time `json:"last_activity"`
+	// ArchivedAt is set once a merged or closed review app's config is cleaned up
+	ArchivedAt *time.Time             `json:"archived_at,omitempty"`
+	History    []PRStatusHistoryEntry `json:"history,omitempty"`
 }
 
 func GetenvFallback(envVars []string) string {
@@ -72,6 +96,16 @@ func GetenvFallback(envVars []string) string {
 	return ""
 }
 
+// buildStartTime parses CODEBUILD_START_TIME (milliseconds since the epoch),
+// falling back to the current time
+func buildStartTime() time.Time {
+	ms, err := strconv.ParseInt(os.Getenv("CODEBUILD_START_TIME"), 10, 64)
+	if err != nil {
+		return time.Now()
+	}
+	return time.UnixMilli(ms)
+}
+
 func (b *Build) FinishBuild() error {
 	err := b.state.WriteCommitTxt()
 	if err != nil {
@@ -89,17 +123,24 @@ func (b *Build) SkipBuild() error {
 }
 
 func New(ctx context.Context) (*Build, error) {
+	webhook := ParseWebhook(os.Getenv)
 	build := Build{
 		Appname:                os.Getenv("APPNAME"),
 		ArtifactBucket:         os.Getenv("ARTIFACT_BUCKET"),
 		Branch:                 GetenvFallback([]string{"BRANCH", "CODEBUILD_WEBHOOK_HEAD_REF", "CODEBUILD_SOURCE_VERSION"}),
 		CodebuildBuildId:       os.Getenv("CODEBUILD_BUILD_ID"),
 		CodebuildBuildNumber:   os.Getenv("CODEBUILD_BUILD_NUMBER"),
-		CodebuildWebhookEvent:  GetenvFallback([]string{"CODEBUILD_WEBHOOK_EVENT", "PULL_REQUEST_UPDATED"}),
+		CodebuildWebhookEvent:  webhook.Event,
 		CodebuildSourceVersion: os.Getenv("CODEBUILD_SOURCE_VERSION"),
+		SourceProvider:         webhook.Provider,
+		PullRequest:            webhook.PullRequest,
+		HeadRef:                webhook.HeadRef,
+		BaseRef:                webhook.BaseRef,
+		StartedAt:              buildStartTime(),
 		DockerHubUsername:      os.Getenv("DOCKERHUB_USERNAME"),
 		DockerHubAccessToken:   os.Getenv("DOCKERHUB_ACCESS_TOKEN"),
 		ECRRepo:                os.Getenv("DOCKER_REPO"),
+		DefaultBranch:          strings.TrimPrefix(os.Getenv("DEFAULT_BRANCH"), "refs/heads/"),
 		Pipeline:               os.Getenv("PIPELINE") == "1",
 		// REVIEW_APP_STATUS is set by the CLI when a review app is created
 		CreateReviewApp: os.Getenv("REVIEW_APP_STATUS") == "created",
@@ -112,7 +153,21 @@ func New(ctx context.Context) (*Build, error) {
 	if err != nil {
 		return &build, err
 	}
-	build.aws = aws.New(&awsCfg, ctx)
+	s3Options, err := aws.S3OptionsFromEnv(os.Getenv)
+	if err != nil {
+		return &build, err
+	}
+	a := aws.New(&awsCfg, ctx)
+	a.SetS3Options(s3Options)
+	build.aws = a
+	build.ReviewAppDeleteTimeout, err = reviewAppDeleteTimeout()
+	if err != nil {
+		return &build, err
+	}
+	build.CacheMaxAge, err = cacheMaxAge()
+	if err != nil {
+		return &build, err
+	}
 	ctainers, err := containers.New(ctx)
 	if err != nil {
 		return &build, err
@@ -135,6 +190,23 @@ func (b *Build) Log() *zerolog.Logger {
 	return log.Ctx(b.Ctx)
 }
 
+// LogAWSMetrics logs the AWS API calls made during the phase. It returns an
+// error so it can be run by checkError when the phase fails.
+func (b *Build) LogAWSMetrics() error {
+	a, ok := b.aws.(*aws.AWS)
+	if !ok {
+		return nil
+	}
+	metrics := a.Metrics()
+	b.Log().Info().
+		Int("calls", metrics.Total()).
+		Int("retries", metrics.Attempts-metrics.Total()).
+		Int("cache_hits", metrics.CacheHits).
+		Interface("operations", metrics.Calls).
+		Msg("AWS API calls")
+	return nil
+}
+
 func (b *Build) System() string {
 	if b.AppPackToml.UseDockerfile() {
 		return DockerBuildSystemKeyword
@@ -143,7 +215,15 @@ func (b *Build) System() string {
 }
 
 func (b *Build) prParameterName() string {
-	return fmt.Sprintf("/apppack/pipelines/%s/review-apps/%s", b.Appname, b.CodebuildSourceVersion)
+	return reviewAppParameterName(b.Appname, b.reviewAppID())
+}
+
+func reviewAppParameterName(appName, pr string) string {
+	return fmt.Sprintf("/apppack/pipelines/%s/review-apps/%s", appName, pr)
+}
+
+func reviewAppConfigPath(appName, pr string) string {
+	return reviewAppParameterName(appName, pr) + "/config/"
 }
 
 // ConvertAppJson checks if an app.json file exists, but an apppack.toml file does not.
@@ -173,33 +253,52 @@ func (b *Build) ConfigParameterPaths() []string {
 	if b.Pipeline {
 		return []string{
 			fmt.Sprintf("/apppack/pipelines/%s/config/", b.Appname),
-			fmt.Sprintf("/apppack/pipelines/%s/review-apps/%s/config/", b.Appname, b.CodebuildSourceVersion),
+			reviewAppConfigPath(b.Appname, b.reviewAppID()),
 		}
 	}
 	return []string{fmt.Sprintf("/apppack/apps/%s/config/", b.Appname)}
 }
 
-func (b *Build) SetPRStatus(status string) (*PRStatus, error) {
-	parameterName := b.prParameterName()
-	prStatus := PRStatus{
-		PullRequest: b.CodebuildSourceVersion,
-		Status:      status,
+// SetPRStatus moves the review app to a new status, recording the event in its history
+func (b *Build) SetPRStatus(prStatus *PRStatus, status string) (*PRStatus, error) {
+	prStatus.PullRequest = b.reviewAppID()
+	if err := prStatus.Transition(status, b.prEvent(), b.CodebuildBuildId, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := b.writePRStatus(prStatus); err != nil {
+		return nil, err
 	}
+	return prStatus, nil
+}
+
+func (b *Build) writePRStatus(prStatus *PRStatus) error {
+	return writePRStatus(b.aws, b.prParameterName(), prStatus)
+}
+
+func writePRStatus(a aws.AWSInterface, parameterName string, prStatus *PRStatus) error {
+	prStatus.LastActivity = time.Now().UTC()
 	// convert the PRStatus struct to JSON
 	prStatusJSON, err := json.Marshal(prStatus)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = b.aws.SetParameter(parameterName, string(prStatusJSON))
+	return a.SetParameter(parameterName, string(prStatusJSON))
+}
+
+// recordReviewAppImage stores the image pushed for the review app, so it can
+// be used to run the pre-destroy command once the PR is merged or closed
+func (b *Build) recordReviewAppImage(image string) error {
+	prStatus, err := b.GetPRStatus()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &prStatus, nil
+	prStatus.Image = image
+	return b.writePRStatus(prStatus)
 }
 
 func (b *Build) GetPRStatus() (*PRStatus, error) {
 	parameterName := b.prParameterName()
-	b.Log().Debug().Str("pr", b.CodebuildSourceVersion).Msg("getting PR status")
+	b.Log().Debug().Str("pr", b.reviewAppID()).Msg("getting PR status")
 	prStatusJSON, err := b.aws.GetParameter(parameterName)
 	if err != nil {
 		return nil, err
@@ -213,21 +312,39 @@ func (b *Build) GetPRStatus() (*PRStatus, error) {
 }
 
 func (b *Build) reviewAppStackName() string {
-	prNumber := strings.TrimPrefix(b.CodebuildSourceVersion, "pr/")
-	return fmt.Sprintf("apppack-reviewapp-%s%s", b.Appname, prNumber)
+	return reviewAppStackName(b.Appname, b.reviewAppID())
+}
+
+func reviewAppStackName(appName, id string) string {
+	if isBranchPreview(id) {
+		return fmt.Sprintf("apppack-reviewapp-%s-branch-%s", appName, strings.TrimPrefix(id, "branch/"))
+	}
+	prNumber := strings.TrimPrefix(id, "pr/")
+	return fmt.Sprintf("apppack-reviewapp-%s%s", appName, prNumber)
 }
 
 func (b *Build) ReviewAppStackExists() (bool, error) {
 	_, err := b.aws.DescribeStack(b.reviewAppStackName())
+	if errors.Is(err, aws.ErrStackNotFound) {
+		return false, nil
+	}
 	if err != nil {
-		// TODO check for specific error that means stack doesn't exist
 		return false, err
 	}
 	return true, nil
 }
 
+// DestroyReviewAppStack starts deleting the review app stack, waiting for it
+// to finish when ReviewAppDeleteTimeout is set
 func (b *Build) DestroyReviewAppStack() error {
-	return b.aws.DestroyStack(b.reviewAppStackName())
+	name := b.reviewAppStackName()
+	if err := b.aws.DestroyStack(name); err != nil {
+		return err
+	}
+	if b.ReviewAppDeleteTimeout <= 0 {
+		return nil
+	}
+	return b.waitForStackDelete(name, b.ReviewAppDeleteTimeout)
 }
 
 func (b *Build) DockerLogin() error {
@@ -264,13 +381,16 @@ func (b *Build) NewPRStatus() string {
 	if b.CreateReviewApp {
 		return CreatedPRStatus
 	}
-	if b.CodebuildWebhookEvent == "PULL_REQUEST_CREATED" || b.CodebuildWebhookEvent == "PULL_REQUEST_REOPENED" {
+	if b.CodebuildWebhookEvent == "PULL_REQUEST_CREATED" {
 		return OpenPRStatus
 	}
+	if b.CodebuildWebhookEvent == "PULL_REQUEST_REOPENED" {
+		return ReopenedPRStatus
+	}
 	if b.CodebuildWebhookEvent == "PULL_REQUEST_MERGED" {
 		return MergedPRStatus
 	}
-	if b.CodebuildWebhookEvent == "PULL_REQUEST_CLOSED" {
+	if b.CodebuildWebhookEvent == "PULL_REQUEST_CLOSED" || b.CodebuildWebhookEvent == BranchDeletedEvent {
 		return ClosedPRStatus
 	}
 	_, err := b.GetPRStatus()
@@ -285,41 +405,67 @@ func (b *Build) HandlePR() (bool, error) {
 	if !b.Pipeline {
 		return false, nil
 	}
-	if !strings.HasPrefix(b.CodebuildSourceVersion, "pr/") {
-		return false, fmt.Errorf("not a pull request: CODEBUILD_SOURCE_VERSION=%s", b.CodebuildSourceVersion)
+	if b.reviewAppID() == "" {
+		return false, fmt.Errorf("not a pull request or preview branch: CODEBUILD_SOURCE_VERSION=%s", b.CodebuildSourceVersion)
 	}
 	newStatus := b.NewPRStatus()
 	b.Log().Debug().Str("status", newStatus).Msg("PR status")
+	status, err := b.GetPRStatus()
+	if errors.Is(err, aws.ErrParameterNotFound) {
+		// any branch can be deleted, but only those with a status have a preview
+		if b.CodebuildWebhookEvent == BranchDeletedEvent && isBranchPreview(b.reviewAppID()) {
+			b.Log().Info().Str("pr", b.reviewAppID()).Msg("deleted branch has no preview")
+			err = b.SkipBuild()
+			return true, err
+		}
+		b.Log().Debug().Err(err).Msg("no existing PR status")
+		status = &PRStatus{}
+	} else if err != nil {
+		return false, fmt.Errorf("unable to read review app status: %w", err)
+	}
+	// a push to a PR whose review app was pruned, or to a deleted preview
+	// branch which was pushed again, lets it be created again
+	if newStatus == "" && (status.WasPruned() || (isBranchPreview(b.reviewAppID()) && status.Status == ClosedPRStatus)) {
+		newStatus = ReopenedPRStatus
+	}
+	// an empty new status keeps the current one, repeated events are a no-op
+	if newStatus != "" && newStatus != status.Status {
+		updated, err := b.SetPRStatus(status, newStatus)
+		var invalid *InvalidPRTransitionError
+		if errors.As(err, &invalid) {
+			// e.g. a retried build of the event which opened the PR, after the
+			// review app was created; the current status stands
+			b.Log().Warn().Err(err).Msg("ignoring out of order review app event")
+			newStatus = ""
+		} else if err != nil {
+			return false, err
+		} else {
+			status = updated
+		}
+	}
 	if newStatus == MergedPRStatus || newStatus == ClosedPRStatus {
 		hasReviewApp, err := b.ReviewAppStackExists()
-		// TODO err is ignored because it usually means the stack doesn't exist
 		if err != nil {
-			b.Log().Debug().Err(err).Msg("unable to access review app stack")
+			return false, fmt.Errorf("unable to access review app stack: %w", err)
 		}
 		if hasReviewApp {
-			b.Log().Info().Str("pr", b.CodebuildSourceVersion).Msg("deleting review app")
+			// the review app is destroyed regardless, so failures are only reported
+			if err := b.RunPreDestroy(status.Image); err != nil {
+				b.Log().Error().Err(err).Msg("pre-destroy command failed")
+			}
+			b.Log().Info().Str("pr", b.reviewAppID()).Msg("deleting review app")
 			if err := b.DestroyReviewAppStack(); err != nil {
 				return false, err
 			}
 		}
+		if status.ArchivedAt == nil {
+			if err := b.archiveReviewApp(status); err != nil {
+				b.Log().Warn().Err(err).Msg("failed to clean up review app config")
+			}
+		}
 		err = b.SkipBuild()
 		return true, err
 	}
-	status, err := b.GetPRStatus()
-	// if the status needs to change, update it
-	noStatus := err != nil
-	keepStatus := newStatus == ""
-	// if no status exists and no status to set, set it to "open"
-	if noStatus {
-		status = &PRStatus{Status: ""}
-	}
-	statusChanged := status.Status != newStatus
-	if noStatus || (statusChanged && !keepStatus) {
-		status, err = b.SetPRStatus(newStatus)
-		if err != nil {
-			return false, err
-		}
-	}
 	if status.Status != CreatedPRStatus {
 		err = b.SkipBuild()
 		return true, err
@@ -339,47 +485,12 @@ func removeDuplicateStr(strSlice []string) []string {
 	return list
 }
 
-func (b *Build) StartAddons() (map[string]string, error) {
-	// if "heroku-redis:in-dyno" in addons start redis:apline
-	// if "heroku-postgresql:in-dyno" in addons start postgres:alpine
-	envOverides := map[string]string{}
-	var err error
-	// dedupe addons
-	addons := removeDuplicateStr(b.AppJSON.GetTestAddons())
-	redisImage := "redis:alpine"
-	postgresImage := "postgres:alpine"
-	// Container names must be unique on the CodeBuild Docker daemon (which is
-	// reused across builds), so prefix them with the build ID. The friendly
-	// name ("redis"/"db") is kept as a network alias so other containers can
-	// still reach the addon by that hostname.
-	namePrefix := strings.ReplaceAll(b.CodebuildBuildId, ":", "-")
-	// use a switch statement to iterate over addons
-	for _, addon := range addons {
-		switch addon {
-		case "heroku-redis:in-dyno":
-			if err = b.containers.PullImage(redisImage); err != nil {
-				return nil, err
-			}
-			if err = b.containers.RunContainer(fmt.Sprintf("%s-redis", namePrefix), b.CodebuildBuildId, []string{"redis"}, &container.Config{Image: redisImage}); err != nil {
-				return nil, err
-			}
-			envOverides["REDIS_URL"] = "redis://redis:6379"
-		case "heroku-postgresql:in-dyno":
-			if err = b.containers.PullImage(postgresImage); err != nil {
-				return nil, err
-			}
-			if err = b.containers.RunContainer(fmt.Sprintf("%s-db", namePrefix), b.CodebuildBuildId, []string{"db"}, &container.Config{Image: postgresImage}); err != nil {
-				return nil, err
-			}
-			envOverides["DATABASE_URL"] = "postgres://postgres:postgres@db:5432/postgres"
-		}
-	}
-	return envOverides, nil
-}
-
-func (b *Build) RunPrebuild() error {
+func (b *Build) RunPrebuild() (err error) {
 	b.Log().Debug().Msg("running prebuild")
 	defer b.containers.Close()
+	if err := b.GarbageCollect(); err != nil {
+		b.Log().Warn().Err(err).Msg("failed to clean up after previous builds")
+	}
 	skip, err := b.HandlePR()
 	if skip {
 		return err
@@ -387,15 +498,23 @@ func (b *Build) RunPrebuild() error {
 	if err != nil {
 		return err
 	}
+	b.notify(BuildStatusContext, StatePending, "Build started")
+	b.notify(TestStatusContext, StatePending, "Waiting for the build")
+	defer func() {
+		if err != nil {
+			b.notifyResult(BuildStatusContext, "Prebuild", err)
+		}
+	}()
 
 	// start downloading cache while we do other work
 	var copyError error
+	var cacheReport *CacheReport
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		b.Log().Info().Msg("downloading build cache")
-		copyError = b.aws.CopyFromS3(b.ArtifactBucket, "cache", CacheDirectory)
+		cacheReport, copyError = b.restoreCache()
 	}()
 	if b.AppPackToml != nil {
 		if err = b.AppPackToml.Validate(); err != nil {
@@ -427,7 +546,7 @@ func (b *Build) RunPrebuild() error {
 		return err
 	}
 
-	err = c.CreateNetwork(b.CodebuildBuildId)
+	err = c.CreateNetwork(b.CodebuildBuildId, b.resourceLabels())
 	if err != nil {
 		return err
 	}
@@ -435,6 +554,13 @@ func (b *Build) RunPrebuild() error {
 	if err != nil {
 		return err
 	}
+	serviceEnv, err := b.StartServices()
+	if err != nil {
+		return err
+	}
+	for k, v := range serviceEnv {
+		envOverrides[k] = v
+	}
 	err = b.state.WriteEnvFile(&envOverrides)
 	if err != nil {
 		return err
@@ -447,6 +573,9 @@ func (b *Build) RunPrebuild() error {
 	if copyError != nil {
 		b.Log().Warn().Err(copyError).Msg("failed to download build cache")
 	}
+	if err = b.writeCacheRestore(cacheReport); err != nil {
+		b.Log().Warn().Err(err).Msg("failed to write cache restore report")
+	}
 	return nil
 }
 
@@ -466,14 +595,22 @@ func (b *Build) DockerPrebuild() error {
 	if err != nil {
 		return err
 	}
-	cmd := exec.Command(
-		"docker", "buildx", "create",
+	args := []string{
+		"buildx", "create",
 		"--use",
 		"--name", strings.ReplaceAll(b.CodebuildBuildId, ":", "-"),
 		"--driver", "docker-container",
 		"--config", buildkitdConfigPath,
 		"--bootstrap",
-	)
+	}
+	// the builder is labeled through its environment, for garbage collection
+	labels := b.resourceLabels()
+	for _, label := range []string{containers.BuildIDLabel, containers.CreatedAtLabel} {
+		if value, ok := labels[label]; ok {
+			args = append(args, "--driver-opt", fmt.Sprintf("env.%s=%s", containers.BuildxEnvLabels[label], value))
+		}
+	}
+	cmd := exec.Command("docker", args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
@@ -1,13 +1,16 @@
 package build
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/apppackio/codebuild-image/builder/aws"
 	"github.com/apppackio/codebuild-image/builder/containers"
 	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
 	"github.com/docker/docker/api/types/container"
@@ -16,6 +19,8 @@ import (
 
 const CodebuildBuildId = "codebuild-build-id"
 
+var buildLabels = map[string]string{containers.BuildIDLabel: CodebuildBuildId}
+
 type MockAWS struct {
 	mock.Mock
 }
@@ -37,11 +42,36 @@ func (m *MockAWS) GetParametersByPath(path string) (map[string]string, error) {
 	return args.Get(0).(map[string]string), args.Error(1)
 }
 
+func (m *MockAWS) DeleteParameter(name string) error {
+	args := m.Called(name)
+	return args.Error(0)
+}
+
+func (m *MockAWS) DeleteParametersByPath(path string) (int, error) {
+	args := m.Called(path)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockAWS) ListParametersByTag(path, key, value string) ([]string, error) {
+	args := m.Called(path, key, value)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockAWS) GetSecretValue(ref aws.SecretReference) (string, error) {
+	args := m.Called(ref)
+	return args.String(0), args.Error(1)
+}
+
 func (m *MockAWS) DescribeStack(stackName string) (*types.Stack, error) {
 	args := m.Called(stackName)
 	return args.Get(0).(*types.Stack), args.Error(1)
 }
 
+func (m *MockAWS) ListStackResources(stackName string) ([]types.StackResourceSummary, error) {
+	args := m.Called(stackName)
+	return args.Get(0).([]types.StackResourceSummary), args.Error(1)
+}
+
 func (m *MockAWS) DestroyStack(stackName string) error {
 	args := m.Called(stackName)
 	return args.Error(0)
@@ -52,16 +82,61 @@ func (m *MockAWS) GetECRLogin() (string, string, error) {
 	return args.String(0), args.String(1), args.Error(2)
 }
 
-func (m *MockAWS) CopyFromS3(bucket, prefix, dest string) error {
-	args := m.Called(bucket, dest)
+func (m *MockAWS) GetObject(bucket, key string) ([]byte, error) {
+	args := m.Called(bucket, key)
+	return args.Get(0).([]byte), args.Error(1)
+}
+
+func (m *MockAWS) PutObject(bucket, key string, body []byte) error {
+	args := m.Called(bucket, key, body)
 	return args.Error(0)
 }
 
-func (m *MockAWS) SyncToS3(src, bucket, prefix string, quiet bool) error {
-	args := m.Called(src, bucket, prefix, quiet)
+func (m *MockAWS) DownloadStream(bucket, key string) (io.ReadCloser, error) {
+	args := m.Called(bucket, key)
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
+
+func (m *MockAWS) UploadStream(bucket, key string, body io.Reader) error {
+	// read the body so the writer isn't left blocked
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	args := m.Called(bucket, key, content)
 	return args.Error(0)
 }
 
+func (m *MockAWS) DeleteObject(bucket, key string) error {
+	args := m.Called(bucket, key)
+	return args.Error(0)
+}
+
+func (m *MockAWS) ListObjects(bucket, prefix string) (map[string]time.Time, error) {
+	args := m.Called(bucket, prefix)
+	return args.Get(0).(map[string]time.Time), args.Error(1)
+}
+
+func (m *MockAWS) DeleteObjectsByPrefix(bucket, prefix string) (int, error) {
+	args := m.Called(bucket, prefix)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockAWS) DeleteObjects(bucket string, keys []string) (int, error) {
+	args := m.Called(bucket, keys)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockAWS) CopyFromS3(bucket string, prefixes []string, dest string) (string, aws.TransferStats, error) {
+	args := m.Called(bucket, prefixes, dest)
+	return args.String(0), args.Get(1).(aws.TransferStats), args.Error(2)
+}
+
+func (m *MockAWS) SyncToS3(src, bucket, prefix string) (aws.TransferStats, error) {
+	args := m.Called(src, bucket, prefix)
+	return args.Get(0).(aws.TransferStats), args.Error(1)
+}
+
 type MockFilesystem struct {
 	mock.Mock
 }
@@ -131,6 +206,16 @@ func (m *MockFilesystem) WriteJsonToFile(s string, v interface{}) error {
 	return args.Error(0)
 }
 
+func (m *MockFilesystem) ReadJsonFile(s string, v interface{}) error {
+	args := m.Called(s, v)
+	return args.Error(0)
+}
+
+func (m *MockFilesystem) WriteXmlToFile(s string, v interface{}) error {
+	args := m.Called(s, v)
+	return args.Error(0)
+}
+
 type MockContainers struct {
 	mock.Mock
 }
@@ -140,11 +225,46 @@ func (c *MockContainers) Close() error {
 	return args.Error(0)
 }
 
-func (c *MockContainers) CreateNetwork(s string) error {
+func (c *MockContainers) CreateNetwork(s string, labels map[string]string) error {
+	args := c.Called(s, labels)
+	return args.Error(0)
+}
+
+func (c *MockContainers) ListNetworks(labels map[string]string) ([]containers.Resource, error) {
+	args := c.Called(labels)
+	return args.Get(0).([]containers.Resource), args.Error(1)
+}
+
+func (c *MockContainers) DeleteNetwork(s string) error {
+	args := c.Called(s)
+	return args.Error(0)
+}
+
+func (c *MockContainers) ListContainers(labels map[string]string) ([]containers.Resource, error) {
+	args := c.Called(labels)
+	return args.Get(0).([]containers.Resource), args.Error(1)
+}
+
+func (c *MockContainers) ListBuildxBuilders() ([]containers.Resource, error) {
+	args := c.Called()
+	return args.Get(0).([]containers.Resource), args.Error(1)
+}
+
+func (c *MockContainers) SelectedBuildxBuilder() (string, error) {
+	args := c.Called()
+	return args.String(0), args.Error(1)
+}
+
+func (c *MockContainers) DeleteVolume(s string) error {
 	args := c.Called(s)
 	return args.Error(0)
 }
 
+func (c *MockContainers) PruneDanglingImages(d time.Duration) (uint64, error) {
+	args := c.Called(d)
+	return args.Get(0).(uint64), args.Error(1)
+}
+
 func (c *MockContainers) PullImage(s string) error {
 	args := c.Called(s)
 	return args.Error(0)
@@ -165,8 +285,8 @@ func (c *MockContainers) CreateContainer(s1 string, cfg *container.Config) (*str
 	return args.Get(0).(*string), args.Error(1)
 }
 
-func (c *MockContainers) RunContainer(s1 string, s2 string, aliases []string, cfg *container.Config) error {
-	args := c.Called(s1, s2, aliases, cfg)
+func (c *MockContainers) RunContainer(s1 string, s2 string, aliases []string, cfg *container.Config, hostCfg *container.HostConfig) error {
+	args := c.Called(s1, s2, aliases, cfg, hostCfg)
 	return args.Error(0)
 }
 
@@ -175,16 +295,46 @@ func (c *MockContainers) GetContainerFile(s1 string, s2 string) (io.ReadCloser,
 	return args.Get(0).(io.ReadCloser), args.Error(1)
 }
 
-func (c *MockContainers) WaitForExit(s string) (int, error) {
-	args := c.Called(s)
+func (c *MockContainers) GetContainerFiles(s1 string, s2 string) (map[string][]byte, error) {
+	args := c.Called(s1, s2)
+	return args.Get(0).(map[string][]byte), args.Error(1)
+}
+
+func (c *MockContainers) WaitForExit(s string, d time.Duration) (int, error) {
+	args := c.Called(s, d)
 	return args.Int(0), args.Error(1)
 }
 
+func (c *MockContainers) TailLogs(s string, n int, w1, w2 io.Writer) error {
+	args := c.Called(s, n, w1, w2)
+	return args.Error(0)
+}
+
+func (c *MockContainers) ListProcesses(s string, w io.Writer) error {
+	args := c.Called(s, w)
+	return args.Error(0)
+}
+
+func (c *MockContainers) KillContainer(s string) error {
+	args := c.Called(s)
+	return args.Error(0)
+}
+
 func (c *MockContainers) AttachLogs(s string, w1, w2 io.Writer) error {
 	args := c.Called(s, w1, w2)
 	return args.Error(0)
 }
 
+func (c *MockContainers) ExecInContainer(s string, cmd []string) (int, error) {
+	args := c.Called(s, cmd)
+	return args.Int(0), args.Error(1)
+}
+
+func (c *MockContainers) ContainerIP(s1 string, s2 string) (string, error) {
+	args := c.Called(s1, s2)
+	return args.String(0), args.Error(1)
+}
+
 func (c *MockContainers) DeleteContainer(s string) error {
 	args := c.Called(s)
 	return args.Error(0)
@@ -208,7 +358,7 @@ func TestHandlePRSkip(t *testing.T) {
 	}
 	_, err = b.HandlePR()
 	if err == nil {
-		t.Error("HandlePR should return an error when CodebuildSourceVersion does not start with `pr/`")
+		t.Error("HandlePR should return an error when the build is not for a pull request")
 	}
 }
 
@@ -221,21 +371,21 @@ func TestHandlePRReviewAppCreated(t *testing.T) {
 		fmt.Sprintf("/apppack/pipelines/%s/review-apps/%s", appName, pr),
 	).Return(
 		"",
-		fmt.Errorf("parameter does not exist"),
+		aws.ErrParameterNotFound,
 	)
 	mockedAWS.On(
 		"SetParameter",
 		fmt.Sprintf("/apppack/pipelines/%s/review-apps/%s", appName, pr),
-		fmt.Sprintf("{\"pull_request\":\"%s\",\"status\":\"created\"}", pr),
+		prStatusMatching(pr, "created"),
 	).Return(nil)
 
 	b := Build{
-		Appname:                appName,
-		Pipeline:               true,
-		CodebuildSourceVersion: pr,
-		CreateReviewApp:        true,
-		aws:                    mockedAWS,
-		Ctx:                    testContext,
+		Appname:         appName,
+		Pipeline:        true,
+		PullRequest:     pr,
+		CreateReviewApp: true,
+		aws:             mockedAWS,
+		Ctx:             testContext,
 	}
 	skip, err := b.HandlePR()
 	if err != nil {
@@ -256,7 +406,7 @@ func TestHandlePRAWSFailed(t *testing.T) {
 		fmt.Sprintf("/apppack/pipelines/%s/review-apps/%s", appName, pr),
 	).Return(
 		"",
-		fmt.Errorf("parameter does not exist"),
+		aws.ErrParameterNotFound,
 	)
 	mockedAWS.On(
 		"SetParameter",
@@ -265,12 +415,12 @@ func TestHandlePRAWSFailed(t *testing.T) {
 	).Return(fmt.Errorf("failed to set parameter"))
 
 	b := Build{
-		Appname:                appName,
-		Pipeline:               true,
-		CodebuildSourceVersion: pr,
-		CreateReviewApp:        true,
-		aws:                    mockedAWS,
-		Ctx:                    testContext,
+		Appname:         appName,
+		Pipeline:        true,
+		PullRequest:     pr,
+		CreateReviewApp: true,
+		aws:             mockedAWS,
+		Ctx:             testContext,
 	}
 	_, err := b.HandlePR()
 	if err == nil {
@@ -287,6 +437,21 @@ func emptyState() *MockFilesystem {
 	return mockedState
 }
 
+// prStatusMatching matches the JSON of a PR status whose latest history entry is the status
+func prStatusMatching(pr string, status string) interface{} {
+	return mock.MatchedBy(func(value string) bool {
+		var prStatus PRStatus
+		if err := json.Unmarshal([]byte(value), &prStatus); err != nil {
+			return false
+		}
+		if len(prStatus.History) == 0 {
+			return false
+		}
+		last := prStatus.History[len(prStatus.History)-1]
+		return prStatus.PullRequest == pr && prStatus.Status == status && last.Status == status
+	})
+}
+
 func reviewAppStatus(appName string, pr string, status string) *MockAWS {
 	mockedAWS := new(MockAWS)
 	mockedAWS.On(
@@ -309,22 +474,22 @@ func TestHandlePROpened(t *testing.T) {
 		fmt.Sprintf("/apppack/pipelines/%s/review-apps/%s", appName, pr),
 	).Return(
 		"",
-		fmt.Errorf("parameter does not exist"),
+		aws.ErrParameterNotFound,
 	)
 	mockedAWS.On(
 		"SetParameter",
 		fmt.Sprintf("/apppack/pipelines/%s/review-apps/%s", appName, pr),
-		fmt.Sprintf("{\"pull_request\":\"%s\",\"status\":\"open\"}", pr),
+		prStatusMatching(pr, "open"),
 	).Return(nil)
 	b := Build{
-		Appname:                appName,
-		Pipeline:               true,
-		CodebuildSourceVersion: pr,
-		CodebuildWebhookEvent:  "PULL_REQUEST_CREATED",
-		CodebuildBuildId:       CodebuildBuildId,
-		aws:                    mockedAWS,
-		state:                  mockedState,
-		Ctx:                    testContext,
+		Appname:               appName,
+		Pipeline:              true,
+		PullRequest:           pr,
+		CodebuildWebhookEvent: "PULL_REQUEST_CREATED",
+		CodebuildBuildId:      CodebuildBuildId,
+		aws:                   mockedAWS,
+		state:                 mockedState,
+		Ctx:                   testContext,
 	}
 	skip, err := b.HandlePR()
 	if err != nil {
@@ -346,23 +511,23 @@ func TestHandlePRUpdatedNotExists(t *testing.T) {
 		mock.AnythingOfType("string"),
 	).Return(
 		"",
-		fmt.Errorf("parameter does not exist"),
+		aws.ErrParameterNotFound,
 	)
 	mockedAWS.On(
 		"SetParameter",
 		fmt.Sprintf("/apppack/pipelines/%s/review-apps/%s", appName, pr),
-		fmt.Sprintf("{\"pull_request\":\"%s\",\"status\":\"open\"}", pr),
+		prStatusMatching(pr, "open"),
 	).Return(nil)
 	mockedState := emptyState()
 	b := Build{
-		Appname:                appName,
-		Pipeline:               true,
-		CodebuildSourceVersion: pr,
-		CodebuildWebhookEvent:  "PULL_REQUEST_UPDATED",
-		CodebuildBuildId:       CodebuildBuildId,
-		aws:                    mockedAWS,
-		state:                  mockedState,
-		Ctx:                    testContext,
+		Appname:               appName,
+		Pipeline:              true,
+		PullRequest:           pr,
+		CodebuildWebhookEvent: "PULL_REQUEST_UPDATED",
+		CodebuildBuildId:      CodebuildBuildId,
+		aws:                   mockedAWS,
+		state:                 mockedState,
+		Ctx:                   testContext,
 	}
 	skip, err := b.HandlePR()
 	if err != nil {
@@ -381,12 +546,12 @@ func TestHandlePRUpdatedReviewAppCreated(t *testing.T) {
 	appName := "test-app"
 	mockedAWS := reviewAppStatus(appName, pr, "created")
 	b := Build{
-		Appname:                appName,
-		Pipeline:               true,
-		CodebuildSourceVersion: pr,
-		CodebuildWebhookEvent:  "PULL_REQUEST_UPDATED",
-		aws:                    mockedAWS,
-		Ctx:                    testContext,
+		Appname:               appName,
+		Pipeline:              true,
+		PullRequest:           pr,
+		CodebuildWebhookEvent: "PULL_REQUEST_UPDATED",
+		aws:                   mockedAWS,
+		Ctx:                   testContext,
 	}
 	skip, err := b.HandlePR()
 	if err != nil {
@@ -404,14 +569,14 @@ func TestHandlePRUpdatedClosed(t *testing.T) {
 	mockedAWS := reviewAppStatus(appName, pr, "closed")
 	mockedState := emptyState()
 	b := Build{
-		Appname:                appName,
-		Pipeline:               true,
-		CodebuildSourceVersion: pr,
-		CodebuildWebhookEvent:  "PULL_REQUEST_UPDATED",
-		CodebuildBuildId:       CodebuildBuildId,
-		aws:                    mockedAWS,
-		state:                  mockedState,
-		Ctx:                    testContext,
+		Appname:               appName,
+		Pipeline:              true,
+		PullRequest:           pr,
+		CodebuildWebhookEvent: "PULL_REQUEST_UPDATED",
+		CodebuildBuildId:      CodebuildBuildId,
+		aws:                   mockedAWS,
+		state:                 mockedState,
+		Ctx:                   testContext,
 	}
 	skip, err := b.HandlePR()
 	if err != nil {
@@ -435,22 +600,22 @@ func TestHandlePRPushDoesNotExist(t *testing.T) {
 		mock.AnythingOfType("string"),
 	).Return(
 		"",
-		fmt.Errorf("parameter does not exist"),
+		aws.ErrParameterNotFound,
 	)
 	mockedAWS.On(
 		"SetParameter",
 		fmt.Sprintf("/apppack/pipelines/%s/review-apps/%s", appName, pr),
-		fmt.Sprintf("{\"pull_request\":\"%s\",\"status\":\"open\"}", pr),
+		prStatusMatching(pr, "open"),
 	).Return(nil)
 	mockedState := emptyState()
 	b := Build{
-		Appname:                appName,
-		Pipeline:               true,
-		CodebuildSourceVersion: pr,
-		CodebuildBuildId:       CodebuildBuildId,
-		aws:                    mockedAWS,
-		state:                  mockedState,
-		Ctx:                    testContext,
+		Appname:          appName,
+		Pipeline:         true,
+		PullRequest:      pr,
+		CodebuildBuildId: CodebuildBuildId,
+		aws:              mockedAWS,
+		state:            mockedState,
+		Ctx:              testContext,
 	}
 	skip, err := b.HandlePR()
 	if err != nil {
@@ -467,20 +632,33 @@ func TestHandlePRMerged(t *testing.T) {
 	pr := "pr/123"
 	appName := "test-app"
 	mockedAWS := new(MockAWS)
+	mockedAWS.On(
+		"GetParameter",
+		fmt.Sprintf("/apppack/pipelines/%s/review-apps/%s", appName, pr),
+	).Return(
+		"",
+		aws.ErrParameterNotFound,
+	)
+	mockedAWS.On(
+		"SetParameter",
+		fmt.Sprintf("/apppack/pipelines/%s/review-apps/%s", appName, pr),
+		prStatusMatching(pr, "merged"),
+	).Return(nil)
 	mockedAWS.On(
 		"DescribeStack",
 		fmt.Sprintf("apppack-reviewapp-%s%s", appName, strings.Split(pr, "/")[1]),
-	).Return(&types.Stack{}, fmt.Errorf("stack does not exist"))
+	).Return((*types.Stack)(nil), aws.ErrStackNotFound)
+	mockedAWS.On("DeleteParametersByPath", reviewAppConfigPath(appName, pr)).Return(2, nil)
 	mockedState := emptyState()
 	b := Build{
-		Appname:                appName,
-		Pipeline:               true,
-		CodebuildSourceVersion: pr,
-		CodebuildWebhookEvent:  "PULL_REQUEST_MERGED",
-		CodebuildBuildId:       CodebuildBuildId,
-		aws:                    mockedAWS,
-		state:                  mockedState,
-		Ctx:                    testContext,
+		Appname:               appName,
+		Pipeline:              true,
+		PullRequest:           pr,
+		CodebuildWebhookEvent: "PULL_REQUEST_MERGED",
+		CodebuildBuildId:      CodebuildBuildId,
+		aws:                   mockedAWS,
+		state:                 mockedState,
+		Ctx:                   testContext,
 	}
 	skip, err := b.HandlePR()
 	if err != nil {
@@ -496,7 +674,12 @@ func TestHandlePRMerged(t *testing.T) {
 func TestHandlePRMergedAndDestroy(t *testing.T) {
 	pr := "pr/123"
 	appName := "test-app"
-	mockedAWS := new(MockAWS)
+	mockedAWS := reviewAppStatus(appName, pr, "created")
+	mockedAWS.On(
+		"SetParameter",
+		fmt.Sprintf("/apppack/pipelines/%s/review-apps/%s", appName, pr),
+		prStatusMatching(pr, "merged"),
+	).Return(nil)
 	mockedAWS.On(
 		"DescribeStack",
 		fmt.Sprintf("apppack-reviewapp-%s%s", appName, strings.Split(pr, "/")[1]),
@@ -505,16 +688,17 @@ func TestHandlePRMergedAndDestroy(t *testing.T) {
 		"DestroyStack",
 		fmt.Sprintf("apppack-reviewapp-%s%s", appName, strings.Split(pr, "/")[1]),
 	).Return(nil)
+	mockedAWS.On("DeleteParametersByPath", reviewAppConfigPath(appName, pr)).Return(2, nil)
 	mockedState := emptyState()
 	b := Build{
-		Appname:                appName,
-		Pipeline:               true,
-		CodebuildSourceVersion: pr,
-		CodebuildWebhookEvent:  "PULL_REQUEST_MERGED",
-		CodebuildBuildId:       CodebuildBuildId,
-		aws:                    mockedAWS,
-		state:                  mockedState,
-		Ctx:                    testContext,
+		Appname:               appName,
+		Pipeline:              true,
+		PullRequest:           pr,
+		CodebuildWebhookEvent: "PULL_REQUEST_MERGED",
+		CodebuildBuildId:      CodebuildBuildId,
+		aws:                   mockedAWS,
+		state:                 mockedState,
+		Ctx:                   testContext,
 	}
 	skip, err := b.HandlePR()
 	if err != nil {
@@ -530,7 +714,12 @@ func TestHandlePRMergedAndDestroy(t *testing.T) {
 func TestHandlePRClosedAndDestroy(t *testing.T) {
 	pr := "pr/123"
 	appName := "test-app"
-	mockedAWS := new(MockAWS)
+	mockedAWS := reviewAppStatus(appName, pr, "created")
+	mockedAWS.On(
+		"SetParameter",
+		fmt.Sprintf("/apppack/pipelines/%s/review-apps/%s", appName, pr),
+		prStatusMatching(pr, "closed"),
+	).Return(nil)
 	mockedAWS.On(
 		"DescribeStack",
 		fmt.Sprintf("apppack-reviewapp-%s%s", appName, strings.Split(pr, "/")[1]),
@@ -539,16 +728,17 @@ func TestHandlePRClosedAndDestroy(t *testing.T) {
 		"DestroyStack",
 		fmt.Sprintf("apppack-reviewapp-%s%s", appName, strings.Split(pr, "/")[1]),
 	).Return(nil)
+	mockedAWS.On("DeleteParametersByPath", reviewAppConfigPath(appName, pr)).Return(2, nil)
 	mockedState := emptyState()
 	b := Build{
-		Appname:                appName,
-		Pipeline:               true,
-		CodebuildSourceVersion: pr,
-		CodebuildWebhookEvent:  "PULL_REQUEST_CLOSED",
-		CodebuildBuildId:       CodebuildBuildId,
-		aws:                    mockedAWS,
-		state:                  mockedState,
-		Ctx:                    testContext,
+		Appname:               appName,
+		Pipeline:              true,
+		PullRequest:           pr,
+		CodebuildWebhookEvent: "PULL_REQUEST_CLOSED",
+		CodebuildBuildId:      CodebuildBuildId,
+		aws:                   mockedAWS,
+		state:                 mockedState,
+		Ctx:                   testContext,
 	}
 	skip, err := b.HandlePR()
 	if err != nil {
@@ -578,7 +768,7 @@ func TestStartAddons(t *testing.T) {
 	).Return(nil)
 	mockedContainers.On(
 		"RunContainer",
-		fmt.Sprintf("%s-redis", CodebuildBuildId), CodebuildBuildId, []string{"redis"}, &container.Config{Image: "redis:alpine"},
+		fmt.Sprintf("%s-redis", CodebuildBuildId), CodebuildBuildId, []string{"redis"}, &container.Config{Image: "redis:alpine", Labels: buildLabels}, (*container.HostConfig)(nil),
 	).Return(nil)
 	mockedContainers.On(
 		"PullImage",
@@ -586,7 +776,7 @@ func TestStartAddons(t *testing.T) {
 	).Return(nil)
 	mockedContainers.On(
 		"RunContainer",
-		fmt.Sprintf("%s-db", CodebuildBuildId), CodebuildBuildId, []string{"db"}, &container.Config{Image: "postgres:alpine"},
+		fmt.Sprintf("%s-db", CodebuildBuildId), CodebuildBuildId, []string{"db"}, &container.Config{Image: "postgres:alpine", Env: []string{"POSTGRES_PASSWORD=postgres"}, Labels: buildLabels}, (*container.HostConfig)(nil),
 	).Return(nil)
 	b := Build{
 		CodebuildBuildId: CodebuildBuildId,
@@ -0,0 +1,114 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/apppackio/codebuild-image/builder/containers"
+	"github.com/apppackio/codebuild-image/builder/redact"
+	"github.com/docker/docker/api/types/container"
+)
+
+// RunPreDestroy runs `[review_app] pre_destroy_command` (or app.json's
+// `pr-predestroy` script) in a one-off container from the review app's last
+// image, with the review app's config loaded into its environment
+func (b *Build) RunPreDestroy(image string) error {
+	command := b.preDestroyCommand()
+	if command == "" {
+		return nil
+	}
+	if image == "" {
+		return fmt.Errorf("no image has been built for the review app")
+	}
+	if err := b.ECRLogin(); err != nil {
+		return err
+	}
+	return b.runPreDestroyCommand(command, image)
+}
+
+// preDestroyCommand prefers apppack.toml, falling back to app.json which
+// hasn't been converted yet when the PR is merged or closed
+func (b *Build) preDestroyCommand() string {
+	if b.AppPackToml != nil && b.AppPackToml.ReviewApp.PreDestroyCommand != "" {
+		return b.AppPackToml.ReviewApp.PreDestroyCommand
+	}
+	if b.AppJSON != nil {
+		return b.AppJSON.Scripts["pr-predestroy"]
+	}
+	return ""
+}
+
+func (b *Build) runPreDestroyCommand(command, image string) error {
+	timeout := DefaultPreDestroyTimeout
+	if b.AppPackToml != nil {
+		var err error
+		if timeout, err = b.AppPackToml.ReviewApp.GetPreDestroyTimeout(); err != nil {
+			return err
+		}
+	}
+	env, err := b.LoadRuntimeEnv()
+	if err != nil {
+		return err
+	}
+	if err = b.containers.PullImage(image); err != nil {
+		return err
+	}
+	if err = b.containers.CreateNetwork(b.CodebuildBuildId, b.resourceLabels()); err != nil {
+		return err
+	}
+	// the build ends after the review app is destroyed, so nothing else cleans up
+	defer func() {
+		if err := b.Teardown(); err != nil {
+			b.Log().Warn().Err(err).Msg("failed to clean up pre-destroy container")
+		}
+	}()
+	var entrypoint []string
+	if b.AppPackToml == nil || b.System() == BuildpackBuildSystemKeyword {
+		entrypoint = []string{"/cnb/lifecycle/launcher"}
+	}
+	name := b.addonContainerName("predestroy")
+	b.Log().Info().Str("command", command).Msg("running review app pre-destroy command")
+	fmt.Printf("+ %s\n", command)
+	err = b.containers.RunContainer(name, b.CodebuildBuildId, nil, b.labeled(&container.Config{
+		Image:      image,
+		Cmd:        []string{"/bin/sh", "-c", command},
+		Entrypoint: entrypoint,
+		Env:        generateDockerEnvStrings(env),
+	}), nil)
+	if err != nil {
+		return err
+	}
+	// the command has all of the review app's config, so its output is masked
+	// like the build and test logs
+	stdout, stderr := redact.NewWriter(os.Stdout, b.redact), redact.NewWriter(os.Stderr, b.redact)
+	flush := func() {
+		stdout.Flush()
+		stderr.Flush()
+	}
+	logsDone := make(chan error, 1)
+	go func() {
+		logsDone <- b.containers.AttachLogs(name, stdout, stderr)
+	}()
+	exitCode, err := b.containers.WaitForExit(name, timeout)
+	if errors.Is(err, containers.ErrWaitTimeout) {
+		if err := b.containers.KillContainer(name); err != nil {
+			b.Log().Warn().Err(err).Msg("failed to kill pre-destroy container")
+		}
+		<-logsDone
+		flush()
+		return fmt.Errorf("pre-destroy command timed out after %s", timeout)
+	}
+	if err != nil {
+		return err
+	}
+	err = <-logsDone
+	flush()
+	if err != nil {
+		b.Log().Warn().Err(err).Msg("failed to read pre-destroy command output")
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("pre-destroy command failed with exit code %d", exitCode)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apppackio/codebuild-image/builder/containers"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/mock"
+)
+
+const reviewAppImage = "123456789.dkr.ecr.us-east-1.amazonaws.com/test-app:abc123"
+
+func TestRunPreDestroyCommand(t *testing.T) {
+	name := CodebuildBuildId + "-predestroy"
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetParametersByPath", "/apppack/pipelines/test-app/config/").Return(
+		map[string]string{"/apppack/pipelines/test-app/config/SECRET_KEY": "shared"}, nil,
+	)
+	mockedAWS.On("GetParametersByPath", "/apppack/pipelines/test-app/review-apps/pr/123/config/").Return(
+		map[string]string{"/apppack/pipelines/test-app/review-apps/pr/123/config/DATABASE_URL": "postgres://review"}, nil,
+	)
+	mockedState := new(MockFilesystem)
+	mockedState.On("ReadEnvFile").Return((*map[string]string)(nil), fmt.Errorf("no env file"))
+	mockedContainers := new(MockContainers)
+	mockedContainers.On("PullImage", reviewAppImage).Return(nil)
+	mockedContainers.On("CreateNetwork", CodebuildBuildId, buildLabels).Return(nil)
+	mockedContainers.On("RunContainer", name, CodebuildBuildId, []string(nil), mock.MatchedBy(func(config *container.Config) bool {
+		env := strings.Join(config.Env, " ")
+		return config.Image == reviewAppImage &&
+			config.Cmd[2] == "python manage.py dump_data" &&
+			config.Entrypoint[0] == "/cnb/lifecycle/launcher" &&
+			strings.Contains(env, "DATABASE_URL=postgres://review") &&
+			strings.Contains(env, "SECRET_KEY=shared")
+	}), (*container.HostConfig)(nil)).Return(nil)
+	mockedContainers.On("AttachLogs", name, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		fmt.Fprintln(args.Get(1).(io.Writer), "dumping postgres://review")
+	}).Return(nil)
+	mockedContainers.On("WaitForExit", name, time.Minute).Return(0, nil)
+	mockedContainers.On("ListContainers", buildLabels).Return([]containers.Resource{}, nil)
+	mockedContainers.On("ListNetworks", buildLabels).Return([]containers.Resource{}, nil)
+	b := Build{
+		Appname:          "test-app",
+		Pipeline:         true,
+		CodebuildBuildId: CodebuildBuildId,
+		PullRequest:      "pr/123",
+		AppPackToml: &AppPackToml{
+			Build:     AppPackTomlBuild{System: "buildpack"},
+			ReviewApp: AppPackTomlReviewApp{PreDestroyCommand: "python manage.py dump_data", PreDestroyTimeout: "1m"},
+		},
+		aws:        mockedAWS,
+		state:      mockedState,
+		containers: mockedContainers,
+		Ctx:        testContext,
+	}
+	stdout, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := os.Stdout
+	os.Stdout = stdout
+	err = b.runPreDestroyCommand("python manage.py dump_data", reviewAppImage)
+	os.Stdout = previous
+	if err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+	// the config is masked in the command's output
+	if output, _ := os.ReadFile(stdout.Name()); !strings.Contains(string(output), "dumping ***") {
+		t.Errorf("expected the config value to be masked, got %q", output)
+	}
+	mockedAWS.AssertExpectations(t)
+	mockedContainers.AssertExpectations(t)
+}
+
+func TestRunPreDestroyCommandFailed(t *testing.T) {
+	name := CodebuildBuildId + "-predestroy"
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetParametersByPath", mock.Anything).Return(map[string]string{}, nil)
+	mockedState := new(MockFilesystem)
+	mockedState.On("ReadEnvFile").Return((*map[string]string)(nil), fmt.Errorf("no env file"))
+	mockedContainers := new(MockContainers)
+	mockedContainers.On("PullImage", reviewAppImage).Return(nil)
+	mockedContainers.On("CreateNetwork", CodebuildBuildId, buildLabels).Return(nil)
+	mockedContainers.On("RunContainer", name, CodebuildBuildId, []string(nil), mock.Anything, mock.Anything).Return(nil)
+	mockedContainers.On("AttachLogs", name, mock.Anything, mock.Anything).Return(nil)
+	mockedContainers.On("WaitForExit", name, mock.Anything).Return(2, nil)
+	mockedContainers.On("ListContainers", buildLabels).Return([]containers.Resource{}, nil)
+	mockedContainers.On("ListNetworks", buildLabels).Return([]containers.Resource{}, nil)
+	b := Build{
+		Appname:          "test-app",
+		Pipeline:         true,
+		CodebuildBuildId: CodebuildBuildId,
+		PullRequest:      "pr/123",
+		AppPackToml:      &AppPackToml{ReviewApp: AppPackTomlReviewApp{PreDestroyCommand: "false"}},
+		aws:              mockedAWS,
+		state:            mockedState,
+		containers:       mockedContainers,
+		Ctx:              testContext,
+	}
+	err := b.runPreDestroyCommand("false", reviewAppImage)
+	if err == nil || !strings.Contains(err.Error(), "exit code 2") {
+		t.Errorf("expected exit code error, got %v", err)
+	}
+	// the container and network are cleaned up either way
+	mockedContainers.AssertExpectations(t)
+}
+
+func TestRunPreDestroyCommandTimeout(t *testing.T) {
+	name := CodebuildBuildId + "-predestroy"
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetParametersByPath", mock.Anything).Return(map[string]string{}, nil)
+	mockedState := new(MockFilesystem)
+	mockedState.On("ReadEnvFile").Return((*map[string]string)(nil), fmt.Errorf("no env file"))
+	mockedContainers := new(MockContainers)
+	mockedContainers.On("PullImage", reviewAppImage).Return(nil)
+	mockedContainers.On("CreateNetwork", CodebuildBuildId, buildLabels).Return(nil)
+	mockedContainers.On("RunContainer", name, CodebuildBuildId, []string(nil), mock.Anything, mock.Anything).Return(nil)
+	mockedContainers.On("AttachLogs", name, mock.Anything, mock.Anything).Return(nil)
+	mockedContainers.On("WaitForExit", name, time.Minute).Return(-1, containers.ErrWaitTimeout)
+	mockedContainers.On("KillContainer", name).Return(nil)
+	mockedContainers.On("ListContainers", buildLabels).Return([]containers.Resource{}, nil)
+	mockedContainers.On("ListNetworks", buildLabels).Return([]containers.Resource{}, nil)
+	b := Build{
+		Appname:          "test-app",
+		Pipeline:         true,
+		CodebuildBuildId: CodebuildBuildId,
+		PullRequest:      "pr/123",
+		AppPackToml:      &AppPackToml{ReviewApp: AppPackTomlReviewApp{PreDestroyCommand: "sleep 3600", PreDestroyTimeout: "1m"}},
+		aws:              mockedAWS,
+		state:            mockedState,
+		containers:       mockedContainers,
+		Ctx:              testContext,
+	}
+	err := b.runPreDestroyCommand("sleep 3600", reviewAppImage)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 1m0s") {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	mockedContainers.AssertExpectations(t)
+}
+
+func TestPreDestroyCommandFromAppJSON(t *testing.T) {
+	b := Build{
+		AppPackToml: &AppPackToml{},
+		AppJSON:     &AppJSON{Scripts: map[string]string{"pr-predestroy": "./bin/cleanup"}},
+	}
+	if command := b.preDestroyCommand(); command != "./bin/cleanup" {
+		t.Errorf("expected app.json pr-predestroy script, got %q", command)
+	}
+}
+
+func TestHandlePRPreDestroyFailureStillDestroys(t *testing.T) {
+	pr := "pr/123"
+	appName := "test-app"
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetParameter", fmt.Sprintf("/apppack/pipelines/%s/review-apps/%s", appName, pr)).Return(
+		fmt.Sprintf(`{"pull_request":"%s","status":"created","image":"%s"}`, pr, reviewAppImage), nil,
+	)
+	mockedAWS.On("SetParameter", mock.Anything, prStatusMatching(pr, ClosedPRStatus)).Return(nil)
+	mockedAWS.On("DescribeStack", "apppack-reviewapp-test-app123").Return(&types.Stack{}, nil)
+	mockedAWS.On("GetECRLogin").Return("", "", fmt.Errorf("AccessDeniedException"))
+	mockedAWS.On("DestroyStack", "apppack-reviewapp-test-app123").Return(nil)
+	mockedAWS.On("DeleteParametersByPath", reviewAppConfigPath(appName, pr)).Return(0, nil)
+	mockedState := emptyState()
+	b := Build{
+		Appname:               appName,
+		Pipeline:              true,
+		PullRequest:           pr,
+		CodebuildWebhookEvent: "PULL_REQUEST_CLOSED",
+		CodebuildBuildId:      CodebuildBuildId,
+		AppPackToml:           &AppPackToml{ReviewApp: AppPackTomlReviewApp{PreDestroyCommand: "./bin/cleanup"}},
+		aws:                   mockedAWS,
+		state:                 mockedState,
+		Ctx:                   testContext,
+	}
+	skip, err := b.HandlePR()
+	if err != nil {
+		t.Errorf("expected pre-destroy failure not to fail the build, got %s", err)
+	}
+	if !skip {
+		t.Error("HandlePR should skip the build when the PR is closed")
+	}
+	mockedAWS.AssertExpectations(t)
+	mockedState.AssertExpectations(t)
+}
@@ -0,0 +1,69 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// BranchDeletedEvent tears down a branch preview. CodeBuild doesn't build
+// deleted branches, so it is sent by a forwarded webhook or a manual build.
+const BranchDeletedEvent = "BRANCH_DELETED"
+
+// maxBranchNameLength keeps preview stack names well under CloudFormation's limit
+const maxBranchNameLength = 40
+
+var nonAlphanumericRegex = regexp.MustCompile(`[^a-z0-9]+`)
+
+// sanitizeBranchName converts a branch name into something valid in both stack
+// and parameter names. Long names are truncated with a hash to keep them unique.
+func sanitizeBranchName(branch string) string {
+	name := strings.Trim(nonAlphanumericRegex.ReplaceAllString(strings.ToLower(branch), "-"), "-")
+	if len(name) > maxBranchNameLength {
+		sum := sha256.Sum256([]byte(branch))
+		name = strings.TrimRight(name[:maxBranchNameLength-9], "-") + "-" + hex.EncodeToString(sum[:])[:8]
+	}
+	return name
+}
+
+// previewBranch returns the branch being built if it matches one of the
+// `[review_app] branches` globs. Branches without a letter or digit in their
+// name can't be named in parameters and never have a preview.
+func (b *Build) previewBranch() string {
+	branch := b.HeadRef
+	if branch == "" {
+		branch = strings.TrimPrefix(b.Branch, "refs/heads/")
+	}
+	if sanitizeBranchName(branch) == "" || b.AppPackToml == nil {
+		return ""
+	}
+	for _, glob := range b.AppPackToml.ReviewApp.Branches {
+		if ok, _ := path.Match(glob, branch); ok {
+			return branch
+		}
+	}
+	// the branch's apppack.toml can't be trusted once it is deleted, so any
+	// branch with a preview is torn down
+	if b.CodebuildWebhookEvent == BranchDeletedEvent {
+		return branch
+	}
+	return ""
+}
+
+// reviewAppID identifies the review app in parameter and stack names: `pr/{number}`
+// for pull requests and `branch/{sanitized name}` for branch previews
+func (b *Build) reviewAppID() string {
+	if b.PullRequest != "" {
+		return b.PullRequest
+	}
+	if branch := b.previewBranch(); branch != "" {
+		return "branch/" + sanitizeBranchName(branch)
+	}
+	return ""
+}
+
+func isBranchPreview(id string) bool {
+	return strings.HasPrefix(id, "branch/")
+}
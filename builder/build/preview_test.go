@@ -0,0 +1,169 @@
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/apppackio/codebuild-image/builder/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSanitizeBranchName(t *testing.T) {
+	for branch, expected := range map[string]string{
+		"release/2.0":         "release-2-0",
+		"preview/Fix_Login!!": "preview-fix-login",
+		"-feature--x-":        "feature-x",
+	} {
+		if actual := sanitizeBranchName(branch); actual != expected {
+			t.Errorf("expected %s for %s, got %s", expected, branch, actual)
+		}
+	}
+	long := "preview/" + strings.Repeat("a", 60)
+	name := sanitizeBranchName(long)
+	if len(name) > maxBranchNameLength || name == sanitizeBranchName(long+"b") {
+		t.Errorf("expected long names to be truncated uniquely, got %s", name)
+	}
+}
+
+func TestReviewAppIDBranch(t *testing.T) {
+	b := Build{
+		Appname:               "test-app",
+		Pipeline:              true,
+		HeadRef:               "release/2.0",
+		CodebuildWebhookEvent: "PUSH",
+		CodebuildBuildId:      CodebuildBuildId,
+		AppPackToml: &AppPackToml{ReviewApp: AppPackTomlReviewApp{
+			Branches: []string{"release/*", "preview/*"},
+		}},
+		Ctx: testContext,
+	}
+	if id := b.reviewAppID(); id != "branch/release-2-0" {
+		t.Errorf("expected branch/release-2-0, got %s", id)
+	}
+	if name := b.reviewAppStackName(); name != "apppack-reviewapp-test-app-branch-release-2-0" {
+		t.Errorf("unexpected stack name %s", name)
+	}
+	paths := b.ConfigParameterPaths()
+	if paths[1] != "/apppack/pipelines/test-app/review-apps/branch/release-2-0/config/" {
+		t.Errorf("unexpected config path %s", paths[1])
+	}
+	unmatched := b
+	unmatched.HeadRef = "feature/login"
+	if id := unmatched.reviewAppID(); id != "" {
+		t.Errorf("expected no preview for an unmatched branch, got %s", id)
+	}
+	// a PR takes precedence over its head branch
+	b.PullRequest = "pr/5"
+	if id := b.reviewAppID(); id != "pr/5" {
+		t.Errorf("expected pr/5, got %s", id)
+	}
+}
+
+func TestHandlePRBranchPush(t *testing.T) {
+	param := "/apppack/pipelines/test-app/review-apps/branch/preview-search"
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetParameter", param).Return("", aws.ErrParameterNotFound)
+	mockedAWS.On("SetParameter", param, prStatusMatching("branch/preview-search", OpenPRStatus)).Return(nil)
+	mockedState := emptyState()
+	b := Build{
+		Appname:               "test-app",
+		Pipeline:              true,
+		HeadRef:               "preview/search",
+		CodebuildWebhookEvent: "PUSH",
+		CodebuildBuildId:      CodebuildBuildId,
+		AppPackToml: &AppPackToml{ReviewApp: AppPackTomlReviewApp{
+			Branches: []string{"release/*", "preview/*"},
+		}},
+		aws:   mockedAWS,
+		state: mockedState,
+		Ctx:   testContext,
+	}
+	skip, err := b.HandlePR()
+	if err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+	if !skip {
+		t.Error("HandlePR should skip the build until the preview is created")
+	}
+	mockedAWS.AssertExpectations(t)
+	mockedState.AssertExpectations(t)
+}
+
+func TestHandlePRBranchDeleted(t *testing.T) {
+	param := "/apppack/pipelines/test-app/review-apps/branch/hotfix"
+	stack := "apppack-reviewapp-test-app-branch-hotfix"
+	mockedAWS := reviewAppStatus("test-app", "branch/hotfix", CreatedPRStatus)
+	mockedAWS.On("SetParameter", param, prStatusMatching("branch/hotfix", ClosedPRStatus)).Return(nil)
+	mockedAWS.On("DescribeStack", stack).Return(&types.Stack{}, nil)
+	mockedAWS.On("DestroyStack", stack).Return(nil)
+	mockedAWS.On("DeleteParametersByPath", param+"/config/").Return(1, nil)
+	mockedState := emptyState()
+	// the deleted branch no longer matches the globs, but still has a preview
+	b := Build{
+		Appname:               "test-app",
+		Pipeline:              true,
+		HeadRef:               "hotfix",
+		CodebuildWebhookEvent: BranchDeletedEvent,
+		CodebuildBuildId:      CodebuildBuildId,
+		AppPackToml: &AppPackToml{ReviewApp: AppPackTomlReviewApp{
+			Branches: []string{"release/*", "preview/*"},
+		}},
+		aws:   mockedAWS,
+		state: mockedState,
+		Ctx:   testContext,
+	}
+	skip, err := b.HandlePR()
+	if err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+	if !skip {
+		t.Error("HandlePR should skip the build when the branch is deleted")
+	}
+	mockedAWS.AssertExpectations(t)
+	mockedState.AssertExpectations(t)
+}
+
+func TestHandlePRBranchDeletedWithoutPreview(t *testing.T) {
+	param := "/apppack/pipelines/test-app/review-apps/branch/feature-login"
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetParameter", param).Return("", aws.ErrParameterNotFound)
+	mockedState := emptyState()
+	b := Build{
+		Appname:               "test-app",
+		Pipeline:              true,
+		HeadRef:               "feature/login",
+		CodebuildWebhookEvent: BranchDeletedEvent,
+		CodebuildBuildId:      CodebuildBuildId,
+		AppPackToml:           &AppPackToml{ReviewApp: AppPackTomlReviewApp{Branches: []string{"preview/*"}}},
+		aws:                   mockedAWS,
+		state:                 mockedState,
+		Ctx:                   testContext,
+	}
+	skip, err := b.HandlePR()
+	if err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+	if !skip {
+		t.Error("HandlePR should skip the build when the branch is deleted")
+	}
+	// no status is written and nothing is torn down
+	mockedAWS.AssertNotCalled(t, "SetParameter", mock.Anything, mock.Anything)
+	mockedAWS.AssertNotCalled(t, "DeleteParametersByPath", mock.Anything)
+	mockedAWS.AssertExpectations(t)
+	mockedState.AssertExpectations(t)
+}
+
+func TestReviewAppIDEmptyBranchName(t *testing.T) {
+	b := Build{
+		HeadRef:     "___",
+		AppPackToml: &AppPackToml{ReviewApp: AppPackTomlReviewApp{Branches: []string{"*"}}},
+	}
+	if id := b.reviewAppID(); id != "" {
+		t.Errorf("expected no preview for a branch name without letters or digits, got %q", id)
+	}
+	b.CodebuildWebhookEvent = BranchDeletedEvent
+	if id := b.reviewAppID(); id != "" {
+		t.Errorf("expected no preview to tear down, got %q", id)
+	}
+}
@@ -0,0 +1,124 @@
+package build
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Source providers
+const (
+	GitHubProvider    = "github"
+	GitLabProvider    = "gitlab"
+	BitbucketProvider = "bitbucket"
+)
+
+// Webhook is a CodeBuild webhook event normalized across source providers
+type Webhook struct {
+	Provider string
+	// Event is one of the PULL_REQUEST_* events CodeBuild uses for GitHub
+	Event string
+	// PullRequest is `pr/{number}`, or empty if the build isn't for a pull request
+	PullRequest string
+	// HeadRef and BaseRef are branch names without the `refs/heads/` prefix
+	HeadRef string
+	BaseRef string
+}
+
+type sourceProvider struct {
+	name string
+	// events maps the provider's own event names to the normalized ones
+	events map[string]string
+	// pullRequestRefs match a source version or ref containing the pull request number
+	pullRequestRefs []*regexp.Regexp
+}
+
+// CodeBuild reports pull requests as `pr/{number}` for every provider, but
+// builds started outside a webhook only have the provider's own refs
+var sourceProviders = map[string]sourceProvider{
+	GitHubProvider: {
+		name: GitHubProvider,
+		pullRequestRefs: []*regexp.Regexp{
+			regexp.MustCompile(`^pr/(\d+)$`),
+			regexp.MustCompile(`^refs/pull/(\d+)/(head|merge)$`),
+		},
+	},
+	GitLabProvider: {
+		name: GitLabProvider,
+		pullRequestRefs: []*regexp.Regexp{
+			regexp.MustCompile(`^pr/(\d+)$`),
+			regexp.MustCompile(`^refs/merge-requests/(\d+)/(head|merge)$`),
+		},
+	},
+	BitbucketProvider: {
+		name: BitbucketProvider,
+		// Bitbucket event keys, for builds started from a forwarded webhook
+		events: map[string]string{
+			"pullrequest:created":   "PULL_REQUEST_CREATED",
+			"pullrequest:updated":   "PULL_REQUEST_UPDATED",
+			"pullrequest:fulfilled": "PULL_REQUEST_MERGED",
+			"pullrequest:rejected":  "PULL_REQUEST_CLOSED",
+		},
+		pullRequestRefs: []*regexp.Regexp{
+			regexp.MustCompile(`^pr/(\d+)$`),
+			regexp.MustCompile(`^refs/pull-requests/(\d+)/(from|merge)$`),
+		},
+	},
+}
+
+// detectProvider uses the host of the repository URL, defaulting to GitHub.
+// Self-hosted GitLab is recognized by a host starting with `gitlab.`.
+func detectProvider(repoURL string) sourceProvider {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return sourceProviders[GitHubProvider]
+	}
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case host == "gitlab.com" || strings.HasPrefix(host, "gitlab."):
+		return sourceProviders[GitLabProvider]
+	case host == "bitbucket.org":
+		return sourceProviders[BitbucketProvider]
+	default:
+		return sourceProviders[GitHubProvider]
+	}
+}
+
+func (p sourceProvider) event(event string) string {
+	if normalized, ok := p.events[event]; ok {
+		return normalized
+	}
+	return event
+}
+
+func (p sourceProvider) pullRequest(refs ...string) string {
+	for _, ref := range refs {
+		for _, re := range p.pullRequestRefs {
+			if m := re.FindStringSubmatch(ref); m != nil {
+				return "pr/" + m[1]
+			}
+		}
+	}
+	return ""
+}
+
+// ParseWebhook normalizes the CodeBuild webhook environment for the repository's provider
+func ParseWebhook(getenv func(string) string) Webhook {
+	p := detectProvider(getenv("CODEBUILD_SOURCE_REPO_URL"))
+	event := getenv("CODEBUILD_WEBHOOK_EVENT")
+	if event == "" {
+		event = "PULL_REQUEST_UPDATED"
+	}
+	headRef := getenv("CODEBUILD_WEBHOOK_HEAD_REF")
+	return Webhook{
+		Provider: p.name,
+		Event:    p.event(event),
+		PullRequest: p.pullRequest(
+			getenv("CODEBUILD_WEBHOOK_TRIGGER"),
+			getenv("CODEBUILD_SOURCE_VERSION"),
+			headRef,
+		),
+		HeadRef: strings.TrimPrefix(headRef, "refs/heads/"),
+		BaseRef: strings.TrimPrefix(getenv("CODEBUILD_WEBHOOK_BASE_REF"), "refs/heads/"),
+	}
+}
@@ -0,0 +1,95 @@
+package build
+
+import "testing"
+
+func webhookEnv(env map[string]string) func(string) string {
+	return func(key string) string { return env[key] }
+}
+
+func TestParseWebhookGitHub(t *testing.T) {
+	webhook := ParseWebhook(webhookEnv(map[string]string{
+		"CODEBUILD_SOURCE_REPO_URL":  "https://github.com/apppackio/example.git",
+		"CODEBUILD_WEBHOOK_EVENT":    "PULL_REQUEST_MERGED",
+		"CODEBUILD_SOURCE_VERSION":   "pr/42",
+		"CODEBUILD_WEBHOOK_HEAD_REF": "refs/heads/feature/login",
+		"CODEBUILD_WEBHOOK_BASE_REF": "refs/heads/main",
+	}))
+	expected := Webhook{
+		Provider:    GitHubProvider,
+		Event:       "PULL_REQUEST_MERGED",
+		PullRequest: "pr/42",
+		HeadRef:     "feature/login",
+		BaseRef:     "main",
+	}
+	if webhook != expected {
+		t.Errorf("expected %+v, got %+v", expected, webhook)
+	}
+}
+
+func TestParseWebhookGitLab(t *testing.T) {
+	webhook := ParseWebhook(webhookEnv(map[string]string{
+		"CODEBUILD_SOURCE_REPO_URL":  "https://gitlab.com/apppackio/example.git",
+		"CODEBUILD_WEBHOOK_EVENT":    "PULL_REQUEST_CREATED",
+		"CODEBUILD_SOURCE_VERSION":   "0123456789abcdef",
+		"CODEBUILD_WEBHOOK_HEAD_REF": "refs/merge-requests/7/head",
+	}))
+	if webhook.Provider != GitLabProvider || webhook.PullRequest != "pr/7" || webhook.Event != "PULL_REQUEST_CREATED" {
+		t.Errorf("expected GitLab merge request pr/7, got %+v", webhook)
+	}
+}
+
+func TestParseWebhookBitbucket(t *testing.T) {
+	webhook := ParseWebhook(webhookEnv(map[string]string{
+		"CODEBUILD_SOURCE_REPO_URL":  "https://bitbucket.org/apppackio/example.git",
+		"CODEBUILD_WEBHOOK_EVENT":    "pullrequest:rejected",
+		"CODEBUILD_WEBHOOK_TRIGGER":  "pr/9",
+		"CODEBUILD_SOURCE_VERSION":   "0123456789abcdef",
+		"CODEBUILD_WEBHOOK_HEAD_REF": "refs/heads/fix-typo",
+		"CODEBUILD_WEBHOOK_BASE_REF": "refs/heads/develop",
+	}))
+	expected := Webhook{
+		Provider:    BitbucketProvider,
+		Event:       "PULL_REQUEST_CLOSED",
+		PullRequest: "pr/9",
+		HeadRef:     "fix-typo",
+		BaseRef:     "develop",
+	}
+	if webhook != expected {
+		t.Errorf("expected %+v, got %+v", expected, webhook)
+	}
+	webhook = ParseWebhook(webhookEnv(map[string]string{
+		"CODEBUILD_SOURCE_REPO_URL": "https://bitbucket.org/apppackio/example.git",
+		"CODEBUILD_SOURCE_VERSION":  "refs/pull-requests/12/from",
+	}))
+	if webhook.PullRequest != "pr/12" || webhook.Event != "PULL_REQUEST_UPDATED" {
+		t.Errorf("expected Bitbucket pull request pr/12 from its ref, got %+v", webhook)
+	}
+}
+
+func TestParseWebhookNotPullRequest(t *testing.T) {
+	webhook := ParseWebhook(webhookEnv(map[string]string{
+		"CODEBUILD_SOURCE_REPO_URL": "https://github.com/apppackio/example.git",
+		"CODEBUILD_SOURCE_VERSION":  "refs/heads/main",
+		"CODEBUILD_WEBHOOK_EVENT":   "PUSH",
+	}))
+	if webhook.PullRequest != "" {
+		t.Errorf("expected no pull request, got %s", webhook.PullRequest)
+	}
+}
+
+func TestDetectProvider(t *testing.T) {
+	for repoURL, expected := range map[string]string{
+		"https://github.com/acme/gitlab-importer.git":    GitHubProvider,
+		"https://github.com/bitbucket/example.git":       GitHubProvider,
+		"https://GitLab.com/acme/example.git":            GitLabProvider,
+		"https://gitlab.example.com/acme/example.git":    GitLabProvider,
+		"https://mygitlab.example.com/acme/example.git":  GitHubProvider,
+		"https://bitbucket.org/acme/example.git":         BitbucketProvider,
+		"https://user@bitbucket.org/acme/example.git":    BitbucketProvider,
+		"https://git-codecommit.us-east-1.amazonaws.com": GitHubProvider,
+	} {
+		if provider := detectProvider(repoURL).name; provider != expected {
+			t.Errorf("expected %s for %s, got %s", expected, repoURL, provider)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package build
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxPRStatusHistory bounds the history kept in the review app's status
+// parameter so it stays under the Parameter Store size limit
+const MaxPRStatusHistory = 10
+
+// ReviewAppCreatedEvent is recorded when the CLI triggers a build to create a review app
+const ReviewAppCreatedEvent = "REVIEW_APP_CREATED"
+
+// prTransitions lists the statuses a review app can move to from each status.
+// An empty status means no status has been recorded yet.
+var prTransitions = map[string][]string{
+	"":               {OpenPRStatus, ReopenedPRStatus, CreatedPRStatus, MergedPRStatus, ClosedPRStatus},
+	OpenPRStatus:     {CreatedPRStatus, MergedPRStatus, ClosedPRStatus},
+	ReopenedPRStatus: {CreatedPRStatus, MergedPRStatus, ClosedPRStatus},
+	CreatedPRStatus:  {MergedPRStatus, ClosedPRStatus},
+	// review apps pruned for inactivity are closed while the PR is still open
+	ClosedPRStatus: {ReopenedPRStatus, MergedPRStatus},
+	MergedPRStatus: {},
+}
+
+// PRStatusHistoryEntry records a status change and the build event which caused it
+type PRStatusHistoryEntry struct {
+	Status    string    `json:"status"`
+	Event     string    `json:"event"`
+	BuildID   string    `json:"build_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// InvalidPRTransitionError is returned when an event would move a review app
+// to a status it can't reach from its current one
+type InvalidPRTransitionError struct {
+	From  string
+	To    string
+	Event string
+}
+
+func (e *InvalidPRTransitionError) Error() string {
+	from := e.From
+	if from == "" {
+		from = "(none)"
+	}
+	return fmt.Sprintf("invalid review app status transition %s -> %s (event %s)", from, e.To, e.Event)
+}
+
+// CanTransition reports whether a review app may move between the statuses
+func CanTransition(from, to string) bool {
+	for _, s := range prTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition moves the status to `to`, recording the change in the history
+func (s *PRStatus) Transition(to, event, buildID string, now time.Time) error {
+	if !CanTransition(s.Status, to) {
+		return &InvalidPRTransitionError{From: s.Status, To: to, Event: event}
+	}
+	s.Status = to
+	if to != MergedPRStatus && to != ClosedPRStatus {
+		s.ArchivedAt = nil
+	}
+	s.History = append(s.History, PRStatusHistoryEntry{
+		Status:    to,
+		Event:     event,
+		BuildID:   buildID,
+		Timestamp: now.UTC(),
+	})
+	if len(s.History) > MaxPRStatusHistory {
+		s.History = s.History[len(s.History)-MaxPRStatusHistory:]
+	}
+	return nil
+}
+
+// prEvent is the event recorded in the status history for this build
+func (b *Build) prEvent() string {
+	if b.CreateReviewApp {
+		return ReviewAppCreatedEvent
+	}
+	return b.CodebuildWebhookEvent
+}
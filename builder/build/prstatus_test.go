@@ -0,0 +1,146 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCanTransition(t *testing.T) {
+	allowed := [][2]string{
+		{"", OpenPRStatus},
+		{OpenPRStatus, CreatedPRStatus},
+		{CreatedPRStatus, MergedPRStatus},
+		{CreatedPRStatus, ClosedPRStatus},
+		{ClosedPRStatus, ReopenedPRStatus},
+		{ReopenedPRStatus, CreatedPRStatus},
+	}
+	for _, tr := range allowed {
+		if !CanTransition(tr[0], tr[1]) {
+			t.Errorf("expected %q -> %q to be allowed", tr[0], tr[1])
+		}
+	}
+	rejected := [][2]string{
+		{MergedPRStatus, CreatedPRStatus},
+		{MergedPRStatus, ReopenedPRStatus},
+		{ClosedPRStatus, CreatedPRStatus},
+		{CreatedPRStatus, OpenPRStatus},
+	}
+	for _, tr := range rejected {
+		if CanTransition(tr[0], tr[1]) {
+			t.Errorf("expected %q -> %q to be rejected", tr[0], tr[1])
+		}
+	}
+}
+
+func TestPRStatusTransition(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	status := PRStatus{PullRequest: "pr/123", Status: CreatedPRStatus}
+	if err := status.Transition(MergedPRStatus, "PULL_REQUEST_MERGED", CodebuildBuildId, now); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	expected := PRStatusHistoryEntry{Status: MergedPRStatus, Event: "PULL_REQUEST_MERGED", BuildID: CodebuildBuildId, Timestamp: now}
+	if status.Status != MergedPRStatus || len(status.History) != 1 || status.History[0] != expected {
+		t.Errorf("expected merged status with history, got %v", status)
+	}
+	err := status.Transition(CreatedPRStatus, ReviewAppCreatedEvent, CodebuildBuildId, now)
+	var transitionErr *InvalidPRTransitionError
+	if !errors.As(err, &transitionErr) {
+		t.Fatalf("expected InvalidPRTransitionError, got %v", err)
+	}
+	if status.Status != MergedPRStatus || len(status.History) != 1 {
+		t.Errorf("expected rejected transition to leave the status unchanged, got %v", status)
+	}
+}
+
+func TestPRStatusHistoryBounded(t *testing.T) {
+	status := PRStatus{PullRequest: "pr/123"}
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	statuses := []string{ClosedPRStatus, ReopenedPRStatus}
+	for i := 0; i < MaxPRStatusHistory+5; i++ {
+		if err := status.Transition(statuses[i%2], fmt.Sprintf("event-%d", i), CodebuildBuildId, start.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+	}
+	if len(status.History) != MaxPRStatusHistory {
+		t.Fatalf("expected %d history entries, got %d", MaxPRStatusHistory, len(status.History))
+	}
+	if status.History[0].Event != "event-5" || status.History[MaxPRStatusHistory-1].Event != "event-14" {
+		t.Errorf("expected the oldest entries to be dropped, got %v", status.History)
+	}
+}
+
+func TestHandlePRMergedIgnoresCreate(t *testing.T) {
+	pr := "pr/123"
+	appName := "test-app"
+	mockedAWS := reviewAppStatus(appName, pr, MergedPRStatus)
+	mockedState := emptyState()
+	b := Build{
+		Appname:          appName,
+		Pipeline:         true,
+		PullRequest:      pr,
+		CreateReviewApp:  true,
+		CodebuildBuildId: CodebuildBuildId,
+		aws:              mockedAWS,
+		state:            mockedState,
+		Ctx:              testContext,
+	}
+	// the merged status stands and nothing is built
+	skip, err := b.HandlePR()
+	if err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+	if !skip {
+		t.Error("expected the build to be skipped")
+	}
+	mockedAWS.AssertNotCalled(t, "SetParameter", mock.Anything, mock.Anything)
+	mockedAWS.AssertExpectations(t)
+	mockedState.AssertExpectations(t)
+}
+
+func TestHandlePRRetriedOpenEvent(t *testing.T) {
+	pr := "pr/123"
+	appName := "test-app"
+	mockedAWS := reviewAppStatus(appName, pr, CreatedPRStatus)
+	b := Build{
+		Appname:               appName,
+		Pipeline:              true,
+		PullRequest:           pr,
+		CodebuildWebhookEvent: "PULL_REQUEST_CREATED",
+		aws:                   mockedAWS,
+		Ctx:                   testContext,
+	}
+	// a retry of the PR's first build keeps its event after the review app was created
+	skip, err := b.HandlePR()
+	if err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+	if skip {
+		t.Error("expected the review app to be built")
+	}
+	mockedAWS.AssertNotCalled(t, "SetParameter", mock.Anything, mock.Anything)
+	mockedAWS.AssertExpectations(t)
+}
+
+func TestHandlePRStatusUnreadable(t *testing.T) {
+	pr := "pr/123"
+	appName := "test-app"
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetParameter", fmt.Sprintf("/apppack/pipelines/%s/review-apps/%s", appName, pr)).Return("", fmt.Errorf("ThrottlingException: rate exceeded"))
+	b := Build{
+		Appname:               appName,
+		Pipeline:              true,
+		PullRequest:           pr,
+		CodebuildWebhookEvent: "PULL_REQUEST_UPDATED",
+		aws:                   mockedAWS,
+		Ctx:                   testContext,
+	}
+	// the stored status and its history aren't replaced
+	if _, err := b.HandlePR(); err == nil {
+		t.Error("expected the error reading the status to be returned")
+	}
+	mockedAWS.AssertNotCalled(t, "SetParameter", mock.Anything, mock.Anything)
+}
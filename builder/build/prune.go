@@ -0,0 +1,97 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/apppackio/codebuild-image/builder/aws"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultReviewAppTTL is how long a review app can go without activity before it is pruned
+const DefaultReviewAppTTL = 14 * 24 * time.Hour
+
+// ReviewAppPrunedEvent is recorded when an idle review app is pruned
+const ReviewAppPrunedEvent = "REVIEW_APP_PRUNED"
+
+// WasPruned reports whether the review app was closed for inactivity rather than by the PR
+func (s *PRStatus) WasPruned() bool {
+	if s.Status != ClosedPRStatus || len(s.History) == 0 {
+		return false
+	}
+	return s.History[len(s.History)-1].Event == ReviewAppPrunedEvent
+}
+
+// lastActivity falls back to the history for statuses written before LastActivity was added
+func (s *PRStatus) lastActivity() time.Time {
+	if !s.LastActivity.IsZero() {
+		return s.LastActivity
+	}
+	if len(s.History) > 0 {
+		return s.History[len(s.History)-1].Timestamp
+	}
+	return time.Time{}
+}
+
+// PrunedReviewApp describes a review app which was (or in a dry run, would be) pruned
+type PrunedReviewApp struct {
+	PullRequest string
+	Idle        time.Duration
+}
+
+// PruneReviewApps destroys the stacks of review apps with no activity for
+// longer than ttl and marks their PRs closed. The pre-destroy command is not
+// run. With dryRun, the review apps are only reported.
+func PruneReviewApps(ctx context.Context, a aws.AWSInterface, appName, buildID string, ttl time.Duration, dryRun bool) ([]PrunedReviewApp, error) {
+	logger := log.Ctx(ctx)
+	now := time.Now()
+	params, ids, err := reviewAppStatuses(a, appName)
+	if err != nil {
+		return nil, err
+	}
+	pruned := []PrunedReviewApp{}
+	var errs []error
+	for _, pr := range ids {
+		var status PRStatus
+		if err := json.Unmarshal([]byte(params[pr]), &status); err != nil {
+			logger.Warn().Err(err).Str("pr", pr).Msg("unable to read review app status")
+			continue
+		}
+		if status.Status != CreatedPRStatus {
+			continue
+		}
+		lastActivity := status.lastActivity()
+		if lastActivity.IsZero() {
+			logger.Debug().Str("pr", pr).Msg("review app has no recorded activity")
+			continue
+		}
+		idle := now.Sub(lastActivity)
+		if idle <= ttl {
+			continue
+		}
+		event := logger.Info().Str("pr", pr).Str("idle", idle.Round(time.Minute).String())
+		if dryRun {
+			event.Msg("would prune idle review app")
+			pruned = append(pruned, PrunedReviewApp{PullRequest: pr, Idle: idle})
+			continue
+		}
+		event.Msg("pruning idle review app")
+		if err := a.DestroyStack(reviewAppStackName(appName, pr)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", pr, err))
+			continue
+		}
+		if err := status.Transition(ClosedPRStatus, ReviewAppPrunedEvent, buildID, now); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", pr, err))
+			continue
+		}
+		if err := writePRStatus(a, reviewAppParameterName(appName, pr), &status); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", pr, err))
+			continue
+		}
+		pruned = append(pruned, PrunedReviewApp{PullRequest: pr, Idle: idle})
+	}
+	return pruned, errors.Join(errs...)
+}
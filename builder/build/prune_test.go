@@ -0,0 +1,123 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+const (
+	reviewAppsPath     = "/apppack/pipelines/test-app/review-apps/pr/"
+	branchPreviewsPath = "/apppack/pipelines/test-app/review-apps/branch/"
+)
+
+func prStatusParameter(t *testing.T, status string, lastActivity time.Time) string {
+	value, err := json.Marshal(PRStatus{Status: status, LastActivity: lastActivity})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(value)
+}
+
+func reviewAppsAWS(t *testing.T) *MockAWS {
+	idle := time.Now().Add(-30 * 24 * time.Hour)
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetParametersByPath", reviewAppsPath).Return(map[string]string{
+		reviewAppsPath + "1": prStatusParameter(t, CreatedPRStatus, idle),
+		reviewAppsPath + "2": prStatusParameter(t, CreatedPRStatus, time.Now().Add(-time.Hour)),
+		reviewAppsPath + "3": prStatusParameter(t, OpenPRStatus, idle),
+		reviewAppsPath + "4": prStatusParameter(t, MergedPRStatus, idle),
+		reviewAppsPath + "5": "not json",
+	}, nil)
+	mockedAWS.On("GetParametersByPath", branchPreviewsPath).Return(map[string]string{
+		branchPreviewsPath + "release-2-0": prStatusParameter(t, CreatedPRStatus, idle),
+	}, nil)
+	return mockedAWS
+}
+
+func TestPruneReviewApps(t *testing.T) {
+	mockedAWS := reviewAppsAWS(t)
+	pruned := mock.MatchedBy(func(value string) bool {
+		var status PRStatus
+		if err := json.Unmarshal([]byte(value), &status); err != nil {
+			return false
+		}
+		return status.WasPruned() && status.History[0].BuildID == CodebuildBuildId && time.Since(status.LastActivity) < time.Minute
+	})
+	mockedAWS.On("DestroyStack", "apppack-reviewapp-test-app-branch-release-2-0").Return(nil)
+	mockedAWS.On("SetParameter", branchPreviewsPath+"release-2-0", pruned).Return(nil)
+	mockedAWS.On("DestroyStack", "apppack-reviewapp-test-app1").Return(nil)
+	mockedAWS.On("SetParameter", reviewAppsPath+"1", pruned).Return(nil)
+	apps, err := PruneReviewApps(testContext, mockedAWS, "test-app", CodebuildBuildId, DefaultReviewAppTTL, false)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if len(apps) != 2 || apps[0].PullRequest != "branch/release-2-0" || apps[1].PullRequest != "pr/1" {
+		t.Errorf("expected the branch preview and pr/1 to be pruned, got %v", apps)
+	}
+	mockedAWS.AssertExpectations(t)
+}
+
+func TestPruneReviewAppsDryRun(t *testing.T) {
+	mockedAWS := reviewAppsAWS(t)
+	pruned, err := PruneReviewApps(testContext, mockedAWS, "test-app", CodebuildBuildId, DefaultReviewAppTTL, true)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if len(pruned) != 2 {
+		t.Errorf("expected the branch preview and pr/1 to be reported, got %v", pruned)
+	}
+	mockedAWS.AssertNotCalled(t, "DestroyStack", mock.Anything)
+	mockedAWS.AssertNotCalled(t, "SetParameter", mock.Anything, mock.Anything)
+}
+
+func TestPruneReviewAppsDestroyFailed(t *testing.T) {
+	mockedAWS := reviewAppsAWS(t)
+	mockedAWS.On("DestroyStack", "apppack-reviewapp-test-app-branch-release-2-0").Return(fmt.Errorf("AccessDenied"))
+	mockedAWS.On("DestroyStack", "apppack-reviewapp-test-app1").Return(fmt.Errorf("AccessDenied"))
+	pruned, err := PruneReviewApps(testContext, mockedAWS, "test-app", CodebuildBuildId, DefaultReviewAppTTL, false)
+	if err == nil {
+		t.Error("expected error when the stack can't be destroyed")
+	}
+	if len(pruned) != 0 {
+		t.Errorf("expected nothing to be pruned, got %v", pruned)
+	}
+	// the status is left as created so the next run tries again
+	mockedAWS.AssertNotCalled(t, "SetParameter", mock.Anything, mock.Anything)
+}
+
+func TestHandlePRPushAfterPrune(t *testing.T) {
+	pr := "pr/123"
+	appName := "test-app"
+	status := PRStatus{PullRequest: pr, Status: CreatedPRStatus}
+	if err := status.Transition(ClosedPRStatus, ReviewAppPrunedEvent, "", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	value, _ := json.Marshal(status)
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetParameter", reviewAppParameterName(appName, pr)).Return(string(value), nil)
+	mockedAWS.On("SetParameter", reviewAppParameterName(appName, pr), prStatusMatching(pr, ReopenedPRStatus)).Return(nil)
+	mockedState := emptyState()
+	b := Build{
+		Appname:               appName,
+		Pipeline:              true,
+		PullRequest:           pr,
+		CodebuildWebhookEvent: "PULL_REQUEST_UPDATED",
+		CodebuildBuildId:      CodebuildBuildId,
+		aws:                   mockedAWS,
+		state:                 mockedState,
+		Ctx:                   testContext,
+	}
+	skip, err := b.HandlePR()
+	if err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+	if !skip {
+		t.Error("HandlePR should skip the build until the review app is created again")
+	}
+	mockedAWS.AssertExpectations(t)
+	mockedState.AssertExpectations(t)
+}
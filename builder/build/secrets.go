@@ -0,0 +1,86 @@
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/apppackio/codebuild-image/builder/aws"
+)
+
+const (
+	secretsManagerDynamicPrefix   = "{{resolve:secretsmanager:"
+	secretsManagerReferencePrefix = "/aws/reference/secretsmanager/"
+	// an ARN secret ID is arn:partition:secretsmanager:region:account:secret:name
+	secretARNParts = 7
+)
+
+// parseSecretReference recognizes config values pointing at Secrets Manager,
+// either a CloudFormation style dynamic reference,
+// {{resolve:secretsmanager:secret-id:SecretString:json-key:version-stage:version-id}},
+// or the Parameter Store reference path /aws/reference/secretsmanager/secret-id.
+// ok is false for any other value.
+func parseSecretReference(value string) (ref *aws.SecretReference, ok bool, err error) {
+	if strings.HasPrefix(value, secretsManagerReferencePrefix) {
+		id := strings.TrimPrefix(value, secretsManagerReferencePrefix)
+		if id == "" {
+			return nil, true, fmt.Errorf("missing secret ID in %s", value)
+		}
+		return &aws.SecretReference{SecretID: id}, true, nil
+	}
+	if !strings.HasPrefix(value, secretsManagerDynamicPrefix) {
+		return nil, false, nil
+	}
+	if !strings.HasSuffix(value, "}}") {
+		return nil, true, fmt.Errorf("unterminated secretsmanager reference")
+	}
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(value, secretsManagerDynamicPrefix), "}}"), ":")
+	idParts := 1
+	if parts[0] == "arn" {
+		idParts = secretARNParts
+	}
+	if len(parts) < idParts || parts[idParts-1] == "" {
+		return nil, true, fmt.Errorf("missing secret ID in secretsmanager reference")
+	}
+	ref = &aws.SecretReference{SecretID: strings.Join(parts[:idParts], ":")}
+	rest := parts[idParts:]
+	if len(rest) > 4 {
+		return nil, true, fmt.Errorf("too many fields in secretsmanager reference")
+	}
+	// the optional fields are positional, so missing ones are empty strings
+	rest = append(rest, make([]string, 4-len(rest))...)
+	if rest[0] != "" && rest[0] != "SecretString" {
+		return nil, true, fmt.Errorf("unsupported secret type %q, only SecretString is supported", rest[0])
+	}
+	ref.JSONKey, ref.VersionStage, ref.VersionID = rest[1], rest[2], rest[3]
+	if ref.VersionStage != "" && ref.VersionID != "" {
+		return nil, true, fmt.Errorf("a secretsmanager reference can't have both a version stage and a version ID")
+	}
+	return ref, true, nil
+}
+
+// resolveSecretReferences replaces config values which reference Secrets
+// Manager with the secret value
+func (b *Build) resolveSecretReferences(env map[string]string) error {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ref, ok, err := parseSecretReference(env[key])
+		if !ok {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("invalid Secrets Manager reference in %s: %w", key, err)
+		}
+		value, err := b.aws.GetSecretValue(*ref)
+		if err != nil {
+			return fmt.Errorf("unable to resolve %s from Secrets Manager secret %s: %w", key, ref.SecretID, err)
+		}
+		b.Log().Debug().Str("key", key).Str("secret", ref.SecretID).Msg("resolved Secrets Manager reference")
+		env[key] = value
+	}
+	return nil
+}
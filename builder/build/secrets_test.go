@@ -0,0 +1,114 @@
+package build
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/apppackio/codebuild-image/builder/aws"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseSecretReference(t *testing.T) {
+	arn := "arn:aws:secretsmanager:us-east-1:123456789012:secret:db-AbCdEf"
+	for value, expected := range map[string]aws.SecretReference{
+		"{{resolve:secretsmanager:db}}":                                   {SecretID: "db"},
+		"{{resolve:secretsmanager:db:SecretString:password}}":             {SecretID: "db", JSONKey: "password"},
+		"{{resolve:secretsmanager:db:SecretString:password:AWSPREVIOUS}}": {SecretID: "db", JSONKey: "password", VersionStage: "AWSPREVIOUS"},
+		"{{resolve:secretsmanager:db:SecretString::AWSPREVIOUS}}":         {SecretID: "db", VersionStage: "AWSPREVIOUS"},
+		"{{resolve:secretsmanager:db:SecretString:::v1}}":                 {SecretID: "db", VersionID: "v1"},
+		"{{resolve:secretsmanager:" + arn + ":SecretString:password}}":    {SecretID: arn, JSONKey: "password"},
+		"{{resolve:secretsmanager:" + arn + "}}":                          {SecretID: arn},
+		"/aws/reference/secretsmanager/prod/db":                           {SecretID: "prod/db"},
+	} {
+		ref, ok, err := parseSecretReference(value)
+		if !ok || err != nil {
+			t.Errorf("%s: expected a reference, got %v, %v", value, ok, err)
+			continue
+		}
+		if *ref != expected {
+			t.Errorf("%s: expected %+v, got %+v", value, expected, *ref)
+		}
+	}
+}
+
+func TestParseSecretReferenceNotAReference(t *testing.T) {
+	for _, value := range []string{"", "hunter2", "{{resolve:ssm:/db/password}}", "/aws/reference/other"} {
+		if _, ok, _ := parseSecretReference(value); ok {
+			t.Errorf("%s: expected not to be a reference", value)
+		}
+	}
+}
+
+func TestParseSecretReferenceInvalid(t *testing.T) {
+	for _, value := range []string{
+		"{{resolve:secretsmanager:db",
+		"{{resolve:secretsmanager:}}",
+		"{{resolve:secretsmanager:arn:aws:secretsmanager:us-east-1}}",
+		"{{resolve:secretsmanager:db:SecretBinary}}",
+		"{{resolve:secretsmanager:db:SecretString:password:AWSCURRENT:v1}}",
+		"{{resolve:secretsmanager:db:SecretString:password:AWSCURRENT::extra}}",
+		"/aws/reference/secretsmanager/",
+	} {
+		if _, ok, err := parseSecretReference(value); !ok || err == nil {
+			t.Errorf("%s: expected an invalid reference, got %v, %v", value, ok, err)
+		}
+	}
+}
+
+func TestLoadBuildEnvResolvesSecrets(t *testing.T) {
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetParametersByPath", "/apppack/apps/test-app/config/").Return(map[string]string{
+		"/apppack/apps/test-app/config/DB_PASSWORD": "{{resolve:secretsmanager:db:SecretString:password}}",
+		"/apppack/apps/test-app/config/API_KEY":     "/aws/reference/secretsmanager/api-key",
+		"/apppack/apps/test-app/config/DEBUG":       "1",
+	}, nil)
+	mockedAWS.On("ListParametersByTag", mock.Anything, BuildVisibleTag, BuildVisibleTagValue).Return([]string{}, nil)
+	mockedAWS.On("GetSecretValue", aws.SecretReference{SecretID: "db", JSONKey: "password"}).Return("hunter2", nil)
+	mockedAWS.On("GetSecretValue", aws.SecretReference{SecretID: "api-key"}).Return("abc123", nil)
+	mockedState := new(MockFilesystem)
+	mockedState.On("ReadEnvFile").Return(&map[string]string{}, nil)
+	b := Build{
+		Appname:          "test-app",
+		CodebuildBuildId: CodebuildBuildId,
+		aws:              mockedAWS,
+		state:            mockedState,
+		Ctx:              testContext,
+	}
+	env, err := b.LoadBuildEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	for key, expected := range map[string]string{"DB_PASSWORD": "hunter2", "API_KEY": "abc123", "DEBUG": "1"} {
+		if env[key] != expected {
+			t.Errorf("expected %s=%s, got %s", key, expected, env[key])
+		}
+	}
+	mockedAWS.AssertExpectations(t)
+}
+
+func TestLoadBuildEnvSecretErrorNamesKey(t *testing.T) {
+	mockedAWS := new(MockAWS)
+	mockedAWS.On("GetParametersByPath", "/apppack/apps/test-app/config/").Return(map[string]string{
+		"/apppack/apps/test-app/config/DB_PASSWORD": "{{resolve:secretsmanager:db:SecretString:password}}",
+	}, nil)
+	mockedAWS.On("GetSecretValue", aws.SecretReference{SecretID: "db", JSONKey: "password"}).Return("", fmt.Errorf("ResourceNotFoundException"))
+	b := Build{
+		Appname: "test-app",
+		aws:     mockedAWS,
+		Ctx:     testContext,
+	}
+	_, err := b.LoadBuildEnv()
+	if err == nil || !strings.Contains(err.Error(), "DB_PASSWORD") {
+		t.Errorf("expected an error naming DB_PASSWORD, got %v", err)
+	}
+	mockedAWS = new(MockAWS)
+	mockedAWS.On("GetParametersByPath", "/apppack/apps/test-app/config/").Return(map[string]string{
+		"/apppack/apps/test-app/config/TOKEN": "{{resolve:secretsmanager:db:SecretBinary}}",
+	}, nil)
+	b.aws = mockedAWS
+	_, err = b.LoadBuildEnv()
+	if err == nil || !strings.Contains(err.Error(), "TOKEN") {
+		t.Errorf("expected an error naming TOKEN, got %v", err)
+	}
+}
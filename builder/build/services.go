@@ -0,0 +1,85 @@
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// testServiceNames returns the names of the `[test.services]` in a stable order
+func (b *Build) testServiceNames() []string {
+	if b.AppPackToml == nil {
+		return nil
+	}
+	names := make([]string, 0, len(b.AppPackToml.Test.Services))
+	for name := range b.AppPackToml.Test.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// serviceAliases returns the network aliases of a test service, which always include its name
+func serviceAliases(name string, svc AppPackTomlTestService) []string {
+	return removeDuplicateStr(append([]string{name}, svc.Aliases...))
+}
+
+// StartServices starts the `[test.services]` containers from apppack.toml on the
+// build network and returns their connection environment for the tests
+func (b *Build) StartServices() (map[string]string, error) {
+	envOverrides := map[string]string{}
+	// services share the container name prefix with addons, so their names can't overlap
+	addons, err := b.testAddons()
+	if err != nil {
+		return nil, err
+	}
+	// every alias answers on the build network, so each must belong to one container
+	owners := map[string]string{}
+	for _, addon := range addons {
+		owners[addon.Spec.Alias] = "test addon " + addon.Name
+	}
+	for _, name := range b.testServiceNames() {
+		for _, alias := range serviceAliases(name, b.AppPackToml.Test.Services[name]) {
+			if owner, ok := owners[alias]; ok {
+				return nil, fmt.Errorf("apppack.toml: [test.services.%s] %s conflicts with %s", name, alias, owner)
+			}
+			owners[alias] = fmt.Sprintf("[test.services.%s]", name)
+		}
+	}
+	for _, name := range b.testServiceNames() {
+		svc := b.AppPackToml.Test.Services[name]
+		if err := b.containers.PullImage(svc.Image); err != nil {
+			return nil, err
+		}
+		config := b.labeled(&container.Config{Image: svc.Image, Env: svc.Env, Cmd: svc.Command})
+		if err := b.containers.RunContainer(b.addonContainerName(name), b.CodebuildBuildId, serviceAliases(name, svc), config, nil); err != nil {
+			return nil, err
+		}
+		for _, e := range svc.ConnectionEnv {
+			kv := strings.SplitN(e, "=", 2)
+			if len(kv) == 2 {
+				envOverrides[kv[0]] = kv[1]
+			}
+		}
+	}
+	return envOverrides, nil
+}
+
+// serviceReadinessTargets returns the test services which have a healthcheck
+func (b *Build) serviceReadinessTargets() []readinessTarget {
+	targets := []readinessTarget{}
+	for _, name := range b.testServiceNames() {
+		healthcheck := b.AppPackToml.Test.Services[name].Healthcheck
+		if healthcheck == nil {
+			continue
+		}
+		targets = append(targets, readinessTarget{
+			label:     "service " + name,
+			container: b.addonContainerName(name),
+			probe:     ReadinessProbe{Command: healthcheck.Command, Port: healthcheck.Port},
+		})
+	}
+	return targets
+}
@@ -0,0 +1,129 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestStartServices(t *testing.T) {
+	mockedContainers := new(MockContainers)
+	mockedContainers.On("PullImage", "stripe/stripe-mock").Return(nil)
+	mockedContainers.On(
+		"RunContainer",
+		fmt.Sprintf("%s-payments", CodebuildBuildId), CodebuildBuildId, []string{"payments", "stripe"},
+		&container.Config{Image: "stripe/stripe-mock", Env: []string{"PORT=12111"}, Cmd: []string{"-http-port", "12111"}, Labels: buildLabels},
+		(*container.HostConfig)(nil),
+	).Return(nil)
+	b := &Build{
+		CodebuildBuildId: CodebuildBuildId,
+		Ctx:              testContext,
+		AppJSON:          &AppJSON{},
+		AppPackToml:      &AppPackToml{Test: AppPackTomlTest{AddonTimeout: "50ms"}},
+		containers:       mockedContainers,
+	}
+	b.AppPackToml.Test.Services = map[string]AppPackTomlTestService{
+		"payments": {
+			Image:         "stripe/stripe-mock",
+			Env:           []string{"PORT=12111"},
+			Aliases:       []string{"stripe"},
+			Command:       []string{"-http-port", "12111"},
+			ConnectionEnv: []string{"STRIPE_API_BASE=http://stripe:12111"},
+		},
+	}
+	env, err := b.StartServices()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if env["STRIPE_API_BASE"] != "http://stripe:12111" {
+		t.Errorf("expected STRIPE_API_BASE=http://stripe:12111, got %s", env["STRIPE_API_BASE"])
+	}
+	mockedContainers.AssertExpectations(t)
+}
+
+func TestStartServicesAddonConflict(t *testing.T) {
+	mockedContainers := new(MockContainers)
+	b := &Build{
+		CodebuildBuildId: CodebuildBuildId,
+		Ctx:              testContext,
+		AppJSON: &AppJSON{
+			Environments: map[string]Environment{
+				"test": {Addons: []string{"heroku-postgresql:in-dyno"}},
+			},
+		},
+		AppPackToml: &AppPackToml{Test: AppPackTomlTest{AddonTimeout: "50ms"}},
+		containers:  mockedContainers,
+	}
+	b.AppPackToml.Test.Services = map[string]AppPackTomlTestService{
+		"db": {Image: "postgis/postgis"},
+	}
+	if _, err := b.StartServices(); err == nil {
+		t.Error("expected error when a service name conflicts with an addon")
+	}
+}
+
+func TestStartServicesAliasConflict(t *testing.T) {
+	mockedContainers := new(MockContainers)
+	b := &Build{
+		CodebuildBuildId: CodebuildBuildId,
+		Ctx:              testContext,
+		AppJSON: &AppJSON{
+			Environments: map[string]Environment{
+				"test": {Addons: []string{"heroku-postgresql:in-dyno"}},
+			},
+		},
+		AppPackToml: &AppPackToml{Test: AppPackTomlTest{Services: map[string]AppPackTomlTestService{
+			"postgis": {Image: "postgis/postgis", Aliases: []string{"db"}},
+		}}},
+		containers: mockedContainers,
+	}
+	if _, err := b.StartServices(); err == nil || !strings.Contains(err.Error(), "db conflicts with test addon") {
+		t.Errorf("expected an alias conflict with the addon, got %v", err)
+	}
+	b.AppJSON = &AppJSON{}
+	b.AppPackToml.Test.Services = map[string]AppPackTomlTestService{
+		"mail":    {Image: "mailhog/mailhog", Aliases: []string{"smtp"}},
+		"mailpit": {Image: "axllent/mailpit", Aliases: []string{"smtp"}},
+	}
+	if _, err := b.StartServices(); err == nil || !strings.Contains(err.Error(), "[test.services.mailpit] smtp conflicts with [test.services.mail]") {
+		t.Errorf("expected an alias conflict between services, got %v", err)
+	}
+	// nothing is started when any alias conflicts
+	mockedContainers.AssertNotCalled(t, "PullImage", mock.Anything)
+}
+
+func TestWaitForServices(t *testing.T) {
+	useAddonProbeInterval(t, time.Millisecond)
+	mockedContainers := new(MockContainers)
+	mockedContainers.On(
+		"ExecInContainer",
+		fmt.Sprintf("%s-selenium", CodebuildBuildId), []string{"curl", "-sf", "http://localhost:4444/status"},
+	).Return(0, nil)
+	b := &Build{
+		CodebuildBuildId: CodebuildBuildId,
+		Ctx:              testContext,
+		AppJSON:          &AppJSON{},
+		AppPackToml:      &AppPackToml{Test: AppPackTomlTest{AddonTimeout: "50ms"}},
+		containers:       mockedContainers,
+	}
+	b.AppPackToml.Test.Services = map[string]AppPackTomlTestService{
+		"selenium": {
+			Image:       "selenium/standalone-chrome",
+			Healthcheck: &AppPackTomlHealthcheck{Command: []string{"curl", "-sf", "http://localhost:4444/status"}},
+		},
+		"mock-api": {Image: "mockserver/mockserver"},
+	}
+	var out bytes.Buffer
+	if err := b.WaitForAddons(&out); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if !strings.Contains(out.String(), "service selenium ready after") {
+		t.Errorf("expected selenium wait to be reported, got %q", out.String())
+	}
+	mockedContainers.AssertExpectations(t)
+}
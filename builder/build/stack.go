@@ -0,0 +1,130 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apppackio/codebuild-image/builder/aws"
+	cfnTypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// stackPollInterval is how often a stack being deleted is checked
+var stackPollInterval = 10 * time.Second
+
+// StackDeleteError reports the resources CloudFormation failed to delete
+type StackDeleteError struct {
+	StackName string
+	Reason    string
+	Resources []cfnTypes.StackResourceSummary
+}
+
+func (e *StackDeleteError) Error() string {
+	msg := fmt.Sprintf("stack %s failed to delete", e.StackName)
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	if len(e.Resources) == 0 {
+		return msg
+	}
+	resources := make([]string, 0, len(e.Resources))
+	for _, r := range e.Resources {
+		resource := fmt.Sprintf("%s (%s)", stringValue(r.LogicalResourceId), stringValue(r.ResourceType))
+		if r.ResourceStatusReason != nil {
+			resource += ": " + *r.ResourceStatusReason
+		}
+		resources = append(resources, resource)
+	}
+	return fmt.Sprintf("%s; resources not deleted: %s", msg, strings.Join(resources, ", "))
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// reviewAppDeleteTimeout parses REVIEW_APP_DELETE_TIMEOUT. When it is unset
+// the review app stack deletion is started but not waited on.
+func reviewAppDeleteTimeout() (time.Duration, error) {
+	value := os.Getenv("REVIEW_APP_DELETE_TIMEOUT")
+	if value == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid REVIEW_APP_DELETE_TIMEOUT %q: %w", value, err)
+	}
+	return timeout, nil
+}
+
+// undeletedResources are the resources CloudFormation hasn't removed yet
+func undeletedResources(resources []cfnTypes.StackResourceSummary) []cfnTypes.StackResourceSummary {
+	remaining := []cfnTypes.StackResourceSummary{}
+	for _, r := range resources {
+		if r.ResourceStatus != cfnTypes.ResourceStatusDeleteComplete && r.ResourceStatus != cfnTypes.ResourceStatusDeleteSkipped {
+			remaining = append(remaining, r)
+		}
+	}
+	return remaining
+}
+
+// deleteFailedResources are the resources CloudFormation gave up on
+func deleteFailedResources(resources []cfnTypes.StackResourceSummary) []cfnTypes.StackResourceSummary {
+	failed := []cfnTypes.StackResourceSummary{}
+	for _, r := range resources {
+		if r.ResourceStatus == cfnTypes.ResourceStatusDeleteFailed {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// waitForStackDelete polls the stack until it is gone, logging progress as
+// resources are removed
+func (b *Build) waitForStackDelete(name string, timeout time.Duration) error {
+	start := time.Now()
+	deadline := start.Add(timeout)
+	var lastStatus cfnTypes.StackStatus
+	lastRemaining := -1
+	for {
+		stack, err := b.aws.DescribeStack(name)
+		if errors.Is(err, aws.ErrStackNotFound) {
+			b.Log().Info().Str("stack", name).Dur("elapsed", time.Since(start)).Msg("stack deleted")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch stack.StackStatus {
+		case cfnTypes.StackStatusDeleteComplete:
+			b.Log().Info().Str("stack", name).Dur("elapsed", time.Since(start)).Msg("stack deleted")
+			return nil
+		case cfnTypes.StackStatusDeleteFailed:
+			resources, err := b.aws.ListStackResources(name)
+			if err != nil {
+				b.Log().Warn().Err(err).Str("stack", name).Msg("unable to list stack resources")
+			}
+			return &StackDeleteError{
+				StackName: name,
+				Reason:    stringValue(stack.StackStatusReason),
+				Resources: deleteFailedResources(resources),
+			}
+		}
+		remaining := lastRemaining
+		if resources, err := b.aws.ListStackResources(name); err == nil {
+			remaining = len(undeletedResources(resources))
+		}
+		if stack.StackStatus != lastStatus || remaining != lastRemaining {
+			b.Log().Info().Str("stack", name).Str("status", string(stack.StackStatus)).Int("remaining", remaining).Msg("waiting for stack deletion")
+			lastStatus, lastRemaining = stack.StackStatus, remaining
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for stack %s to delete (status %s)", timeout, name, stack.StackStatus)
+		}
+		time.Sleep(stackPollInterval)
+	}
+}
@@ -0,0 +1,194 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apppackio/codebuild-image/builder/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+)
+
+// fakeStackAWS simulates a CloudFormation stack moving through a series of
+// statuses, one per DescribeStack call. Once the statuses run out the stack
+// no longer exists, unless stuck is set to repeat the last status forever.
+// Calls it doesn't override go to the embedded mock.
+type fakeStackAWS struct {
+	*MockAWS
+	statuses    []types.StackStatus
+	reason      string
+	resources   []types.StackResourceSummary
+	stuck       bool
+	describeErr error
+	destroyed   bool
+}
+
+func (f *fakeStackAWS) DescribeStack(name string) (*types.Stack, error) {
+	if f.describeErr != nil {
+		return nil, f.describeErr
+	}
+	if len(f.statuses) == 0 {
+		return nil, fmt.Errorf("%w: %s", aws.ErrStackNotFound, name)
+	}
+	status := f.statuses[0]
+	if len(f.statuses) > 1 || !f.stuck {
+		f.statuses = f.statuses[1:]
+	}
+	reason := f.reason
+	return &types.Stack{StackName: &name, StackStatus: status, StackStatusReason: &reason}, nil
+}
+
+func (f *fakeStackAWS) DestroyStack(name string) error {
+	f.destroyed = true
+	return nil
+}
+
+func (f *fakeStackAWS) ListStackResources(name string) ([]types.StackResourceSummary, error) {
+	return f.resources, nil
+}
+
+func stackResource(id string, status types.ResourceStatus, reason string) types.StackResourceSummary {
+	resourceType := "AWS::ECS::Service"
+	r := types.StackResourceSummary{LogicalResourceId: &id, ResourceType: &resourceType, ResourceStatus: status}
+	if reason != "" {
+		r.ResourceStatusReason = &reason
+	}
+	return r
+}
+
+// useStackPollInterval shortens the wait between stack status polls for the test
+func useStackPollInterval(t *testing.T, interval time.Duration) {
+	previous := stackPollInterval
+	stackPollInterval = interval
+	t.Cleanup(func() { stackPollInterval = previous })
+}
+
+func TestReviewAppStackExists(t *testing.T) {
+	b := Build{
+		Appname:     "test-app",
+		PullRequest: "pr/123",
+		aws:         &fakeStackAWS{},
+		Ctx:         testContext,
+	}
+	exists, err := b.ReviewAppStackExists()
+	if err != nil || exists {
+		t.Errorf("expected missing stack without error, got %v, %v", exists, err)
+	}
+	b = Build{
+		Appname:     "test-app",
+		PullRequest: "pr/123",
+		aws:         &fakeStackAWS{statuses: []types.StackStatus{types.StackStatusCreateComplete}},
+		Ctx:         testContext,
+	}
+	exists, err = b.ReviewAppStackExists()
+	if err != nil || !exists {
+		t.Errorf("expected existing stack without error, got %v, %v", exists, err)
+	}
+}
+
+func TestReviewAppStackExistsError(t *testing.T) {
+	throttled := errors.New("Throttling: Rate exceeded")
+	b := Build{
+		Appname:     "test-app",
+		PullRequest: "pr/123",
+		aws:         &fakeStackAWS{describeErr: throttled},
+		Ctx:         testContext,
+	}
+	if _, err := b.ReviewAppStackExists(); !errors.Is(err, throttled) {
+		t.Errorf("expected throttling error, got %v", err)
+	}
+	b.Pipeline = true
+	b.CodebuildWebhookEvent = "PULL_REQUEST_MERGED"
+	b.aws = &fakeStackAWS{MockAWS: reviewAppStatus(b.Appname, "pr/123", MergedPRStatus), describeErr: throttled}
+	if _, err := b.HandlePR(); !errors.Is(err, throttled) {
+		t.Errorf("expected HandlePR to surface the throttling error, got %v", err)
+	}
+}
+
+func TestDestroyReviewAppStackNoWait(t *testing.T) {
+	fake := &fakeStackAWS{statuses: []types.StackStatus{types.StackStatusDeleteInProgress}}
+	b := Build{
+		Appname:     "test-app",
+		PullRequest: "pr/123",
+		aws:         fake,
+		Ctx:         testContext,
+	}
+	if err := b.DestroyReviewAppStack(); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+	if !fake.destroyed || len(fake.statuses) != 1 {
+		t.Errorf("expected delete to be started without polling")
+	}
+}
+
+func TestDestroyReviewAppStackWait(t *testing.T) {
+	fake := &fakeStackAWS{
+		statuses: []types.StackStatus{types.StackStatusDeleteInProgress, types.StackStatusDeleteInProgress},
+		resources: []types.StackResourceSummary{
+			stackResource("Service", types.ResourceStatusDeleteInProgress, ""),
+			stackResource("Queue", types.ResourceStatusDeleteComplete, ""),
+		},
+	}
+	useStackPollInterval(t, time.Millisecond)
+	b := Build{
+		Appname:                "test-app",
+		PullRequest:            "pr/123",
+		ReviewAppDeleteTimeout: time.Second,
+		aws:                    fake,
+		Ctx:                    testContext,
+	}
+	if err := b.DestroyReviewAppStack(); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+	if len(fake.statuses) != 0 {
+		t.Errorf("expected to poll until the stack was gone")
+	}
+}
+
+func TestDestroyReviewAppStackFailed(t *testing.T) {
+	fake := &fakeStackAWS{
+		statuses: []types.StackStatus{types.StackStatusDeleteInProgress, types.StackStatusDeleteFailed},
+		reason:   "The following resource(s) failed to delete: [Bucket].",
+		resources: []types.StackResourceSummary{
+			stackResource("Service", types.ResourceStatusDeleteComplete, ""),
+			stackResource("Bucket", types.ResourceStatusDeleteFailed, "The bucket you tried to delete is not empty"),
+		},
+	}
+	useStackPollInterval(t, time.Millisecond)
+	b := Build{
+		Appname:                "test-app",
+		PullRequest:            "pr/123",
+		ReviewAppDeleteTimeout: time.Second,
+		aws:                    fake,
+		Ctx:                    testContext,
+	}
+	err := b.DestroyReviewAppStack()
+	var deleteErr *StackDeleteError
+	if !errors.As(err, &deleteErr) {
+		t.Fatalf("expected StackDeleteError, got %v", err)
+	}
+	if len(deleteErr.Resources) != 1 || *deleteErr.Resources[0].LogicalResourceId != "Bucket" {
+		t.Errorf("expected only the failed resource to be reported, got %v", deleteErr.Resources)
+	}
+	if !strings.Contains(err.Error(), "Bucket (AWS::ECS::Service): The bucket you tried to delete is not empty") {
+		t.Errorf("expected resource in error message, got %q", err)
+	}
+}
+
+func TestDestroyReviewAppStackTimeout(t *testing.T) {
+	fake := &fakeStackAWS{statuses: []types.StackStatus{types.StackStatusDeleteInProgress}, stuck: true}
+	useStackPollInterval(t, time.Millisecond)
+	b := Build{
+		Appname:                "test-app",
+		PullRequest:            "pr/123",
+		ReviewAppDeleteTimeout: 5 * time.Millisecond,
+		aws:                    fake,
+		Ctx:                    testContext,
+	}
+	err := b.DestroyReviewAppStack()
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+}
@@ -12,8 +12,9 @@ var buildCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := logger.WithContext(cmd.Context())
 		b, err := build.New(ctx)
-		checkError(err, b.SkipBuild)
-		checkError(b.RunBuild(), b.SkipBuild)
+		checkError(err, b.SkipBuild, b.Teardown)
+		checkError(b.RunBuild(), b.SkipBuild, b.Teardown, b.LogAWSMetrics)
+		b.LogAWSMetrics()
 	},
 }
 
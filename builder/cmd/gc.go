@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"os"
+	"time"
+
+	"github.com/apppackio/codebuild-image/builder/build"
+	"github.com/apppackio/codebuild-image/builder/containers"
+	"github.com/spf13/cobra"
+)
+
+var gcOlderThan time.Duration
+
+var gcCmd = &cobra.Command{
+	Use:          "gc",
+	Short:        "Remove containers, networks, builders and images left behind by previous builds",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := logger.WithContext(cmd.Context())
+		c, err := containers.New(ctx)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		return build.GarbageCollect(ctx, c, os.Getenv("CODEBUILD_BUILD_ID"), gcOlderThan)
+	},
+}
+
+func init() {
+	gcCmd.Flags().DurationVar(&gcOlderThan, "older-than", build.DefaultGCThreshold, "only remove resources older than this")
+	rootCmd.AddCommand(gcCmd)
+}
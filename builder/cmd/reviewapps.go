@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/apppackio/codebuild-image/builder/aws"
+	"github.com/apppackio/codebuild-image/builder/build"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pruneAppName string
+	pruneTTL     time.Duration
+	pruneDryRun  bool
+	purgeAge     time.Duration
+)
+
+var reviewappsCmd = &cobra.Command{
+	Use:   "reviewapps",
+	Short: "Manage the review apps of a pipeline",
+}
+
+var reviewappsPruneCmd = &cobra.Command{
+	Use:          "prune",
+	Short:        "Destroy review apps which have been idle longer than the TTL",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := logger.WithContext(cmd.Context())
+		if pruneAppName == "" {
+			return fmt.Errorf("--app (or APPNAME) is required")
+		}
+		awsCfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return err
+		}
+		pruned, err := build.PruneReviewApps(ctx, aws.New(&awsCfg, ctx), pruneAppName, os.Getenv("CODEBUILD_BUILD_ID"), pruneTTL, pruneDryRun)
+		logger.Info().Int("count", len(pruned)).Bool("dry-run", pruneDryRun).Msg("pruned idle review apps")
+		return err
+	},
+}
+
+var reviewappsPurgeCmd = &cobra.Command{
+	Use:          "purge",
+	Short:        "Delete the status of review apps archived longer ago than the grace period",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := logger.WithContext(cmd.Context())
+		if pruneAppName == "" {
+			return fmt.Errorf("--app (or APPNAME) is required")
+		}
+		awsCfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return err
+		}
+		purged, err := build.PurgeArchivedReviewApps(ctx, aws.New(&awsCfg, ctx), pruneAppName, purgeAge, pruneDryRun)
+		logger.Info().Int("count", len(purged)).Bool("dry-run", pruneDryRun).Msg("purged archived review apps")
+		return err
+	},
+}
+
+func init() {
+	reviewappsPruneCmd.Flags().StringVar(&pruneAppName, "app", os.Getenv("APPNAME"), "pipeline name")
+	reviewappsPruneCmd.Flags().DurationVar(&pruneTTL, "ttl", build.DefaultReviewAppTTL, "prune review apps with no activity for longer than this")
+	reviewappsPruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "only list the review apps which would be pruned")
+	reviewappsCmd.AddCommand(reviewappsPruneCmd)
+	reviewappsPurgeCmd.Flags().StringVar(&pruneAppName, "app", os.Getenv("APPNAME"), "pipeline name")
+	reviewappsPurgeCmd.Flags().DurationVar(&purgeAge, "older-than", build.DefaultArchiveTTL, "purge review apps archived longer ago than this")
+	reviewappsPurgeCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "only list the review apps which would be purged")
+	reviewappsCmd.AddCommand(reviewappsPurgeCmd)
+	rootCmd.AddCommand(reviewappsCmd)
+}
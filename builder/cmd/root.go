@@ -20,10 +20,14 @@ var rootCmd = &cobra.Command{
 	},
 }
 
-func checkError(err error, postError func() error) {
+// checkError exits if err is not nil, first running each of the postError
+// functions (e.g. to skip the rest of the build and clean up after it)
+func checkError(err error, postError ...func() error) {
 	if err != nil {
-		if err2 := postError(); err2 != nil {
-			logger.Error().Err(err2).Msg("Error")
+		for _, f := range postError {
+			if err2 := f(); err2 != nil {
+				logger.Error().Err(err2).Msg("Error")
+			}
 		}
 		logger.Fatal().Err(err).Msg("Error")
 	}
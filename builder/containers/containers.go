@@ -1,17 +1,26 @@
 package containers
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/apppackio/codebuild-image/builder/redact"
 	"github.com/docker/cli/cli/config"
 	"github.com/docker/cli/cli/config/types"
-	apiTypes "github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
@@ -27,6 +36,8 @@ type BuildConfig struct {
 	CacheDir  string
 	LogFile   *os.File
 	Env       map[string]string
+	// Redact lists values masked in the build output, the config loaded from SSM
+	Redact []string
 }
 
 func NewBuildConfig(image, buildNumber string, env map[string]string, logFile *os.File, cacheDir string) *BuildConfig {
@@ -40,20 +51,72 @@ func NewBuildConfig(image, buildNumber string, env map[string]string, logFile *o
 	}
 }
 
+const (
+	// BuildIDLabel is set on every container and network the builder creates so
+	// they can be found and removed when the build ends
+	BuildIDLabel = "io.apppack.build-id"
+	// CreatedAtLabel records when the build which created the resource started (RFC 3339)
+	CreatedAtLabel = "io.apppack.created-at"
+	// BuildkitContainerPrefix is the name prefix of the containers buildx
+	// creates for docker-container builders
+	BuildkitContainerPrefix = "buildx_buildkit_"
+)
+
+// BuildxEnvLabels maps each label to the environment variable which carries it
+// on buildx builder containers. buildx can't label the containers it creates,
+// but can set their environment.
+var BuildxEnvLabels = map[string]string{
+	BuildIDLabel:   "APPPACK_BUILD_ID",
+	CreatedAtLabel: "APPPACK_CREATED_AT",
+}
+
+// Resource is a container or network found by label
+type Resource struct {
+	ID      string
+	Name    string
+	Labels  map[string]string
+	Created time.Time
+	// Running is only set for containers
+	Running bool
+}
+
 type ContainersI interface {
 	Close() error
-	CreateNetwork(string) error
+	CreateNetwork(string, map[string]string) error
+	ListNetworks(map[string]string) ([]Resource, error)
+	DeleteNetwork(string) error
+	ListContainers(map[string]string) ([]Resource, error)
+	ListBuildxBuilders() ([]Resource, error)
+	SelectedBuildxBuilder() (string, error)
+	DeleteVolume(string) error
+	PruneDanglingImages(time.Duration) (uint64, error)
 	PullImage(string) error
 	PushImage(string) error
 	BuildImage(string, *BuildConfig) error
 	CreateContainer(string, *container.Config) (*string, error)
 	DeleteContainer(string) error
-	RunContainer(string, string, []string, *container.Config) error
+	RunContainer(string, string, []string, *container.Config, *container.HostConfig) error
 	GetContainerFile(string, string) (io.ReadCloser, error)
-	WaitForExit(string) (int, error)
+	GetContainerFiles(string, string) (map[string][]byte, error)
+	WaitForExit(string, time.Duration) (int, error)
 	AttachLogs(string, io.Writer, io.Writer) error
+	TailLogs(string, int, io.Writer, io.Writer) error
+	ListProcesses(string, io.Writer) error
+	KillContainer(string) error
+	ExecInContainer(string, []string) (int, error)
+	ContainerIP(string, string) (string, error)
 }
 
+// ErrWaitTimeout is returned by WaitForExit when the container is still running after the timeout
+var ErrWaitTimeout = errors.New("timed out waiting for container to exit")
+
+// execExitPolls bounds how often ExecInContainer inspects an exec whose output
+// has ended but which the daemon still reports as running
+const (
+	execExitPolls        = 50
+	execExitPollInterval = 100 * time.Millisecond
+)
+
 type Containers struct {
 	ctx context.Context
 	cli *client.Client
@@ -110,12 +173,144 @@ func Login(serverAddress string, user string, password string) error {
 	return cf.Save()
 }
 
-func (c *Containers) CreateNetwork(id string) error {
+func (c *Containers) CreateNetwork(id string, labels map[string]string) error {
 	c.Log().Debug().Str("network", id).Msg("creating docker network")
-	_, err := c.cli.NetworkCreate(c.ctx, id, apiTypes.NetworkCreate{})
+	_, err := c.cli.NetworkCreate(c.ctx, id, network.CreateOptions{Labels: labels})
 	return err
 }
 
+// labelFilters matches resources with all of the labels. An empty value
+// matches any resource which has the label.
+func labelFilters(labels map[string]string) filters.Args {
+	args := filters.NewArgs()
+	for k, v := range labels {
+		if v == "" {
+			args.Add("label", k)
+		} else {
+			args.Add("label", fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+	return args
+}
+
+// ListNetworks returns the networks which have all of the labels
+func (c *Containers) ListNetworks(labels map[string]string) ([]Resource, error) {
+	networks, err := c.cli.NetworkList(c.ctx, network.ListOptions{Filters: labelFilters(labels)})
+	if err != nil {
+		return nil, err
+	}
+	resources := []Resource{}
+	for _, n := range networks {
+		resources = append(resources, Resource{ID: n.ID, Name: n.Name, Labels: n.Labels, Created: n.Created})
+	}
+	return resources, nil
+}
+
+func (c *Containers) DeleteNetwork(id string) error {
+	c.Log().Debug().Str("network", id).Msg("deleting docker network")
+	return c.cli.NetworkRemove(c.ctx, id)
+}
+
+// ListContainers returns the containers, running or not, which have all of the labels
+func (c *Containers) ListContainers(labels map[string]string) ([]Resource, error) {
+	return c.listContainers(labelFilters(labels))
+}
+
+// ListBuildxBuilders returns the docker-container buildx builders, running or
+// not, with the labels recorded in their environment
+func (c *Containers) ListBuildxBuilders() ([]Resource, error) {
+	resources, err := c.listContainers(filters.NewArgs(filters.Arg("name", BuildkitContainerPrefix)))
+	if err != nil {
+		return nil, err
+	}
+	// the name filter matches anywhere in the name
+	builders := []Resource{}
+	for _, r := range resources {
+		if !strings.HasPrefix(r.Name, BuildkitContainerPrefix) {
+			continue
+		}
+		info, err := c.cli.ContainerInspect(c.ctx, r.ID)
+		if err != nil {
+			return nil, err
+		}
+		r.Labels = map[string]string{}
+		if info.Config != nil {
+			r.Labels = buildxLabels(info.Config.Env)
+		}
+		builders = append(builders, r)
+	}
+	return builders, nil
+}
+
+// buildxLabels reads the labels set with BuildxEnvLabels from a container's environment
+func buildxLabels(env []string) map[string]string {
+	labels := map[string]string{}
+	for _, e := range env {
+		k, v, _ := strings.Cut(e, "=")
+		for label, name := range BuildxEnvLabels {
+			if k == name {
+				labels[label] = v
+			}
+		}
+	}
+	return labels
+}
+
+// SelectedBuildxBuilder returns the name of the container of the buildx
+// builder in use, or "" when it isn't a docker-container builder
+func (c *Containers) SelectedBuildxBuilder() (string, error) {
+	cmd := exec.Command("docker", "buildx", "inspect")
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("docker buildx inspect: %w: %s", err, strings.TrimSpace(output.String()))
+	}
+	return parseBuildxInspect(output.String()), nil
+}
+
+// parseBuildxInspect finds the container of the first node in `docker buildx
+// inspect` output
+func parseBuildxInspect(output string) string {
+	dockerContainer, inNodes := false, false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), ":")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch {
+		case key == "Driver" && !inNodes:
+			dockerContainer = value == "docker-container"
+		case key == "Nodes":
+			inNodes = true
+		case key == "Name" && inNodes && dockerContainer:
+			return BuildkitContainerPrefix + value
+		}
+	}
+	return ""
+}
+
+func (c *Containers) listContainers(args filters.Args) ([]Resource, error) {
+	ctainers, err := c.cli.ContainerList(c.ctx, container.ListOptions{All: true, Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	resources := []Resource{}
+	for _, ctainer := range ctainers {
+		name := ""
+		if len(ctainer.Names) > 0 {
+			name = strings.TrimPrefix(ctainer.Names[0], "/")
+		}
+		resources = append(resources, Resource{
+			ID:      ctainer.ID,
+			Name:    name,
+			Labels:  ctainer.Labels,
+			Created: time.Unix(ctainer.Created, 0),
+			Running: ctainer.State == "running",
+		})
+	}
+	return resources, nil
+}
+
 func (c *Containers) PullImage(imageName string) error {
 	c.Log().Debug().Str("image", imageName).Msg("pulling image")
 	cmd := exec.Command("docker", "pull", imageName)
@@ -133,8 +328,12 @@ func (c *Containers) PushImage(imageName string) error {
 }
 
 func (c *Containers) CreateContainer(name string, config *container.Config) (*string, error) {
+	return c.createContainer(name, config, nil)
+}
+
+func (c *Containers) createContainer(name string, config *container.Config, hostConfig *container.HostConfig) (*string, error) {
 	c.Log().Debug().Str("image", config.Image).Str("name", name).Msg("creating container")
-	resp, err := c.cli.ContainerCreate(c.ctx, config, nil, &network.NetworkingConfig{}, nil, name)
+	resp, err := c.cli.ContainerCreate(c.ctx, config, hostConfig, &network.NetworkingConfig{}, nil, name)
 	if err != nil {
 		return nil, err
 	}
@@ -145,9 +344,10 @@ func (c *Containers) CreateContainer(name string, config *container.Config) (*st
 // container is created with the (unique) name so it never collides on a
 // reused Docker daemon. Any aliases are registered as network-scoped
 // hostnames so other containers can reach it by a friendly name (e.g. "db").
-func (c *Containers) RunContainer(name string, networkID string, aliases []string, config *container.Config) error {
+// hostConfig is optional and carries settings such as resource limits.
+func (c *Containers) RunContainer(name string, networkID string, aliases []string, config *container.Config, hostConfig *container.HostConfig) error {
 	c.Log().Debug().Str("image", config.Image).Str("container", name).Strs("aliases", aliases).Msg("starting container")
-	containerID, err := c.CreateContainer(name, config)
+	containerID, err := c.createContainer(name, config, hostConfig)
 	if err != nil {
 		return err
 	}
@@ -171,12 +371,95 @@ func (c *Containers) GetContainerFile(containerID string, src string) (io.ReadCl
 	return reader, nil
 }
 
+// globRoot returns the longest leading directory of pattern which contains no
+// glob characters. If pattern has no glob characters, it is returned as-is.
+func globRoot(pattern string) string {
+	parts := strings.Split(pattern, "/")
+	for i, part := range parts {
+		if strings.ContainsAny(part, "*?[") {
+			root := strings.Join(parts[:i], "/")
+			if root == "" {
+				return "/"
+			}
+			return root
+		}
+	}
+	return pattern
+}
+
+// GetContainerFiles returns the contents of the regular files in the container
+// which match the glob pattern (see path.Match). Relative patterns are resolved
+// against the container's working directory. No match is not an error.
+func (c *Containers) GetContainerFiles(containerID string, pattern string) (map[string][]byte, error) {
+	if !path.IsAbs(pattern) {
+		info, err := c.cli.ContainerInspect(c.ctx, containerID)
+		if err != nil {
+			return nil, err
+		}
+		workdir := "/"
+		if info.Config != nil && info.Config.WorkingDir != "" {
+			workdir = info.Config.WorkingDir
+		}
+		pattern = path.Join(workdir, pattern)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	root := globRoot(pattern)
+	files := map[string][]byte{}
+	reader, err := c.GetContainerFile(containerID, root)
+	if client.IsErrNotFound(err) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	// entries in the archive are relative to the parent of the copied path
+	parent := path.Dir(root)
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Join(parent, hdr.Name)
+		if matched, _ := path.Match(pattern, name); !matched {
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = content
+	}
+	c.Log().Debug().Str("pattern", pattern).Int("files", len(files)).Msg("copied files from container")
+	return files, nil
+}
+
 // WaitContainer waits for a container to exit and returns the exit code
-func (c *Containers) WaitForExit(containerID string) (int, error) {
-	c.Log().Debug().Str("container", containerID).Msg("waiting for container to exit")
-	statusCh, errCh := c.cli.ContainerWait(c.ctx, containerID, container.WaitConditionNotRunning)
+// A timeout of zero waits indefinitely, otherwise ErrWaitTimeout is returned
+// if the container is still running when it expires.
+func (c *Containers) WaitForExit(containerID string, timeout time.Duration) (int, error) {
+	c.Log().Debug().Str("container", containerID).Dur("timeout", timeout).Msg("waiting for container to exit")
+	ctx := c.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(c.ctx, timeout)
+		defer cancel()
+	}
+	statusCh, errCh := c.cli.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
 	select {
 	case err := <-errCh:
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return -1, ErrWaitTimeout
+		}
 		return -1, err
 	case status := <-statusCh:
 		return int(status.StatusCode), nil
@@ -197,6 +480,109 @@ func (c *Containers) AttachLogs(containerID string, stdout, stderr io.Writer) er
 	return err
 }
 
+// TailLogs writes the last lines of a container's logs to stdout and stderr
+func (c *Containers) TailLogs(containerID string, lines int, stdout, stderr io.Writer) error {
+	c.Log().Debug().Str("container", containerID).Int("lines", lines).Msg("reading tail of container logs")
+	reader, err := c.cli.ContainerLogs(c.ctx, containerID, container.LogsOptions{ShowStdout: true, ShowStderr: true, Tail: strconv.Itoa(lines)})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = stdcopy.StdCopy(stdout, stderr, reader)
+	return err
+}
+
+// ListProcesses writes the processes running in a container to w as a table
+func (c *Containers) ListProcesses(containerID string, w io.Writer) error {
+	c.Log().Debug().Str("container", containerID).Msg("listing container processes")
+	top, err := c.cli.ContainerTop(c.ctx, containerID, nil)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(top.Titles, "\t"))
+	for _, process := range top.Processes {
+		fmt.Fprintln(tw, strings.Join(process, "\t"))
+	}
+	return tw.Flush()
+}
+
+func (c *Containers) KillContainer(containerID string) error {
+	c.Log().Debug().Str("container", containerID).Msg("killing container")
+	return c.cli.ContainerKill(c.ctx, containerID, "KILL")
+}
+
+// ExecInContainer runs cmd inside a running container, discarding its output,
+// and returns the exit code
+func (c *Containers) ExecInContainer(containerID string, cmd []string) (int, error) {
+	c.Log().Debug().Str("container", containerID).Strs("cmd", cmd).Msg("executing command in container")
+	execResp, err := c.cli.ContainerExecCreate(c.ctx, containerID, container.ExecOptions{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return -1, err
+	}
+	attachResp, err := c.cli.ContainerExecAttach(c.ctx, execResp.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return -1, err
+	}
+	defer attachResp.Close()
+	// the stream closes when the command exits
+	if _, err = io.Copy(io.Discard, attachResp.Reader); err != nil {
+		return -1, err
+	}
+	// the daemon can report the exec as still running, with an exit code of 0,
+	// for a moment after the stream closes
+	for i := 0; ; i++ {
+		inspect, err := c.cli.ContainerExecInspect(c.ctx, execResp.ID)
+		if err != nil {
+			return -1, err
+		}
+		if !inspect.Running {
+			return inspect.ExitCode, nil
+		}
+		if i == execExitPolls {
+			return -1, fmt.Errorf("exec in %s still running after its output ended", containerID)
+		}
+		time.Sleep(execExitPollInterval)
+	}
+}
+
+// ContainerIP returns the address of the container on the given network
+func (c *Containers) ContainerIP(containerID string, networkID string) (string, error) {
+	info, err := c.cli.ContainerInspect(c.ctx, containerID)
+	if err != nil {
+		return "", err
+	}
+	if info.NetworkSettings != nil {
+		if endpoint, ok := info.NetworkSettings.Networks[networkID]; ok && endpoint.IPAddress != "" {
+			return endpoint.IPAddress, nil
+		}
+	}
+	return "", fmt.Errorf("container %s has no address on network %s", containerID, networkID)
+}
+
+func (c *Containers) DeleteVolume(name string) error {
+	c.Log().Debug().Str("volume", name).Msg("deleting docker volume")
+	return c.cli.VolumeRemove(c.ctx, name, true)
+}
+
+// PruneDanglingImages removes untagged images older than the given age and
+// returns the bytes reclaimed
+func (c *Containers) PruneDanglingImages(olderThan time.Duration) (uint64, error) {
+	c.Log().Debug().Dur("older_than", olderThan).Msg("pruning dangling images")
+	report, err := c.cli.ImagesPrune(c.ctx, filters.NewArgs(
+		filters.Arg("dangling", "true"),
+		filters.Arg("until", olderThan.String()),
+	))
+	if err != nil {
+		return 0, err
+	}
+	return report.SpaceReclaimed, nil
+}
+
 func (c *Containers) DeleteContainer(containerID string) error {
 	c.Log().Debug().Str("container", containerID).Msg("deleting container")
 	return c.cli.ContainerRemove(c.ctx, containerID, container.RemoveOptions{Force: true})
@@ -219,8 +605,12 @@ func (c *Containers) BuildImage(dockerfile string, config *BuildConfig) error {
 	}
 	dockerArgs = append(dockerArgs, ".")
 	cmd := exec.Command("docker", dockerArgs...)
-	out := io.MultiWriter(os.Stdout, config.LogFile)
+	out := redact.NewWriter(io.MultiWriter(os.Stdout, config.LogFile), config.Redact)
 	cmd.Stdout = out
 	cmd.Stderr = out
-	return cmd.Run()
+	err := cmd.Run()
+	if flushErr := out.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
 }
@@ -0,0 +1,35 @@
+package containers
+
+import (
+	"reflect"
+	"testing"
+)
+
+const buildxInspectOutput = `Name:          build-1
+Driver:        docker-container
+Last Activity: 2026-07-01 12:00:00 +0000 UTC
+
+Nodes:
+Name:                  build-10
+Endpoint:              unix:///var/run/docker.sock
+Status:                running
+BuildKit version:      v0.15.1
+`
+
+func TestParseBuildxInspect(t *testing.T) {
+	if name := parseBuildxInspect(buildxInspectOutput); name != "buildx_buildkit_build-10" {
+		t.Errorf("expected the node's container, got %q", name)
+	}
+	// the default builder runs in the daemon, not a container
+	if name := parseBuildxInspect("Name:   default\nDriver: docker\n\nNodes:\nName:   default\n"); name != "" {
+		t.Errorf("expected no container, got %q", name)
+	}
+}
+
+func TestBuildxLabels(t *testing.T) {
+	labels := buildxLabels([]string{"PATH=/usr/bin", "APPPACK_BUILD_ID=app:1234", "APPPACK_CREATED_AT=2026-07-01T12:00:00Z"})
+	expected := map[string]string{BuildIDLabel: "app:1234", CreatedAtLabel: "2026-07-01T12:00:00Z"}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("expected %v, got %v", expected, labels)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"archive/tar"
 	"context"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"os"
@@ -36,6 +37,8 @@ type State interface {
 	EndLogging(*os.File, string) error
 	WriteTomlToFile(string, interface{}) error
 	WriteJsonToFile(string, interface{}) error
+	ReadJsonFile(string, interface{}) error
+	WriteXmlToFile(string, interface{}) error
 }
 
 // State is a struct that holds the state of the build
@@ -183,6 +186,33 @@ func (f *FileState) WriteJsonToFile(filename string, v interface{}) error {
 	return nil
 }
 
+func (f *FileState) ReadJsonFile(filename string, v interface{}) error {
+	file, err := f.fs.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewDecoder(file).Decode(v)
+}
+
+func (f *FileState) WriteXmlToFile(filename string, v interface{}) error {
+	f.Log().Debug().Str("filename", filename).Msg("writing xml to file")
+	file, err := f.fs.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.WriteString(xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(file)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return err
+	}
+	return nil
+}
+
 func GetAppPackTomlFilename() string {
 	filename := DefaultAppPackTomlFilename
 	if envFile := os.Getenv("APPPACK_TOML"); envFile != "" {
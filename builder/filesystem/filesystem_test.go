@@ -111,6 +111,27 @@ func TestWriteEnvFile(t *testing.T) {
 	}
 }
 
+func TestReadJsonFile(t *testing.T) {
+	fs := afero.Afero{Fs: afero.NewMemMapFs()}
+	s := &FileState{
+		fs:  fs,
+		ctx: testContext,
+	}
+	if err := s.WriteJsonToFile("report.json", map[string]int{"files": 3}); err != nil {
+		t.Fatal(err)
+	}
+	report := map[string]int{}
+	if err := s.ReadJsonFile("report.json", &report); err != nil {
+		t.Fatal(err)
+	}
+	if report["files"] != 3 {
+		t.Errorf("expected 3 files, got %v", report)
+	}
+	if err := s.ReadJsonFile("missing.json", &report); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
 func TestGetFilename(t *testing.T) {
 	// Check that there is no env variable set
 	if os.Getenv("APPPACK_TOML") != "" {
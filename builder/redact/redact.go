@@ -0,0 +1,101 @@
+package redact
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// Mask replaces redacted values in the output
+	Mask = "***"
+	// MinLength is the length of the shortest value which is redacted. Shorter
+	// values, like "1" or "true", are too common in normal output to mask.
+	MinLength = 8
+)
+
+// Writer masks any of its values in the output written to the underlying
+// writer. The end of a write which could be the start of a value is held
+// back until the next write, so values split across writes are still masked.
+// Flush must be called once writing is done.
+type Writer struct {
+	w        io.Writer
+	values   []string
+	replacer *strings.Replacer
+	// starts indexes the values by their first byte, to find partial values
+	starts    map[byte][]string
+	maxLength int
+	pending   string
+	mu        sync.Mutex
+}
+
+func NewWriter(w io.Writer, values []string) *Writer {
+	unique := map[string]bool{}
+	for _, v := range values {
+		if len(v) >= MinLength {
+			unique[v] = true
+		}
+	}
+	r := &Writer{w: w}
+	for v := range unique {
+		r.values = append(r.values, v)
+	}
+	// longest first, so a value containing another is masked as a whole
+	sort.Slice(r.values, func(i, j int) bool {
+		if len(r.values[i]) != len(r.values[j]) {
+			return len(r.values[i]) > len(r.values[j])
+		}
+		return r.values[i] < r.values[j]
+	})
+	pairs := make([]string, 0, len(r.values)*2)
+	r.starts = map[byte][]string{}
+	for _, v := range r.values {
+		pairs = append(pairs, v, Mask)
+		r.starts[v[0]] = append(r.starts[v[0]], v)
+		r.maxLength = max(r.maxLength, len(v))
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+	return r
+}
+
+// partialLength returns the length of the longest suffix of s which is the
+// start of a value. Only suffixes starting with the first byte of a value are
+// compared.
+func (r *Writer) partialLength(s string) int {
+	for i := max(0, len(s)-r.maxLength+1); i < len(s); i++ {
+		for _, v := range r.starts[s[i]] {
+			if len(v) > len(s)-i && strings.HasPrefix(v, s[i:]) {
+				return len(s) - i
+			}
+		}
+	}
+	return 0
+}
+
+func (r *Writer) Write(p []byte) (int, error) {
+	if len(r.values) == 0 {
+		return r.w.Write(p)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := r.replacer.Replace(r.pending + string(p))
+	hold := r.partialLength(out)
+	r.pending = out[len(out)-hold:]
+	if _, err := io.WriteString(r.w, out[:len(out)-hold]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes any output held back as a possible start of a value
+func (r *Writer) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending == "" {
+		return nil
+	}
+	_, err := io.WriteString(r.w, r.pending)
+	r.pending = ""
+	return err
+}
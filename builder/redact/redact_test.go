@@ -0,0 +1,98 @@
+package redact
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out, []string{"hunter2-secret", "short", "postgres://user:hunter2-secret@db/app"})
+	if _, err := w.Write([]byte("DATABASE_URL=postgres://user:hunter2-secret@db/app\nPASSWORD=hunter2-secret short\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "DATABASE_URL=***\nPASSWORD=*** short\n"
+	if out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestWriterSplitWrites(t *testing.T) {
+	input := "token: abcdefghijkl, again abcdefghijkl and abcdefg at the end abcdef"
+	// every way of splitting the input into two writes, and one byte at a time
+	for i := 0; i <= len(input); i++ {
+		var out bytes.Buffer
+		w := NewWriter(&out, []string{"abcdefghijkl"})
+		w.Write([]byte(input[:i]))
+		w.Write([]byte(input[i:]))
+		w.Flush()
+		expected := "token: ***, again *** and abcdefg at the end abcdef"
+		if out.String() != expected {
+			t.Errorf("split at %d: expected %q, got %q", i, expected, out.String())
+		}
+	}
+	var out bytes.Buffer
+	w := NewWriter(&out, []string{"abcdefghijkl"})
+	for i := range input {
+		w.Write([]byte{input[i]})
+	}
+	w.Flush()
+	if out.String() != "token: ***, again *** and abcdefg at the end abcdef" {
+		t.Errorf("byte writes: got %q", out.String())
+	}
+}
+
+func TestWriterHoldsBackPartialValue(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out, []string{"abcdefghijkl"})
+	n, err := w.Write([]byte("line\nabcdef"))
+	if err != nil || n != 11 {
+		t.Errorf("expected the whole write to be accepted, got %d, %v", n, err)
+	}
+	if out.String() != "line\n" {
+		t.Errorf("expected the possible start of a value to be held back, got %q", out.String())
+	}
+}
+
+func TestWriterHoldsBackLongestPartialValue(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out, []string{"abcdefghijkl", "xyzabcdefghi", "xyzxyzxyz"})
+	w.Write([]byte("line xyzabc"))
+	if out.String() != "line " {
+		t.Errorf("expected the longest possible start of a value to be held back, got %q", out.String())
+	}
+	w.Write([]byte("defghi done"))
+	w.Flush()
+	if out.String() != "line *** done" {
+		t.Errorf("expected the value to be masked, got %q", out.String())
+	}
+}
+
+func TestWriterNoValues(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out, []string{"", "1", "true"})
+	w.Write([]byte("DEBUG=1 ENABLED=true"))
+	w.Flush()
+	if out.String() != "DEBUG=1 ENABLED=true" {
+		t.Errorf("expected short values not to be masked, got %q", out.String())
+	}
+}
+
+func BenchmarkWriter(b *testing.B) {
+	values := make([]string, 200)
+	for i := range values {
+		values[i] = fmt.Sprintf("config-value-%03d-%s", i, strings.Repeat("x", 40))
+	}
+	w := NewWriter(io.Discard, values)
+	line := []byte("test_app.py::test_something PASSED config-value-0 [ 42%]\n")
+	b.SetBytes(int64(len(line)))
+	for i := 0; i < b.N; i++ {
+		w.Write(line)
+	}
+}
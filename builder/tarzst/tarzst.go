@@ -0,0 +1,245 @@
+// Package tarzst streams a directory as a zstd-compressed tar archive
+package tarzst
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Stats counts the files in an archive and their uncompressed size
+type Stats struct {
+	Files int
+	Bytes int64
+}
+
+// walk calls f with the relative path of every directory, regular file and
+// symlink under dir, in lexical order. Other file types can't be archived and
+// are skipped.
+func walk(dir string, f func(name, path string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() && d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		return f(filepath.ToSlash(name), path, info)
+	})
+}
+
+// Stat counts the files under dir without reading them
+func Stat(dir string) (Stats, error) {
+	stats := Stats{}
+	err := walk(dir, func(name, path string, info fs.FileInfo) error {
+		if info.Mode().IsRegular() {
+			stats.Files++
+			stats.Bytes += info.Size()
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// Digest hashes the names, permissions, link targets and content of
+// everything under dir. Modification times, and the sizes of anything but
+// regular files, are left out, so a directory restored from an archive and
+// rebuilt with the same content has the same digest.
+func Digest(dir string) (string, error) {
+	h := sha256.New()
+	err := walk(dir, func(name, path string, info fs.FileInfo) error {
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			var err error
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		// a directory's size depends on the filesystem and its history
+		size := int64(0)
+		if info.Mode().IsRegular() {
+			size = info.Size()
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00%d\x00%s\x00", name, info.Mode(), size, link)
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Write archives everything under dir to w
+func Write(w io.Writer, dir string) (Stats, error) {
+	stats := Stats{}
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return stats, err
+	}
+	tw := tar.NewWriter(zw)
+	err = walk(dir, func(name, path string, info fs.FileInfo) error {
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			var err error
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		// user and group names aren't restored, and looking them up is slow
+		header.Uname, header.Gname = "", ""
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := io.Copy(tw, f)
+		stats.Files++
+		stats.Bytes += n
+		return err
+	})
+	if err != nil {
+		zw.Close()
+		return stats, err
+	}
+	if err = tw.Close(); err != nil {
+		zw.Close()
+		return stats, err
+	}
+	return stats, zw.Close()
+}
+
+// Extract unpacks an archive written by Write into dir
+func Extract(r io.Reader, dir string) (Stats, error) {
+	stats := Stats{}
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return stats, err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return stats, err
+	}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+		path, err := targetPath(dir, header.Name)
+		if err != nil {
+			return stats, err
+		}
+		mode := fs.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, mode|0o700)
+		case tar.TypeSymlink:
+			os.Remove(path)
+			err = os.Symlink(header.Linkname, path)
+		case tar.TypeReg:
+			var n int64
+			n, err = extractFile(tr, path, mode)
+			stats.Files++
+			stats.Bytes += n
+		default:
+			continue
+		}
+		if err != nil {
+			return stats, err
+		}
+		if header.Typeflag != tar.TypeSymlink {
+			os.Chtimes(path, header.ModTime, header.ModTime)
+		}
+	}
+}
+
+// targetPath joins the name to dir, refusing names which escape it, either
+// directly or through a symlink extracted earlier in the archive
+func targetPath(dir, name string) (string, error) {
+	dir = filepath.Clean(dir)
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if path == dir {
+		return path, nil
+	}
+	if !strings.HasPrefix(path, dir+string(os.PathSeparator)) {
+		return "", fmt.Errorf("archive entry %s is outside %s", name, dir)
+	}
+	parent := dir
+	for _, part := range strings.Split(filepath.Dir(strings.TrimPrefix(path, dir+string(os.PathSeparator))), string(os.PathSeparator)) {
+		if part == "." {
+			break
+		}
+		parent = filepath.Join(parent, part)
+		info, err := os.Lstat(parent)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("archive entry %s is inside the symlink %s", name, parent)
+		}
+	}
+	return path, nil
+}
+
+func extractFile(r io.Reader, path string, mode fs.FileMode) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, err
+	}
+	// replace rather than write through an existing symlink
+	os.Remove(path)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
@@ -0,0 +1,146 @@
+package tarzst
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func writeTree(t testing.TB, dir string) {
+	t.Helper()
+	files := map[string]string{
+		"layers/node/modules.tgz": "node modules",
+		"layers/node/layer.toml":  "cache = true",
+		"index.json":              `{"manifests": []}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("node", filepath.Join(dir, "layers", "latest")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src)
+	var archive bytes.Buffer
+	written, err := Write(&archive, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written.Files != 3 {
+		t.Errorf("expected 3 files, got %+v", written)
+	}
+	dest := t.TempDir()
+	extracted, err := Extract(&archive, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extracted != written {
+		t.Errorf("expected %+v extracted, got %+v", written, extracted)
+	}
+	content, err := os.ReadFile(filepath.Join(dest, "layers", "latest", "layer.toml"))
+	if err != nil || string(content) != "cache = true" {
+		t.Errorf("expected the file through the symlink, got %q, %v", content, err)
+	}
+	stats, err := Stat(dest)
+	if err != nil || stats != written {
+		t.Errorf("expected %+v, got %+v, %v", written, stats, err)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir)
+	digest, err := Digest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// modification times don't change the digest
+	later := time.Now().Add(time.Hour)
+	if err = os.Chtimes(filepath.Join(dir, "index.json"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if unchanged, _ := Digest(dir); unchanged != digest {
+		t.Error("expected the digest to ignore modification times")
+	}
+	if err = os.WriteFile(filepath.Join(dir, "index.json"), []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := Digest(dir); changed == digest {
+		t.Error("expected the digest to change with the content")
+	}
+}
+
+func TestExtractOutsideDirectory(t *testing.T) {
+	var archive bytes.Buffer
+	zw, _ := zstd.NewWriter(&archive)
+	tw := tar.NewWriter(zw)
+	tw.WriteHeader(&tar.Header{Name: "../escaped", Typeflag: tar.TypeReg, Mode: 0o644, Size: 1})
+	tw.Write([]byte("x"))
+	tw.Close()
+	zw.Close()
+	dir := t.TempDir()
+	if _, err := Extract(&archive, filepath.Join(dir, "cache")); err == nil {
+		t.Error("expected an error for an entry outside the directory")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Error("expected nothing to be written outside the directory")
+	}
+}
+
+func TestExtractThroughSymlink(t *testing.T) {
+	var archive bytes.Buffer
+	zw, _ := zstd.NewWriter(&archive)
+	tw := tar.NewWriter(zw)
+	dir := t.TempDir()
+	outside := filepath.Join(dir, "outside")
+	if err := os.Mkdir(outside, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside})
+	tw.WriteHeader(&tar.Header{Name: "link/escaped", Typeflag: tar.TypeReg, Mode: 0o644, Size: 1})
+	tw.Write([]byte("x"))
+	tw.Close()
+	zw.Close()
+	if _, err := Extract(&archive, filepath.Join(dir, "cache")); err == nil {
+		t.Error("expected an error for an entry inside a symlink")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "escaped")); !os.IsNotExist(err) {
+		t.Error("expected nothing to be written through the symlink")
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	dir := b.TempDir()
+	// half random, half repeated, roughly like a dependency cache
+	content := make([]byte, 1<<20)
+	rand.Read(content[:len(content)/2])
+	for i := 0; i < 32; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%02d", i)), content, 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(32 << 20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Write(io.Discard, dir); err != nil {
+			b.Fatal(err)
+		}
+	}
+}